@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// 設定ファイル書き込みの定数
+const (
+	defaultFileActionMode = 0644
+	fileActionBackupExt   = ".bak"
+)
+
+// fileParameters は"file"のパラメータの構造体
+// パラメータ例：{"path": "/etc/nginx/conf.d/maintenance.conf", "content": "...", "mode": "0644", "backup": true}
+type fileParameters struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	Mode    string `json:"mode"`   // 8進数のパーミッション。省略した場合は0644
+	Backup  bool   `json:"backup"` // trueの場合は既存のファイルをpath.bakにコピーしてから置き換える
+}
+
+// fileActionHandler は設定ファイルを書き込むか置き換えるActionHandler
+type fileActionHandler struct{}
+
+// parseFileParameters はパラメータをパースしてパスとパーミッションを検証するファンクション
+func parseFileParameters(event *Event) (*fileParameters, os.FileMode, error) {
+	var params fileParameters
+	if err := parseActionParameters(event, &params); err != nil {
+		return nil, 0, err
+	}
+	if !filepath.IsAbs(params.Path) || filepath.Clean(params.Path) != params.Path {
+		return nil, 0, errors.New("File action path must be a clean absolute path: " + params.Path)
+	}
+
+	mode := os.FileMode(defaultFileActionMode)
+	if len(params.Mode) > 0 {
+		m, err := strconv.ParseUint(params.Mode, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, 0, errors.New("Invalid file mode: " + params.Mode)
+		}
+		mode = os.FileMode(m)
+	}
+	return &params, mode, nil
+}
+
+// Validate はパラメータを検証し、実行ユーザが指定されていないことを確認するファンクション
+// ファイルはAgentのプロセスが書き込むため、umaskとリソース制限は適用せずにmodeのパーミッションを設定する
+func (h *fileActionHandler) Validate(event *Event) error {
+	if _, _, err := parseFileParameters(event); err != nil {
+		return err
+	}
+	return checkInProcessAction(event)
+}
+
+// writeFileAtomic は同じディレクトリの一時ファイルに書き込んでからリネームしてファイルを置き換えるファンクション
+// リネームはパスにあるシンボリックリンク自体を置き換えるため、リンク先のファイルには書き込まない
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Execute はファイルを置き換えるファンクション
+// 置き換えるパスがシンボリックリンクの場合は、リンク先の任意のファイルを書き換えられないように拒否する
+// バックアップは元のファイルのパーミッションのまま作成する
+func (h *fileActionHandler) Execute(ctx context.Context, event *Event, result *ActionResult) error {
+	params, mode, err := parseFileParameters(event)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(params.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if info != nil && !info.Mode().IsRegular() {
+		return errors.New("File action path must be a regular file, not a symlink or special file: " + params.Path)
+	}
+
+	if params.Backup && info != nil {
+		f, err := os.OpenFile(params.Path, os.O_RDONLY|openNoFollow, 0)
+		if err != nil {
+			return err
+		}
+		old, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(params.Path+fileActionBackupExt, old, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFileAtomic(params.Path, []byte(params.Content), mode); err != nil {
+		return err
+	}
+
+	result.ExitCode = 0
+	result.Stdout = "Wrote " + strconv.Itoa(len(params.Content)) + " bytes to " + params.Path
+	return nil
+}
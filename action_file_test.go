@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileActionRefusesSymlink(t *testing.T) {
+	dir := t.TempDir()
+	victim := filepath.Join(dir, "victim")
+	if err := ioutil.WriteFile(victim, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "app.conf")
+	if err := os.Symlink(victim, target); err != nil {
+		t.Fatal(err)
+	}
+
+	event := newPolicyTestEvent(t, actionTypeFile, fileParameters{Path: target, Content: "overwritten"})
+	if err := (&fileActionHandler{}).Execute(context.Background(), event, newActionResult(event)); err == nil {
+		t.Error("writing through a symlink should fail")
+	}
+	if content, _ := ioutil.ReadFile(victim); string(content) != "original" {
+		t.Errorf("symlink target was modified: %q", content)
+	}
+}
+
+func TestFileActionBackupKeepsOriginalMode(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// バックアップのパスに置かれたシンボリックリンクも追従しない
+	victim := filepath.Join(dir, "victim")
+	if err := os.Symlink(victim, target+fileActionBackupExt); err != nil {
+		t.Fatal(err)
+	}
+
+	event := newPolicyTestEvent(t, actionTypeFile, fileParameters{Path: target, Content: "new", Mode: "0644", Backup: true})
+	if err := (&fileActionHandler{}).Execute(context.Background(), event, newActionResult(event)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(target + fileActionBackupExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm() != 0600 {
+		t.Errorf("backup mode = %v, want regular file with 0600", info.Mode())
+	}
+	if content, _ := ioutil.ReadFile(target + fileActionBackupExt); string(content) != "old" {
+		t.Errorf("backup content = %q", content)
+	}
+	if _, err := os.Stat(victim); !os.IsNotExist(err) {
+		t.Error("backup followed the symlink")
+	}
+	if info, _ := os.Stat(target); info.Mode().Perm() != 0644 {
+		t.Errorf("target mode = %v, want 0644", info.Mode())
+	}
+}
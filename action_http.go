@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxHTTPActionResponseBytes は"http"の実行結果に含めるレスポンス本文の上限
+const maxHTTPActionResponseBytes = 1024 * 1024
+
+// httpParameters は"http"のパラメータの構造体
+// パラメータ例：{"method": "POST", "url": "http://127.0.0.1:8080/admin/flush", "expected_status": 204}
+type httpParameters struct {
+	Method         string            `json:"method"`
+	URL            string            `json:"url"`
+	Headers        map[string]string `json:"headers"`
+	Body           string            `json:"body"`
+	ExpectedStatus int               `json:"expected_status"` // 0の場合は2xxを成功とする
+}
+
+// maxHTTPActionRedirects は"http"で追従するリダイレクトの上限
+const maxHTTPActionRedirects = 10
+
+// httpActionClient は"http"で使うHTTPクライアント
+// リダイレクトのたびに転送先がローカルエンドポイントかを検証し、ローカル以外への転送を拒否する
+// 環境変数のプロキシは使わない
+var httpActionClient = &http.Client{
+	Transport: &http.Transport{Proxy: nil},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxHTTPActionRedirects {
+			return errors.New("HTTP action stopped after " + strconv.Itoa(maxHTTPActionRedirects) + " redirects.")
+		}
+		if !isLoopbackHost(req.URL.Hostname()) {
+			return errors.New("HTTP action redirect must be a local endpoint: " + req.URL.String())
+		}
+		return nil
+	},
+}
+
+// httpActionHandler はAgentホストのローカルエンドポイントを呼び出すActionHandler
+type httpActionHandler struct{}
+
+// isLoopbackHost はホスト名がループバックアドレスかを返却するファンクション
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseHTTPParameters はパラメータをパースして、URLがローカルエンドポイントであることを検証するファンクション
+func parseHTTPParameters(event *Event) (*httpParameters, error) {
+	var params httpParameters
+	if err := parseActionParameters(event, &params); err != nil {
+		return nil, err
+	}
+	if len(params.Method) == 0 {
+		params.Method = "GET"
+	}
+	params.Method = strings.ToUpper(params.Method)
+
+	u, err := url.Parse(params.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("HTTP action url must be http or https: " + params.URL)
+	}
+	if !isLoopbackHost(u.Hostname()) {
+		return nil, errors.New("HTTP action url must be a local endpoint: " + params.URL)
+	}
+	return &params, nil
+}
+
+// Validate はパラメータを検証し、実行ユーザが指定されていないことを確認するファンクション
+func (h *httpActionHandler) Validate(event *Event) error {
+	if _, err := parseHTTPParameters(event); err != nil {
+		return err
+	}
+	return checkInProcessAction(event)
+}
+
+// Execute はローカルエンドポイントにHTTPリクエストを送信するファンクション
+// 期待したステータスの場合は終了コード0、それ以外は終了コード1としてレスポンス本文を標準出力に設定する
+func (h *httpActionHandler) Execute(ctx context.Context, event *Event, result *ActionResult) error {
+	params, err := parseHTTPParameters(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(params.Method, params.URL, strings.NewReader(params.Body))
+	if err != nil {
+		return err
+	}
+	for k, v := range params.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpActionClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPActionResponseBytes))
+	if err != nil {
+		return err
+	}
+	result.Stdout = string(body)
+
+	ok := 200 <= resp.StatusCode && resp.StatusCode <= 299
+	if params.ExpectedStatus > 0 {
+		ok = resp.StatusCode == params.ExpectedStatus
+	}
+	if ok {
+		result.ExitCode = 0
+	} else {
+		result.ExitCode = 1
+		result.Stderr = "Unexpected status: " + strconv.Itoa(resp.StatusCode)
+	}
+	return nil
+}
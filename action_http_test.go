@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPActionRejectsRedirectToRemoteHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/local" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(w, r, "http://192.0.2.1/steal", http.StatusFound)
+	}))
+	defer server.Close()
+
+	handler := &httpActionHandler{}
+	event := newPolicyTestEvent(t, actionTypeHTTP, httpParameters{URL: server.URL + "/redirect"})
+	if err := handler.Execute(context.Background(), event, newActionResult(event)); err == nil {
+		t.Error("redirect to a non-local host should fail")
+	}
+
+	event = newPolicyTestEvent(t, actionTypeHTTP, httpParameters{URL: server.URL + "/local", ExpectedStatus: http.StatusNoContent})
+	result := newActionResult(event)
+	if err := handler.Execute(context.Background(), event, result); err != nil || result.ExitCode != 0 {
+		t.Errorf("local request should succeed: %v exitCode=%d", err, result.ExitCode)
+	}
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// Action実行結果送信の定数
+const (
+	// ResultsChannelSize はAction実行結果を送信するまで保持するチャネルのサイズ
+	ResultsChannelSize          = 100
+	maxActionOutputRetries      = 5
+	actionOutputRetryDelaySecs  = 5
+	maxActionOutputRetryDelay   = 60
+	actionOutputRequestTypePath = "action"
+)
+
+// serverStatusError はServerが2xx以外のステータスを返却したことを示すエラー
+type serverStatusError struct {
+	Status int
+}
+
+func (e *serverStatusError) Error() string {
+	return "Server returned unexpected status: " + strconv.Itoa(e.Status)
+}
+
+// isPermanentSendError は同じ内容を再送しても受け付けられないエラーかを返却するファンクション
+// 408と429以外の4xxはリクエストの内容が拒否されたものとして扱う
+func isPermanentSendError(err error) bool {
+	statusErr, ok := err.(*serverStatusError)
+	if !ok {
+		return false
+	}
+	return 400 <= statusErr.Status && statusErr.Status <= 499 &&
+		statusErr.Status != http.StatusRequestTimeout && statusErr.Status != http.StatusTooManyRequests
+}
+
+// SendActionOutput はServerにHTTP POSTしてRunbook実行結果を送信するファンクション
+// Serverが2xx以外のステータスを返却した場合は*serverStatusErrorを返却する
+func SendActionOutput(result *ActionResult, configObj *ServerConfig) error {
+	logging.Debug("Sending the action output.", logging.Fields{"eventID": result.EventID})
+
+	// Session.Post(url, payload, result, errMsg)
+	server := configObj.get()
+	resp, err := newServerSession(server).Post(joinURL(server.EndPoint, actionOutputRequestTypePath, result.EventID), result, nil, nil)
+	if err != nil {
+		logging.Warn("Could not post the action output to server.", logging.Fields{"error": err, "response": resp})
+		return err
+	}
+
+	if 200 <= resp.Status() && resp.Status() <= 299 {
+		logging.Info("Successfully sent the action output.", logging.Fields{"eventID": result.EventID})
+		return nil
+	}
+	logging.Warn("Unexpected status from server.", logging.Fields{"status": resp.Status()})
+	return &serverStatusError{Status: resp.Status()}
+}
+
+// sendActionOutputWithRetries はSendActionOutputが失敗した場合に最大maxActionOutputRetries回リトライするファンクション
+func sendActionOutputWithRetries(result *ActionResult, configObj *ServerConfig) error {
+	var err error
+	for i := 1; i <= maxActionOutputRetries; i++ {
+		if err = SendActionOutput(result, configObj); err == nil || isPermanentSendError(err) {
+			return err
+		}
+		if i < maxActionOutputRetries {
+			sleepDelay := math.Min(float64(i*actionOutputRetryDelaySecs), maxActionOutputRetryDelay)
+			logging.Warn("Could not send the action output. Retrying..", logging.Fields{"eventID": result.EventID, "delay": sleepDelay})
+			time.Sleep(time.Second * time.Duration(sleepDelay))
+		}
+	}
+	return err
+}
+
+// ReportActionResults はresultsChannelからRunbook実行結果を取り出してServerに送信するファンクション
+// Actionの実行とは別のgo routineで動作するため、Serverの応答が遅くてもActionの実行は止まらない
+// outboxがある場合は実行結果を送信待ちファイルに保存して送信をOutbox.Runに任せ、Actionキューのメッセージは送信に成功した後にOutbox.Runが削除する
+// outboxがないか保存できなかった場合は直接送信し、送信に成功した場合のみメッセージを削除する
+func ReportActionResults(resultsChannel <-chan *ActionResult, outbox *Outbox, configObj *ServerConfig) {
+	for result := range resultsChannel {
+		if outbox != nil {
+			err := outbox.Append(result)
+			if err == nil {
+				continue
+			}
+			logging.Error("Could not save the action result to the outbox. Sending it directly.", logging.Fields{"eventID": result.EventID, "error": err})
+		}
+
+		err := sendActionOutputWithRetries(result, configObj)
+		if err != nil {
+			logging.Error("Could not send the action output. Giving up.", logging.Fields{"eventID": result.EventID, "error": err})
+		}
+		releaseEvent(result.event, err == nil)
+	}
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestTLSServer はhandlerで応答するServerのスタンドインを起動するファンクション
+// Serverへのリクエストはhttpsで送信するため、テストの間はDefaultTransportをテスト用のサーバの証明書を信頼するものに入れ替える
+func newTestTLSServer(t *testing.T, handler http.HandlerFunc) *ServerConfig {
+	server := httptest.NewTLSServer(handler)
+	transport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+		server.Close()
+	})
+	return &ServerConfig{APIKey: "key", EndPoint: strings.TrimPrefix(server.URL, "https://")}
+}
+
+func TestSendActionOutputPostsResult(t *testing.T) {
+	var mu sync.Mutex
+	var path, authorization string
+	var received ActionResult
+	configObj := newTestTLSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path = r.URL.Path
+		authorization = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&received)
+	})
+
+	result := &ActionResult{EventID: "event", InflightActionID: "inflight", RuleID: "rule", AgentID: "agent",
+		Status: ActionStatusFailed, ExitCode: 2, Stdout: "out", Stderr: "err", StartTime: 1, EndTime: 2, TimedOut: true}
+	if err := SendActionOutput(result, configObj); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if path != agentAPI+actionOutputRequestTypePath+"/event" || authorization != "Bearer key" {
+		t.Errorf("path = %q, authorization = %q", path, authorization)
+	}
+	if received.EventID != "event" || received.InflightActionID != "inflight" || received.RuleID != "rule" || received.AgentID != "agent" ||
+		received.ExitCode != 2 || received.Stdout != "out" || received.Stderr != "err" || received.StartTime != 1 || received.EndTime != 2 || !received.TimedOut {
+		t.Errorf("received = %+v", received)
+	}
+}
+
+func TestSendActionOutputDoesNotRetryRejectedResult(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	configObj := newTestTLSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	})
+
+	err := sendActionOutputWithRetries(&ActionResult{EventID: "event"}, configObj)
+	if statusErr, ok := err.(*serverStatusError); !ok || statusErr.Status != http.StatusUnprocessableEntity {
+		t.Errorf("err = %v, want the server status", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("rejected result was sent %d times, want 1", requests)
+	}
+}
+
+func TestIsPermanentSendError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&serverStatusError{Status: http.StatusBadRequest}, true},
+		{&serverStatusError{Status: http.StatusNotFound}, true},
+		{&serverStatusError{Status: http.StatusRequestTimeout}, false},
+		{&serverStatusError{Status: http.StatusTooManyRequests}, false},
+		{&serverStatusError{Status: http.StatusInternalServerError}, false},
+		{&serverStatusError{Status: http.StatusBadGateway}, false},
+		{http.ErrHandlerTimeout, false},
+	}
+	for _, test := range tests {
+		if got := isPermanentSendError(test.err); got != test.want {
+			t.Errorf("isPermanentSendError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// TestReportActionResultsDeletesOnlySentResults は送信待ちファイルがない場合に、送信に成功した実行結果のメッセージだけを削除することを確認するテスト
+func TestReportActionResultsDeletesOnlySentResults(t *testing.T) {
+	configObj := newTestTLSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/rejected") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	queue := &fakeActionQueue{}
+	results := make(chan *ActionResult, 2)
+	for _, eventID := range []string{"rejected", "accepted"} {
+		results <- newActionResult(&Event{EventID: eventID, ReceiptHandle: eventID, queue: queue})
+	}
+	close(results)
+
+	ReportActionResults(results, nil, configObj)
+	if deleted := queue.deletedHandles(); len(deleted) != 1 || deleted[0] != "accepted" {
+		t.Errorf("deleted = %v, want only the accepted result", deleted)
+	}
+}
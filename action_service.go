@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"regexp"
+)
+
+// systemctlPath はsystemdのユニットを操作するコマンド。PATHの検索に依存しないように絶対パスで指定する
+const systemctlPath = "/bin/systemctl"
+
+// serviceUnitRegex はsystemdのユニット名の正規表現
+var serviceUnitRegex = regexp.MustCompile(`^[A-Za-z0-9@_.:-]+$`)
+
+// serviceOperations は"service"で許可する操作
+var serviceOperations = map[string]bool{
+	"start":   true,
+	"stop":    true,
+	"restart": true,
+	"reload":  true,
+}
+
+// serviceParameters は"service"のパラメータの構造体
+// パラメータ例：{"unit": "nginx.service", "operation": "restart"}
+type serviceParameters struct {
+	Unit      string `json:"unit"`
+	Operation string `json:"operation"`
+}
+
+// serviceActionHandler はsystemdのユニットを起動、停止、再起動するActionHandler
+type serviceActionHandler struct{}
+
+// parseServiceParameters はパラメータをパースしてユニット名と操作を検証するファンクション
+func parseServiceParameters(event *Event) (*serviceParameters, error) {
+	var params serviceParameters
+	if err := parseActionParameters(event, &params); err != nil {
+		return nil, err
+	}
+	if !serviceUnitRegex.MatchString(params.Unit) {
+		return nil, errors.New("Invalid service unit: " + params.Unit)
+	}
+	if !serviceOperations[params.Operation] {
+		return nil, errors.New("Unsupported service operation: " + params.Operation)
+	}
+	return &params, nil
+}
+
+// serviceCommand はユニットを操作するsystemctlのコマンドと引数を返却するファンクション
+func serviceCommand(params *serviceParameters) []string {
+	return []string{systemctlPath, params.Operation, "--", params.Unit}
+}
+
+// Validate はパラメータを検証するファンクション
+// systemdのユニットの操作にはAgentの権限が必要なため、実行ユーザを指定した場合は拒否する
+func (h *serviceActionHandler) Validate(event *Event) error {
+	if _, err := parseServiceParameters(event); err != nil {
+		return err
+	}
+	return checkRunsAsAgent(event, "controls systemd with the agent's privileges")
+}
+
+// Execute はsystemctlでユニットを操作するファンクション
+func (h *serviceActionHandler) Execute(ctx context.Context, event *Event, result *ActionResult) error {
+	params, err := parseServiceParameters(event)
+	if err != nil {
+		return err
+	}
+	argv := serviceCommand(params)
+	return runCommand(ctx, event, result, argv[0], argv[1:]...)
+}
@@ -0,0 +1,227 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// Action出力ストリーミングの定数
+const (
+	outputStreamRequestPath = "output"
+	outputStreamStdout      = "stdout"
+	outputStreamStderr      = "stderr"
+	// outputChunkSize は1つのチャンクに含める出力の最大バイト数
+	outputChunkSize = 16 * 1024
+	// outputStreamBufferSize は送信待ちのチャンクを保持する数。超えた場合はチャンクを破棄する
+	outputStreamBufferSize       = 64
+	maxOutputChunkRetries        = 3
+	outputChunkRetryDelaySecs    = 1
+	maxOutputChunkRetryDelaySecs = 10
+)
+
+// OutputChunk は実行中のActionの出力の一部をServerに送信する構造体
+// Sequenceは1から始まる連番で、破棄されたチャンクの分は欠番になる
+type OutputChunk struct {
+	EventID  string
+	Sequence int64
+	Stream   string // "stdout"または"stderr"
+	Data     string
+	Time     int64
+}
+
+// OutputSummary は出力のストリーミングの最後に送信する構造体
+type OutputSummary struct {
+	EventID       string
+	Final         bool
+	LastSequence  int64 // 生成した最後のチャンクの連番
+	SentChunks    int
+	DroppedChunks int
+	DroppedBytes  int
+	Status        string
+	ExitCode      int
+}
+
+// outputStreamConfig は出力をストリーミングするServerの設定。nilの場合はストリーミングしない
+var outputStreamConfig = struct {
+	sync.RWMutex
+	configObj *ServerConfig
+}{}
+
+// ConfigureOutputStreaming はActionの出力をストリーミングするServerを設定するファンクション
+// configObjがnilの場合はストリーミングを無効にする
+func ConfigureOutputStreaming(configObj *ServerConfig) {
+	outputStreamConfig.Lock()
+	outputStreamConfig.configObj = configObj
+	outputStreamConfig.Unlock()
+}
+
+// outputStream は1つのActionの出力をチャンクに分けて順番にServerに送信する
+// 書き込みはブロックせず、送信が追いつかずにバッファが一杯の場合はチャンクを破棄して数を記録する
+type outputStream struct {
+	eventID   string
+	configObj *ServerConfig
+	chunks    chan *OutputChunk
+
+	mu            sync.Mutex
+	closed        bool
+	sequence      int64
+	droppedChunks int
+	droppedBytes  int
+	sentChunks    int
+	status        string
+	exitCode      int
+}
+
+// startOutputStream はEventの出力のストリーミングを開始するファンクション
+// ストリーミングが設定されていない場合はnilを返却する
+func startOutputStream(event *Event) *outputStream {
+	outputStreamConfig.RLock()
+	configObj := outputStreamConfig.configObj
+	outputStreamConfig.RUnlock()
+	if configObj == nil {
+		return nil
+	}
+
+	s := &outputStream{
+		eventID:   event.EventID,
+		configObj: configObj,
+		chunks:    make(chan *OutputChunk, outputStreamBufferSize),
+	}
+	go s.run()
+	return s
+}
+
+// writer は指定したストリームの出力をチャンクにするio.Writerを返却するファンクション
+func (s *outputStream) writer(stream string) io.Writer {
+	return &outputStreamWriter{stream: s, name: stream}
+}
+
+// push は出力をチャンクに分けて送信待ちにするファンクション
+func (s *outputStream) push(stream string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for len(p) > 0 {
+		n := len(p)
+		if n > outputChunkSize {
+			n = outputChunkSize
+		}
+		s.sequence++
+		chunk := &OutputChunk{
+			EventID:  s.eventID,
+			Sequence: s.sequence,
+			Stream:   stream,
+			Data:     string(p[:n]),
+			Time:     nowInMillis(),
+		}
+		select {
+		case s.chunks <- chunk:
+		default:
+			s.droppedChunks++
+			s.droppedBytes += n
+		}
+		p = p[n:]
+	}
+}
+
+// close はActionの終了を記録してストリーミングを終了するファンクション
+// 送信待ちのチャンクと最後のOutputSummaryは別のgo routineで送信するため、Actionの実行は待たない
+func (s *outputStream) close(result *ActionResult) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.status = result.Status
+	s.exitCode = result.ExitCode
+	close(s.chunks)
+}
+
+// run は送信待ちのチャンクを順番に送信し、最後にOutputSummaryを送信するファンクション
+func (s *outputStream) run() {
+	for chunk := range s.chunks {
+		if err := s.postWithRetries(chunk); err != nil {
+			logging.Warn("Could not stream the action output. Dropping the chunk.", logging.Fields{"eventID": s.eventID, "sequence": chunk.Sequence, "error": err})
+			s.mu.Lock()
+			s.droppedChunks++
+			s.droppedBytes += len(chunk.Data)
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Lock()
+		s.sentChunks++
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	summary := &OutputSummary{
+		EventID:       s.eventID,
+		Final:         true,
+		LastSequence:  s.sequence,
+		SentChunks:    s.sentChunks,
+		DroppedChunks: s.droppedChunks,
+		DroppedBytes:  s.droppedBytes,
+		Status:        s.status,
+		ExitCode:      s.exitCode,
+	}
+	s.mu.Unlock()
+	if err := s.postWithRetries(summary); err != nil {
+		logging.Warn("Could not send the output summary.", logging.Fields{"eventID": s.eventID, "error": err})
+		return
+	}
+	logging.Debug("Finished streaming the action output.", logging.Fields{"eventID": s.eventID, "chunks": summary.SentChunks, "dropped": summary.DroppedChunks})
+}
+
+// postWithRetries はServerにHTTP POSTし、失敗した場合は間隔を延ばしながら最大maxOutputChunkRetries回リトライするファンクション
+// 送信している間はチャンクがバッファに溜まるため、Serverの応答が遅い場合はバッファが一杯になり出力が破棄される
+func (s *outputStream) postWithRetries(payload interface{}) error {
+	var err error
+	for i := 1; i <= maxOutputChunkRetries; i++ {
+		if err = s.post(payload); err == nil {
+			return nil
+		}
+		if i < maxOutputChunkRetries {
+			sleepDelay := math.Min(float64(int(outputChunkRetryDelaySecs)<<uint(i-1)), maxOutputChunkRetryDelaySecs)
+			time.Sleep(time.Second * time.Duration(sleepDelay))
+		}
+	}
+	return err
+}
+
+// post はServerにHTTP POSTしてチャンクまたはOutputSummaryを送信するファンクション
+func (s *outputStream) post(payload interface{}) error {
+	server := s.configObj.get()
+	url := joinURL(server.EndPoint, actionOutputRequestTypePath, s.eventID, outputStreamRequestPath)
+	resp, err := newServerSession(server).Post(url, payload, nil, nil)
+	if err != nil {
+		return err
+	}
+	if 200 <= resp.Status() && resp.Status() <= 299 {
+		return nil
+	}
+	return errors.New("Server returned unexpected status: " + strconv.Itoa(resp.Status()))
+}
+
+// outputStreamWriter はoutputStreamに出力を書き込むio.Writer
+type outputStreamWriter struct {
+	stream *outputStream
+	name   string
+}
+
+// Write は出力をoutputStreamに書き込むファンクション。プロセスを止めないように常に成功させる
+func (w *outputStreamWriter) Write(p []byte) (int, error) {
+	w.stream.push(w.name, p)
+	return len(p), nil
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOutputStreamCountsDroppedChunks は送信待ちが一杯の時に破棄したチャンクを数え、OutputSummaryで送信することを確認するテスト
+func TestOutputStreamCountsDroppedChunks(t *testing.T) {
+	chunks := make(chan OutputChunk, outputStreamBufferSize*2)
+	summaries := make(chan OutputSummary, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content, _ := json.Marshal(payload)
+		if _, ok := payload["Final"]; ok {
+			var summary OutputSummary
+			json.Unmarshal(content, &summary)
+			summaries <- summary
+		} else {
+			var chunk OutputChunk
+			json.Unmarshal(content, &chunk)
+			chunks <- chunk
+		}
+	}))
+	transport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	defer func() {
+		http.DefaultTransport = transport
+		server.Close()
+	}()
+
+	// 送信が追いつかない状態にするため、送信を始める前に送信待ちを超えるチャンクを書き込む
+	const extra = 5
+	s := &outputStream{
+		eventID:   "event",
+		configObj: &ServerConfig{EndPoint: strings.TrimPrefix(server.URL, "https://")},
+		chunks:    make(chan *OutputChunk, outputStreamBufferSize),
+	}
+	writer := s.writer(outputStreamStdout)
+	for i := 0; i < outputStreamBufferSize+extra; i++ {
+		if n, err := writer.Write([]byte("line\n")); n != 5 || err != nil {
+			t.Fatalf("Write = %d, %v; writes should never fail", n, err)
+		}
+	}
+	result := &ActionResult{Status: ActionStatusSucceeded, ExitCode: 0}
+	s.close(result)
+	go s.run()
+
+	var summary OutputSummary
+	select {
+	case summary = <-summaries:
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for the output summary")
+	}
+	want := OutputSummary{
+		EventID:       "event",
+		Final:         true,
+		LastSequence:  outputStreamBufferSize + extra,
+		SentChunks:    outputStreamBufferSize,
+		DroppedChunks: extra,
+		DroppedBytes:  extra * 5,
+		Status:        ActionStatusSucceeded,
+	}
+	if summary != want {
+		t.Errorf("summary = %+v, want %+v", summary, want)
+	}
+	close(chunks)
+	var sequence int64
+	for chunk := range chunks {
+		sequence++
+		if chunk.Sequence != sequence || chunk.Stream != outputStreamStdout || chunk.Data != "line\n" {
+			t.Errorf("chunk = %+v, want sequence %d", chunk, sequence)
+		}
+	}
+	if sequence != outputStreamBufferSize {
+		t.Errorf("received %d chunks, want %d", sequence, outputStreamBufferSize)
+	}
+}
+
+func TestOutputStreamSplitsLargeWrites(t *testing.T) {
+	s := &outputStream{eventID: "event", chunks: make(chan *OutputChunk, outputStreamBufferSize)}
+	s.push(outputStreamStderr, make([]byte, outputChunkSize*2+1))
+	close(s.chunks)
+
+	var sizes []int
+	for chunk := range s.chunks {
+		sizes = append(sizes, len(chunk.Data))
+	}
+	if len(sizes) != 3 || sizes[0] != outputChunkSize || sizes[1] != outputChunkSize || sizes[2] != 1 {
+		t.Errorf("chunk sizes = %v", sizes)
+	}
+	if s.droppedChunks != 0 || s.sequence != 3 {
+		t.Errorf("dropped = %d, sequence = %d", s.droppedChunks, s.sequence)
+	}
+}
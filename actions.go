@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+// Action種別の定数
+const (
+	actionTypeScript  = "script"
+	actionTypeExec    = "exec"
+	actionTypeHTTP    = "http"
+	actionTypeService = "service"
+	actionTypeFile    = "file"
+
+	shellPath        = "/bin/sh"
+	shellCommandFlag = "-c"
+	shellStdinFlag   = "-s"
+)
+
+// ActionHandler はAction種別ごとの実行処理のインタフェース
+// どのAction種別も実行結果は同じActionResultの形で返却する
+type ActionHandler interface {
+	// Validate はActionを実行する前にEventのパラメータを検証する
+	Validate(event *Event) error
+	// Execute はActionを実行してresultに終了コードや出力を設定する
+	// ctxの期限はEventのタイムアウト値
+	Execute(ctx context.Context, event *Event, result *ActionResult) error
+}
+
+// actionHandlers はAction種別ごとのActionHandlerを保持する
+var actionHandlers = struct {
+	sync.RWMutex
+	handlers map[string]ActionHandler
+}{handlers: map[string]ActionHandler{}}
+
+func init() {
+	RegisterActionHandler(actionTypeScript, &scriptActionHandler{})
+	RegisterActionHandler(actionTypeExec, &execActionHandler{})
+	RegisterActionHandler(actionTypeHTTP, &httpActionHandler{})
+	RegisterActionHandler(actionTypeService, &serviceActionHandler{})
+	RegisterActionHandler(actionTypeFile, &fileActionHandler{})
+}
+
+// RegisterActionHandler はAction種別にActionHandlerを登録するファンクション
+// 同じAction種別を登録した場合は後から登録したActionHandlerに置き換える
+func RegisterActionHandler(actionType string, handler ActionHandler) {
+	actionHandlers.Lock()
+	actionHandlers.handlers[actionType] = handler
+	actionHandlers.Unlock()
+}
+
+// getActionHandler はAction種別に登録されたActionHandlerを返却するファンクション
+func getActionHandler(actionType string) (ActionHandler, error) {
+	actionHandlers.RLock()
+	defer actionHandlers.RUnlock()
+	handler, ok := actionHandlers.handlers[actionType]
+	if !ok {
+		return nil, errors.New("Unsupported action type: " + actionType)
+	}
+	return handler, nil
+}
+
+// parseActionParameters はEventのParametersをAction種別ごとのパラメータの構造体にパースするファンクション
+func parseActionParameters(event *Event, params interface{}) error {
+	if len(event.Parameters) == 0 {
+		return errors.New("Event does not have parameters for action type: " + event.ActionType)
+	}
+	if err := json.Unmarshal(event.Parameters, params); err != nil {
+		return errors.New("Could not parse the action parameters. Error: " + err.Error())
+	}
+	return nil
+}
+
+// scriptActionHandler はRawCommandまたはRunbookをシェルで実行するActionHandler
+type scriptActionHandler struct{}
+
+// Validate はRawCommandかRunbookのリポジトリがあることを検証するファンクション
+func (h *scriptActionHandler) Validate(event *Event) error {
+	if len(event.RawCommand) == 0 && len(event.GithubFilePath) == 0 {
+		return errors.New("Event does not have raw command nor runbook repository.")
+	}
+	return nil
+}
+
+// Execute はRawCommandがある場合はRawCommandを、ない場合はGithubFilePathのリポジトリから取得したRunbookを実行するファンクション
+// Runbookのキャッシュは実行ユーザから読めないため、Agentが読み込んだ内容をシェルの標準入力に渡す
+func (h *scriptActionHandler) Execute(ctx context.Context, event *Event, result *ActionResult) error {
+	if len(event.RawCommand) > 0 {
+		return runCommand(ctx, event, result, shellPath, shellCommandFlag, event.RawCommand)
+	}
+	path, err := resolveRunbook(event)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return runCommandWithInput(ctx, event, result, bytes.NewReader(content), shellPath, shellStdinFlag)
+}
+
+// execParameters は"exec"のパラメータの構造体
+// パラメータ例：{"args": ["/usr/sbin/nginx", "-s", "reload"]}
+type execParameters struct {
+	Args []string `json:"args"`
+}
+
+// execActionHandler はシェルを介さずにコマンドを実行するActionHandler
+type execActionHandler struct{}
+
+// Validate はコマンドが絶対パスで指定されていることを検証するファンクション
+func (h *execActionHandler) Validate(event *Event) error {
+	var params execParameters
+	if err := parseActionParameters(event, &params); err != nil {
+		return err
+	}
+	if len(params.Args) == 0 {
+		return errors.New("Exec action does not have args.")
+	}
+	if !filepath.IsAbs(params.Args[0]) {
+		return errors.New("Exec action command must be an absolute path: " + params.Args[0])
+	}
+	return nil
+}
+
+// Execute はargsの先頭をコマンド、残りを引数として実行するファンクション
+func (h *execActionHandler) Execute(ctx context.Context, event *Event, result *ActionResult) error {
+	var params execParameters
+	if err := parseActionParameters(event, &params); err != nil {
+		return err
+	}
+	return runCommand(ctx, event, result, params.Args[0], params.Args[1:]...)
+}
@@ -1,17 +1,26 @@
 package agent
 
-import "strings"
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/jmcvetta/napping.v3"
+)
 
 const (
 	agentAPI = "/api/v1/agent/"
 	protocol = "https://"
 	slash    = "/"
+	// serverRequestTimeoutSecs はServerへのリクエストが応答するまで待つ秒数
+	serverRequestTimeoutSecs = 30
 )
 
 // Event はServerから送信する単一のSQSメッセージの構造体
 // 1つのEventは1つのRunbookに対応する
 type Event struct {
-	Timestamp        int64             `json:"timestamp"`
+	Timestamp        int64             `json:"timestamp"` //Eventを作成した時刻(ミリ秒)。MaxEventAgeSecsより古いEventは拒否する
 	Source           string            `json:"source"`
 	HostName         string            `json:"hostname"`
 	ActionType       string            `json:"action_type"`
@@ -24,9 +33,26 @@ type Event struct {
 	Signature        string            `json:"signature"`
 	Timeout          int32             `json:"timeout"`
 	GithubFilePath   string            `json:"github_filepath"`
+	GithubRef        string            `json:"github_ref"` //Runbookのブランチ名、タグ名またはコミットSHA。デフォルトはmaster
+	Checksum         string            `json:"checksum"`   //RunbookのSHA-256(16進数)
 	Enviroment       map[string]string `json:"env"`
+	Parameters       json.RawMessage   `json:"params"` //ActionType(exec、http、service、file)ごとのパラメータ
 	SQSMessageID     string            //SQSメッセージから取得
 	ReceiptHandle    string            //SQSメッセージから取得
+	queue            ActionQueue       //Action実行結果の送信後のメッセージ削除で使う
+	keepalive        *visibilityKeepalive
+}
+
+// newServerSession はAPIキーをAuthorizationヘッダで送信するnappingのSessionを生成するファンクション
+// APIキーはURLに含めないため、ServerやプロキシのアクセスログにAPIキーが残らない
+// Serverが応答しない場合に送信するgo routineが止まらないように、serverRequestTimeoutSecsでリクエストを打ち切る
+func newServerSession(server ServerConfig) *napping.Session {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+server.APIKey.Value())
+	return &napping.Session{
+		Header: &header,
+		Client: &http.Client{Timeout: time.Second * serverRequestTimeoutSecs},
+	}
 }
 
 // joinURL はAPIリクエストURLを構成するファンクション
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerSessionSendsAPIKeyWithTimeout(t *testing.T) {
+	session := newServerSession(ServerConfig{APIKey: "key"})
+	if session.Client == nil || session.Client.Timeout <= 0 {
+		t.Fatalf("server session must have a client timeout: %+v", session.Client)
+	}
+	if got := session.Header.Get("Authorization"); got != "Bearer key" {
+		t.Errorf("Authorization = %q, want Bearer key", got)
+	}
+}
+
+func TestServerSessionTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	session := newServerSession(ServerConfig{})
+	session.Client.Timeout = time.Millisecond * 100
+	done := make(chan error, 1)
+	go func() {
+		_, err := session.Get(server.URL, nil, nil, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "Timeout") {
+			t.Errorf("err = %v, want a timeout", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("request to a stalled server did not time out")
+	}
+}
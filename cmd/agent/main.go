@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+
+	"github.com/tsubauaaa/agent/cmd"
+)
+
+// agentコマンド。サブコマンドはcmd.Mainを参照
+func main() {
+	os.Exit(cmd.Main(os.Args[1:]))
+}
@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/tsubauaaa/agent"
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// usage はagentコマンドの使い方
+const usage = `Usage: agent <command> [flags]
+
+Commands:
+  run                     Run the agent in the foreground.
+  register                Register the agent once and print the AgentID.
+  status [-address addr]  Show the status of the running agent.
+  config show             Print the effective config. The API key is redacted.
+  config validate         Validate the config and print all problems.
+  exec-event <file.json>  Process an event (signed with -signature or -sign-key) or a local queue message
+                          like "run" and print the action result.
+  version                 Print the agent version.
+
+Flags shared by run, register, status, config and exec-event:
+  -config    path to the agent config file.
+  -endpoint  API endpoint at which the agent should register.
+  -api_key   API key for your account.
+`
+
+// Main はagentコマンドのファンクション。argsはコマンド名を除いたコマンドライン引数で、終了コードを返却する
+// 全てのサブコマンドは同じ規則(コマンドライン引数 > 環境変数 > 設定ファイル > デフォルト値)で設定を読み込む
+func Main(args []string) int {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "run":
+		return runCommand(args[1:])
+	case "register":
+		return registerCommand(args[1:])
+	case "status":
+		return statusCommand(args[1:])
+	case "config":
+		if len(args) > 1 {
+			switch args[1] {
+			case "show":
+				return ConfigShow(args[2:])
+			case "validate":
+				return ConfigValidate(args[2:])
+			}
+		}
+	case "exec-event":
+		return execEventCommand(args[1:])
+	case "version":
+		fmt.Printf("agent version %s\n", agent.AgentVersion)
+		return 0
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return 0
+	}
+	fmt.Print(usage)
+	return 2
+}
+
+// setupStderrLogger はワンショットのサブコマンドのログを標準エラー出力に出力するファンクション
+// 標準出力にはコマンドの結果だけを出力する
+func setupStderrLogger(agentConfig agent.AgentConfig) {
+	logConfig := logging.LogConfig{Format: agentConfig.LogFormat, Sinks: []logging.SinkConfig{{Type: logging.SinkStderr}}}
+	if err := logging.SetupLogger(logConfig, agentConfig.DebugMode, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not setup logger. Error: %v\n", err)
+	}
+}
+
+// runCommand は"agent run"コマンドのファンクション。SIGINTかSIGTERMを受け取るまでAgentをフォアグラウンドで実行する
+func runCommand(args []string) int {
+	var options configOptions
+	if err := newFlagSet("run", &options).Parse(args); err != nil {
+		return 2
+	}
+
+	errs := make(chan error, 5)
+	exitCh := make(chan struct{})
+	go func() {
+		for err := range errs {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		logging.Info("Stopping the agent.", logging.Fields{"signal": sig.String()})
+		close(exitCh)
+	}()
+
+	if err := runAgent(options, errs, exitCh); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// registerCommand は"agent register"コマンドのファンクション
+// AgentRegistrationを1回だけ行い、成功した場合はAgentIDを出力する。リトライはしない
+func registerCommand(args []string) int {
+	var options configOptions
+	if err := newFlagSet("register", &options).Parse(args); err != nil {
+		return 2
+	}
+	_, serverConfig, agentConfig, ok := options.loadValidConfig()
+	if !ok {
+		return 1
+	}
+	setupStderrLogger(agentConfig)
+
+	metaData, err := agent.GetHostMetaData(&agentConfig)
+	if err != nil {
+		fmt.Printf("Could not get metadata from host. Error: %v\n", err)
+		return 1
+	}
+	regInfo, err := agent.RegisterAgent(metaData, &serverConfig)
+	if err != nil {
+		fmt.Printf("Could not register the agent. Error: %v\n", err)
+		return 1
+	}
+	fmt.Println(regInfo.AgentID)
+	return 0
+}
+
+// statusCommand は"agent status"コマンドのファンクション
+// 実行中のAgentのローカル制御エンドポイントからステータスを取得して出力する
+// -addressを指定しない場合は設定ファイルのControlAddressを使う。認証トークンは設定ファイルのStateDirから読み込む
+func statusCommand(args []string) int {
+	var options configOptions
+	var address string
+	flags := newFlagSet("status", &options)
+	flags.StringVar(&address, "address", "", "address of the local control endpoint of the running agent.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	configFilePath, _, agentConfig, err := options.load(make(chan error, 1))
+	if err != nil {
+		fmt.Printf("Could not load the config. Error: %v\n", err)
+		return 1
+	}
+	if len(address) == 0 {
+		address = agentConfig.ControlAddress
+	}
+
+	stateDir := agent.ResolveConfigPath(configFilePath, agentConfig.StateDir)
+	status, err := agent.QueryAgentStatus(address, stateDir)
+	if err != nil {
+		fmt.Printf("Could not get the status of the agent. Is the agent running? Error: %v\n", err)
+		return 1
+	}
+	lastPoll := "never"
+	if status.LastPollTime > 0 {
+		lastPoll = time.Unix(0, status.LastPollTime*int64(time.Millisecond)).Format(time.RFC3339)
+	}
+	fmt.Printf("Version:          %s\n", status.AgentVersion)
+	fmt.Printf("AgentID:          %s\n", status.AgentID)
+	fmt.Printf("Uptime:           %v\n", time.Duration(status.Uptime)*time.Millisecond)
+	fmt.Printf("Last poll:        %s\n", lastPoll)
+	fmt.Printf("Poll interval:    %ds\n", status.PollIntervalSecs)
+	fmt.Printf("Inflight actions: %d\n", status.InflightActions)
+	fmt.Printf("Queued actions:   %d\n", status.QueuedActions)
+	fmt.Printf("Paused:           %v\n", status.Paused)
+	fmt.Printf("Log level:        %s (base: %s)\n", status.LogLevel, status.BaseLogLevel)
+	return 0
+}
+
+// exec-eventの定数
+const (
+	// execEventSendTimeoutSecs は実行結果をServerに送信し終えるまで待つ秒数
+	execEventSendTimeoutSecs = 60
+)
+
+// readExecEventMessage はexec-eventのファイルを読み込み、ローカルキューのメッセージファイルの内容とagentIDを返却するファンクション
+// ファイルがローカルキューのメッセージファイル({"Attributes": ..., "Body": ...})の場合はそのまま使う
+// msg.jsonのようなEventのファイルの場合は、ファイルの内容を本文、EventのagentidをagentID属性として、
+// signatureかsignKeyFileの秘密鍵で署名したsignature属性を付ける
+func readExecEventMessage(path, signature, signKeyFile, keyID string) ([]byte, string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var message struct {
+		Attributes map[string]string
+		Body       string
+	}
+	if err := json.Unmarshal(content, &message); err != nil {
+		return nil, "", err
+	}
+	if len(message.Body) > 0 {
+		return content, message.Attributes["agentID"], nil
+	}
+
+	var event agent.Event
+	if err := json.Unmarshal(content, &event); err != nil {
+		return nil, "", err
+	}
+	if len(event.AgentID) == 0 {
+		return nil, "", errors.New("The event does not have agentid.")
+	}
+	if len(signature) == 0 {
+		if len(signKeyFile) == 0 {
+			return nil, "", errors.New("An event file needs -signature or -sign-key.")
+		}
+		key, err := ioutil.ReadFile(signKeyFile)
+		if err != nil {
+			return nil, "", err
+		}
+		if signature, err = agent.SignMessage(content, keyID, key); err != nil {
+			return nil, "", err
+		}
+	}
+	encoded, err := agent.EncodeLocalQueueMessage(event.AgentID, signature, content)
+	return encoded, event.AgentID, err
+}
+
+// execEventCommand は"agent exec-event"コマンドのファンクション
+// msg.jsonのようなEventのファイルかローカルキューのメッセージファイルを一時的なローカルキューに入れ、
+// runと同じActionキューのポーリング、署名検証、Action実行記録、ローカル実行ポリシー、実行結果の送信の処理で実行して、実行結果をJSONで出力する
+// AgentRegistrationは行わないため、メッセージのagentIDをこのAgentのAgentIDとして扱い、署名はAgentConfigで固定した公開鍵で検証する
+// 実行中のAgentの状態保存ディレクトリと競合しないように、Action実行記録は一時ディレクトリに作成し、送信待ちファイルは使わない
+func execEventCommand(args []string) int {
+	var options configOptions
+	var signature, signKeyFile, keyID string
+	flags := newFlagSet("exec-event", &options)
+	flags.StringVar(&signature, "signature", "", "signature attribute (keyid:base64) of the event file.")
+	flags.StringVar(&signKeyFile, "sign-key", "", "path to a PEM (PKCS#8) Ed25519 or RSA private key to sign the event file with.")
+	flags.StringVar(&keyID, "key-id", "local", "key id of -sign-key. The public key must be in VerificationKeys with this key id.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: agent exec-event [flags] <event.json>")
+		return 2
+	}
+	configFilePath, serverConfig, agentConfig, ok := options.loadValidConfig()
+	if !ok {
+		return 1
+	}
+	setupStderrLogger(agentConfig)
+
+	content, agentID, err := readExecEventMessage(flags.Arg(0), signature, signKeyFile, keyID)
+	if err != nil {
+		fmt.Printf("Could not read the event file. Error: %v\n", err)
+		return 1
+	}
+
+	if err := configureActions(configFilePath, &agentConfig); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	// メッセージを一時的なローカルキューに送信し、runと同じ処理で受信させる
+	tmpDir, err := ioutil.TempDir("", "agent-exec-event")
+	if err != nil {
+		fmt.Printf("Could not create the local queue. Error: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(tmpDir)
+	queueDir := filepath.Join(tmpDir, "queue")
+	if err := agent.WriteLocalQueueMessage(queueDir, "exec-event", content); err != nil {
+		fmt.Printf("Could not write the message to the local queue. Error: %v\n", err)
+		return 1
+	}
+	agentConfig.ActionQueueType = agent.QueueTypeLocal
+	agentConfig.LocalQueueDir = queueDir
+	ledger, err := agent.OpenActionLedger(filepath.Join(tmpDir, "state"))
+	if err != nil {
+		fmt.Printf("Could not open the action ledger. Error: %v\n", err)
+		return 1
+	}
+
+	regManager := agent.NewRegistrationManager(agent.HostMetaData{}, &serverConfig, agentConfig.VerificationKeys)
+	regManager.SetLocalAgentID(agentID)
+	agent.ConfigureMaxEventAge(agentConfig.MaxEventAgeSecs)
+
+	resultCh := make(chan *agent.ActionResult, 1)
+	errs := make(chan error, 5)
+	pipeline := startActionPipeline(regManager, &agentConfig, make(chan string), make(chan time.Time, 1), ledger, nil, &serverConfig, errs,
+		func(result *agent.ActionResult) { resultCh <- result })
+
+	// 署名の検証などで拒否されたメッセージは削除されるため、実行結果がないままキューが空になる
+	var result *agent.ActionResult
+	ticker := time.NewTicker(time.Millisecond * 200)
+	for result == nil {
+		select {
+		case result = <-resultCh:
+		case err := <-errs:
+			fmt.Printf("Could not process the message. Error: %v\n", err)
+			return 1
+		case <-ticker.C:
+			if n, err := agent.LocalQueueLength(queueDir); err == nil && n == 0 {
+				select {
+				case result = <-resultCh:
+				default:
+					ticker.Stop()
+					fmt.Println("The message was rejected. See the log for the reason.")
+					pipeline.stop()
+					return 1
+				}
+			}
+		}
+	}
+	ticker.Stop()
+
+	output, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		fmt.Printf("Could not print the action result. Error: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(output))
+
+	// Serverが応答しない場合にコマンドが終わらないように、送信を待つ時間には上限を設ける
+	stopped := make(chan struct{})
+	go func() {
+		pipeline.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * execEventSendTimeoutSecs):
+		fmt.Fprintf(os.Stderr, "Could not send the action result to the server in %ds.\n", execEventSendTimeoutSecs)
+		return 1
+	}
+	if result.Status != agent.ActionStatusSucceeded {
+		return 1
+	}
+	return 0
+}
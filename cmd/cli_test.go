@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsubauaaa/agent"
+)
+
+// execEventTestEnv はexec-eventのテスト用の設定ファイル、署名鍵、Serverのスタンドイン
+type execEventTestEnv struct {
+	dir        string
+	configPath string
+	keyPath    string
+	received   chan agent.ActionResult
+}
+
+// newExecEventTestEnv はEd25519の鍵を生成し、公開鍵を固定した設定ファイルとServerのスタンドインを用意するファンクション
+// 実行結果はhttpsで送信されるため、テストの間はDefaultTransportをテスト用のサーバの証明書を信頼するものに入れ替える
+func newExecEventTestEnv(t *testing.T) *execEventTestEnv {
+	env := &execEventTestEnv{dir: t.TempDir(), received: make(chan agent.ActionResult, 10)}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.keyPath = filepath.Join(env.dir, "sign.pem")
+	if err := ioutil.WriteFile(env.keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result agent.ActionResult
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		env.received <- result
+	}))
+	transport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+		server.Close()
+	})
+
+	// SecretはJSONで値を出力しないため、設定ファイルはmapから作成する
+	config := map[string]interface{}{
+		"Server": map[string]interface{}{"APIKey": "key", "EndPoint": strings.TrimPrefix(server.URL, "https://")},
+		"Agent": map[string]interface{}{
+			"StateDir":       filepath.Join(env.dir, "state"),
+			"ControlAddress": agent.ControlDisabled,
+			"VerificationKeys": []agent.VerificationKey{{
+				KeyID:     "local",
+				Algorithm: agent.AlgorithmEd25519,
+				PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+			}},
+		},
+	}
+	content, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.configPath = filepath.Join(env.dir, "agent.json")
+	if err := ioutil.WriteFile(env.configPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// writeEvent はmsg.jsonのようなEventのファイルを書き込むファンクション
+func (env *execEventTestEnv) writeEvent(t *testing.T, eventID string) string {
+	event := map[string]interface{}{
+		"timestamp":   time.Now().UnixNano() / int64(time.Millisecond),
+		"action_type": "script",
+		"eventid":     eventID,
+		"agentid":     "local-agent",
+		"raw_command": "echo hello",
+		"timeout":     10,
+	}
+	content, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(env.dir, eventID+".json")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecEventRunsSignedEventFile(t *testing.T) {
+	env := newExecEventTestEnv(t)
+	eventPath := env.writeEvent(t, "event-1")
+
+	if code := execEventCommand([]string{"-config", env.configPath, "-sign-key", env.keyPath, eventPath}); code != 0 {
+		t.Fatalf("exit code = %d, want 0", code)
+	}
+	select {
+	case result := <-env.received:
+		if result.EventID != "event-1" || result.Status != agent.ActionStatusSucceeded || result.Stdout != "hello\n" {
+			t.Errorf("server received %+v", result)
+		}
+	default:
+		t.Fatal("the result was not sent to the server")
+	}
+
+	// 実行中のAgentのAction実行記録と競合しないように、状態保存ディレクトリには書き込まない
+	if files, _ := ioutil.ReadDir(filepath.Join(env.dir, "state")); len(files) > 0 {
+		t.Errorf("exec-event wrote to the state directory: %v", files)
+	}
+}
+
+func TestExecEventRejectsBadSignature(t *testing.T) {
+	env := newExecEventTestEnv(t)
+	eventPath := env.writeEvent(t, "event-2")
+
+	if code := execEventCommand([]string{"-config", env.configPath, "-signature", "local:AAAA", eventPath}); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	if code := execEventCommand([]string{"-config", env.configPath, eventPath}); code != 1 {
+		t.Errorf("unsigned event: exit code = %d, want 1", code)
+	}
+	select {
+	case result := <-env.received:
+		t.Errorf("rejected event was executed: %+v", result)
+	default:
+	}
+}
+
+func TestExecEventAcceptsLocalQueueMessage(t *testing.T) {
+	env := newExecEventTestEnv(t)
+	eventPath := env.writeEvent(t, "event-3")
+	body, err := ioutil.ReadFile(eventPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ioutil.ReadFile(env.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := agent.SignMessage(body, "local", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := agent.EncodeLocalQueueMessage("local-agent", signature, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messagePath := filepath.Join(env.dir, "message.json")
+	if err := ioutil.WriteFile(messagePath, message, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := execEventCommand([]string{"-config", env.configPath, messagePath}); code != 0 {
+		t.Fatalf("exit code = %d, want 0", code)
+	}
+	select {
+	case result := <-env.received:
+		if result.EventID != "event-3" {
+			t.Errorf("server received %+v", result)
+		}
+	default:
+		t.Fatal("the result was not sent to the server")
+	}
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tsubauaaa/agent"
+)
+
+// configOptions は設定の読み込みに使うコマンドライン引数。全てのサブコマンドで共通
+type configOptions struct {
+	endPoint       string
+	apiKey         string
+	configFilePath string
+}
+
+// register はコマンドライン引数をFlagSetに登録するファンクション
+func (o *configOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.endPoint, "endpoint", "", "API endpoint at which the agent should register.")
+	flags.StringVar(&o.apiKey, "api_key", "", "API key for your account. Get this from app.")
+	flags.StringVar(&o.configFilePath, "config", "", "path to the agent config file.")
+}
+
+// cmdlineConfig はコマンドライン引数からServerConfig構造体を構成するファンクション
+func (o *configOptions) cmdlineConfig() agent.ServerConfig {
+	return agent.ServerConfig{EndPoint: o.endPoint, APIKey: agent.Secret(o.apiKey)}
+}
+
+// load は設定ファイルのパスを解決し、設定ファイル、環境変数、コマンドライン引数からServerConfigとAgentConfigを構成するファンクション
+func (o *configOptions) load(errorChannel chan error) (string, agent.ServerConfig, agent.AgentConfig, error) {
+	path, err := resolveConfigFilePath(o.configFilePath)
+	if err != nil {
+		errorChannel <- err
+		return "", agent.ServerConfig{}, agent.AgentConfig{}, err
+	}
+	serverConfig, agentConfig, err := agent.GetConfig(path, o.cmdlineConfig(), errorChannel)
+	return path, serverConfig, agentConfig, err
+}
+
+// loadValidConfig は設定値を構成して検証するファンクション。問題がある場合は全ての問題を出力してfalseを返却する
+// GetConfigはエラーを1つだけerrorChannelに送るため、戻り値で扱いチャネルは読まない
+func (o *configOptions) loadValidConfig() (string, agent.ServerConfig, agent.AgentConfig, bool) {
+	path, serverConfig, agentConfig, err := o.load(make(chan error, 1))
+	if err != nil {
+		fmt.Printf("Could not load the config. Error: %v\n", err)
+		return "", agent.ServerConfig{}, agent.AgentConfig{}, false
+	}
+	if problems := agent.ValidateConfig(path, serverConfig, agentConfig); len(problems) > 0 {
+		printConfigProblems(problems)
+		return "", agent.ServerConfig{}, agent.AgentConfig{}, false
+	}
+	return path, serverConfig, agentConfig, true
+}
+
+// newFlagSet はサブコマンドのFlagSetを生成し、設定の読み込みに使うコマンドライン引数を登録するファンクション
+func newFlagSet(name string, options *configOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	options.register(flags)
+	return flags
+}
+
+// printConfigProblems は設定値の検証で見つかった全ての問題を出力するファンクション
+func printConfigProblems(problems []error) {
+	fmt.Printf("Invalid config values. %d problem(s) found:\n", len(problems))
+	for _, problem := range problems {
+		fmt.Printf("  - %v\n", problem)
+	}
+}
+
+// resolveConfigFilePath はconfigFilePathが未指定の場合に実行ファイルと同じディレクトリのデフォルト設定ファイルを返却するファンクション
+func resolveConfigFilePath(path string) (string, error) {
+	if len(path) > 0 {
+		return path, nil
+	}
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, agent.DefaultConfigFileName), nil
+}
+
+// ConfigValidate は"agent config validate"コマンドのファンクション
+// 設定ファイル、環境変数、コマンドライン引数から構成した設定値を検証し、見つかった全ての問題を出力する
+// 問題がない場合は0、問題がある場合は1を返却する
+func ConfigValidate(args []string) int {
+	var options configOptions
+	if err := newFlagSet("config validate", &options).Parse(args); err != nil {
+		return 2
+	}
+	path, _, _, ok := options.loadValidConfig()
+	if !ok {
+		return 1
+	}
+	fmt.Printf("Config is valid: %s\n", path)
+	return 0
+}
+
+// ConfigShow は"agent config show"コマンドのファンクション
+// 設定ファイル、環境変数、コマンドライン引数から構成した設定値をJSONで出力する。APIキーは出力しない
+func ConfigShow(args []string) int {
+	var options configOptions
+	if err := newFlagSet("config show", &options).Parse(args); err != nil {
+		return 2
+	}
+	_, serverConfig, agentConfig, err := options.load(make(chan error, 1))
+	if err != nil {
+		fmt.Printf("Could not load the config. Error: %v\n", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(agent.Config{Server: serverConfig, Agent: agentConfig}); err != nil {
+		fmt.Printf("Could not print the config. Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -1,24 +1,17 @@
 package main
 
 import (
-	"fmt"
+	"os"
+	"strings"
 
 	"github.com/tsubauaaa/agent/cmd"
 )
 
 func main() {
-	errs := make(chan error, 5)
-	exitCh := make(chan struct{})
-
-	go func() {
-		for {
-			err := <-errs
-			if err != nil {
-				fmt.Print(err)
-			}
-		}
-	}()
-
-	// Agentサービスのメインループ処理の開始
-	cmd.MainLoop(errs, exitCh)
+	// サブコマンドはcmd/agentと同じ。サブコマンドを省略した場合はフラグだけを指定した従来の起動方法として"run"を実行する
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		args = append([]string{"run"}, args...)
+	}
+	os.Exit(cmd.Main(args))
 }
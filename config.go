@@ -4,8 +4,17 @@ package agent
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/tsubauaaa/agent/logging"
+	"gopkg.in/yaml.v2"
 )
 
 // Config はAgent設定ファイルのパラメータの構造体
@@ -16,8 +25,30 @@ type Config struct {
 
 // ServerConfig はAgent設定ファイルのうちServer部のパラメータの構造体
 type ServerConfig struct {
-	APIKey   string
-	EndPoint string
+	// APIKey はServerのAPIキー。ログには出力しない
+	APIKey Secret
+	// APIKeyFile はAPIKeyが空の場合にAPIキーを読み込むファイルのパス。相対パスの場合は設定ファイルのディレクトリからのパス
+	APIKeyFile string
+	// APIKeyEnv はAPIKeyとAPIKeyFileが空の場合にAPIキーを読み込む環境変数名
+	APIKeyEnv string
+	EndPoint  string
+}
+
+// serverConfigLock は設定の再読み込みでServerConfigを入れ替える間、他のgo routineが参照しないようにするロック
+var serverConfigLock sync.RWMutex
+
+// get はServerConfigの現在の値を返却するファンクション。Serverに送信するgo routineはこのファンクションで参照する
+func (c *ServerConfig) get() ServerConfig {
+	serverConfigLock.RLock()
+	defer serverConfigLock.RUnlock()
+	return *c
+}
+
+// update はServerConfigを新しい値に入れ替えるファンクション
+func (c *ServerConfig) update(newConfig ServerConfig) {
+	serverConfigLock.Lock()
+	*c = newConfig
+	serverConfigLock.Unlock()
 }
 
 // AgentConfig はAgent設定ファイルのうちAgent部のパラメータの構造体
@@ -25,30 +56,135 @@ type AgentConfig struct {
 	AssignedHostname string
 	LogFile          string
 	DebugMode        bool
+	VerificationKeys []VerificationKey // SQSメッセージの署名検証用に固定する公開鍵。設定した場合はServerが配布する公開鍵は使わない
+	ActionQueueType  string            // "sqs"(デフォルト)または"local"
+	LocalQueueDir    string            // ActionQueueTypeが"local"の場合のスプールディレクトリ
+	// MaxEventAgeSecs はEventのtimestampから受け付ける最大の経過秒数。0の場合はデフォルト
+	MaxEventAgeSecs int
+	// MaxConcurrentActions は並列に実行するActionの最大数。0の場合はデフォルト値
+	MaxConcurrentActions int
+	// StateDir はAction実行記録などを保存するディレクトリ。相対パスの場合は設定ファイルのディレクトリからのパス
+	StateDir string
+	// RunbookSource はRunbookの取得元。"github"(デフォルト)または"git"
+	RunbookSource string
+	// RunbookSourceURL は"github"の場合はGitHub APIのURL、"git"の場合はリポジトリを置くディレクトリ
+	RunbookSourceURL string
+	// PolicyFile はローカル実行ポリシーファイル(JSON)のパス。相対パスの場合は設定ファイルのディレクトリからのパス
+	PolicyFile string
+	// LogFormat はログのフォーマット。"text"(デフォルト)、"json"、"logfmt"
+	LogFormat string
+	// LogSinks はログの出力先。空の場合はLogFileにローテートして出力する
+	LogSinks []logging.SinkConfig
+	// LogLevelResetSecs は実行中に変更したログレベルを元に戻すまでの秒数。0の場合はデフォルト
+	LogLevelResetSecs int
+	// ControlAddress はローカル制御エンドポイントのアドレス(ループバックのみ)。"disabled"の場合は起動しない
+	ControlAddress string
+	// PollIntervalSecs はSQSポーリング間隔(秒)。0の場合はデフォルト。Serverからハートビートで指示された場合はそちらを使う
+	PollIntervalSecs int
+	// Execution はActionのプロセスの実行ユーザ、作業ディレクトリ、umask、リソース制限のデフォルト
+	Execution ExecutionSettings
 }
 
 const (
 	// DefaultConfigFileName デフォルト設定ファイル
 	DefaultConfigFileName = "agent.json"
 	// DefaultBaseURL デフォルトAPIエンドポイント
-	DefaultBaseURL     = "tsubauaaa.com"
+	DefaultBaseURL = "tsubauaaa.com"
+	// DefaultStateDir デフォルト状態保存ディレクトリ
+	DefaultStateDir    = "state"
 	defaultLogFileName = "agent.log"
 )
 
+// 設定ファイルの形式
+const (
+	configFormatJSON = "json"
+	configFormatYAML = "yaml"
+	configFormatTOML = "toml"
+)
+
+// configFileFormat は設定ファイルの拡張子から形式を求めるファンクション。不明な拡張子はJSONとして扱う
+func configFileFormat(configFilePath string) string {
+	switch strings.ToLower(filepath.Ext(configFilePath)) {
+	case ".yaml", ".yml":
+		return configFormatYAML
+	case ".toml":
+		return configFormatTOML
+	}
+	return configFormatJSON
+}
+
+// normalizeYAML はYAMLのmap[interface{}]interface{}をJSONに変換できるmap[string]interface{}に変換するファンクション
+func normalizeYAML(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, item := range value {
+			m[fmt.Sprint(k)] = normalizeYAML(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeYAML(item)
+		}
+		return value
+	}
+	return v
+}
+
+// decodeConfigFile は設定ファイルを形式に応じてmapにデコードするファンクション
+// YAMLとTOMLはmapからJSONに変換し、JSONと同じ規則(キーの大文字小文字を区別しない)でConfig構造体にパースする
+func decodeConfigFile(configFilePath string, content []byte) (map[string]interface{}, error) {
+	obj := map[string]interface{}{}
+	switch configFileFormat(configFilePath) {
+	case configFormatYAML:
+		var raw interface{}
+		if err := yaml.Unmarshal(content, &raw); err != nil {
+			return nil, err
+		}
+		if m, ok := normalizeYAML(raw).(map[string]interface{}); ok {
+			obj = m
+		} else if raw != nil {
+			return nil, errors.New("The YAML config must be a mapping.")
+		}
+	case configFormatTOML:
+		if _, err := toml.Decode(string(content), &obj); err != nil {
+			return nil, err
+		}
+	default:
+		if err := json.Unmarshal(content, &obj); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
 // parseConfigは設定ファイルをConfig構造体にパースするファンクション
-func parseConfig(configFilePath string) (Config, error) {
+// 設定ファイルはJSON、YAML(.yaml、.yml)、TOML(.toml)に対応し、設定ファイルにない項目はbaseの値を残す
+// 設定ファイルから値を設定した項目はsourcesに記録する
+func parseConfig(configFilePath string, base Config, sources configSources) (Config, error) {
 	file, err := ioutil.ReadFile(configFilePath)
 	if err != nil {
 		fmt.Printf("Could not read the config file. Error: %v\n", err)
 		return Config{}, err
 	}
 
-	var obj Config
-	err = json.Unmarshal(file, &obj)
+	raw, err := decodeConfigFile(configFilePath, file)
+	if err != nil {
+		fmt.Printf("Could not parse the config file. Error: %v\n", err)
+		return Config{}, err
+	}
+	content, err := json.Marshal(raw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	obj := base
+	err = json.Unmarshal(content, &obj)
 	if err != nil {
-		fmt.Printf("Could not parse the config JSON. Error: %v\n", err)
+		fmt.Printf("Could not parse the config file. Error: %v\n", err)
 		return Config{}, err
 	}
+	sources.markFile(raw)
 	return obj, nil
 }
 
@@ -56,51 +192,71 @@ func parseConfig(configFilePath string) (Config, error) {
 func getDefaultConfig() Config {
 	return Config{
 		ServerConfig{EndPoint: DefaultBaseURL},
-		AgentConfig{LogFile: defaultLogFileName, DebugMode: false},
+		AgentConfig{
+			LogFile:              defaultLogFileName,
+			DebugMode:            false,
+			StateDir:             DefaultStateDir,
+			ActionQueueType:      QueueTypeSQS,
+			MaxConcurrentActions: defaultMaxConcurrentActions,
+			RunbookSource:        RunbookSourceGithub,
+			LogFormat:            logging.FormatText,
+		},
 	}
 }
 
 // mergeConfigsはコマンドライン引数とAgent設定ファイルとデフォルト値からConfig構造体を構成するファンクション
 // ServerConfigの設定値はコマンドライン引数の値が優先される
-func mergeConfigs(cmdConfig ServerConfig, configObj Config) (ServerConfig, AgentConfig, error) {
-	var apiKey string
+func mergeConfigs(cmdConfig ServerConfig, configObj Config, sources configSources) (ServerConfig, AgentConfig, error) {
 	if len(cmdConfig.APIKey) > 0 {
-		apiKey = cmdConfig.APIKey
-	} else {
-		apiKey = configObj.Server.APIKey
+		configObj.Server.APIKey = cmdConfig.APIKey
+		sources["Server.APIKey"] = configSourceFlag
 	}
-
-	var endPoint string
 	if len(cmdConfig.EndPoint) > 0 {
-		endPoint = cmdConfig.EndPoint
-	} else {
-		endPoint = configObj.Server.EndPoint
+		configObj.Server.EndPoint = cmdConfig.EndPoint
+		sources["Server.EndPoint"] = configSourceFlag
 	}
-
-	return ServerConfig{
-			APIKey:   apiKey,
-			EndPoint: endPoint,
-		},
-		configObj.Agent, nil
+	return configObj.Server, configObj.Agent, nil
 }
 
 // GetConfig はServerConfigとAgentConfigを返却する
+// 設定値の優先順位はコマンドライン引数 > 環境変数(AGENT_*) > 設定ファイル > デフォルト値
+// APIKeyが空の場合はAPIKeyFileまたはAPIKeyEnvからAPIキーを読み込む
+// 各設定値をどこから設定したかはLogConfigSourcesで出力する
 func GetConfig(configFilePath string, cmdlineConfig ServerConfig, errorChannel chan error) (ServerConfig, AgentConfig, error) {
-	// 設定ファイル項目を設定ファイルやデフォルト値から構成する
-	var configObject Config
+	// 設定ファイル項目をデフォルト値、設定ファイル、環境変数の順に重ねて構成する
+	configObject := getDefaultConfig()
+	sources := newConfigSources(&configObject)
 	var err error
 
 	if len(configFilePath) > 0 {
 		//設定ファイルをConfig構造体にパース
-		configObject, err = parseConfig(configFilePath)
+		configObject, err = parseConfig(configFilePath, configObject, sources)
 		if err != nil {
 			errorChannel <- err
 			return ServerConfig{}, AgentConfig{}, err
 		}
-	} else {
-		//デフォルト値からConfig構造体にパース
-		configObject = getDefaultConfig()
 	}
+
+	//環境変数で設定値を上書きする
+	if err = applyEnvOverrides(&configObject, os.Environ(), sources); err != nil {
+		fmt.Printf("Invalid config environment variable. Error: %v\n", err)
+		errorChannel <- err
+		return ServerConfig{}, AgentConfig{}, err
+	}
+
 	//コマンドライン引数と設定ファイルとデフォルト値からConfig構造体を構成する
-	return mergeConfigs(cmdlineConfig, configObject)
+	serverConfig, agentConfig, err := mergeConfigs(cmdlineConfig, configObject, sources)
+
+	//空の設定値にデフォルト値を設定する
+	merged := Config{Server: serverConfig, Agent: agentConfig}
+	applyConfigDefaults(&merged, sources)
+
+	//APIキーがファイルまたは環境変数で指定されている場合は読み込む
+	if err := resolveAPIKey(configFilePath, &merged.Server, sources); err != nil {
+		fmt.Printf("Could not load the API key. Error: %v\n", err)
+		errorChannel <- err
+		return ServerConfig{}, AgentConfig{}, err
+	}
+	setConfigSources(sources)
+	return merged.Server, merged.Agent, err
 }
@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// 設定値の取得元
+const (
+	configSourceDefault = "default"
+	configSourceFile    = "file"
+	configSourceEnv     = "env"
+	configSourceFlag    = "flag"
+	configSourceKeyFile = "APIKeyFile"
+	configSourceKeyEnv  = "APIKeyEnv"
+)
+
+// configEnvPrefix は設定値を上書きする環境変数の接頭辞
+//
+// 環境変数名は"AGENT_" + セクション名 + "_" + 項目名を英大文字にしたもの。入れ子の構造体は"_"でつなぐ
+//
+//	AGENT_SERVER_APIKEY=xxx
+//	AGENT_SERVER_ENDPOINT=api.example.com
+//	AGENT_AGENT_DEBUGMODE=true
+//	AGENT_AGENT_EXECUTION_RUNASUSER=nobody
+//
+// 文字列、真偽値、数値以外の項目(スライスなど)はJSONで指定する
+//
+//	AGENT_AGENT_LOGSINKS='[{"Type":"stderr"}]'
+const configEnvPrefix = "AGENT_"
+
+// configSources は設定値のパス("Server.APIKey"など)ごとの取得元
+type configSources map[string]string
+
+// configField は設定値の1項目
+type configField struct {
+	path  []string
+	value reflect.Value
+}
+
+// walkConfigFields は設定値の項目を列挙するファンクション。構造体は項目ごとに展開し、スライスやマップは1つの項目として扱う
+func walkConfigFields(v reflect.Value, path []string, fields []configField) []configField {
+	if v.Kind() != reflect.Struct {
+		return append(fields, configField{path: path, value: v})
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if len(t.Field(i).PkgPath) > 0 {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), t.Field(i).Name)
+		fields = walkConfigFields(v.Field(i), fieldPath, fields)
+	}
+	return fields
+}
+
+// newConfigSources は全ての設定値の取得元をデフォルト値とするファンクション
+func newConfigSources(config *Config) configSources {
+	sources := configSources{}
+	for _, field := range walkConfigFields(reflect.ValueOf(config).Elem(), nil, nil) {
+		sources[strings.Join(field.path, ".")] = configSourceDefault
+	}
+	return sources
+}
+
+// lookupKey は大文字小文字を区別せずにmapからキーの値を探すファンクション(encoding/jsonと同じ規則)
+func lookupKey(m map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := m[key]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// markFile は設定ファイルに含まれる設定値の取得元を設定ファイルとするファンクション
+func (s configSources) markFile(raw map[string]interface{}) {
+	for path := range s {
+		var current interface{} = raw
+		found := true
+		for _, key := range strings.Split(path, ".") {
+			m, ok := current.(map[string]interface{})
+			if !ok {
+				found = false
+				break
+			}
+			if current, ok = lookupKey(m, key); !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			s[path] = configSourceFile
+		}
+	}
+}
+
+// configEnvName は設定値のパスに対応する環境変数名を求めるファンクション
+func configEnvName(path []string) string {
+	return configEnvPrefix + strings.ToUpper(strings.Join(path, "_"))
+}
+
+// setConfigValue は環境変数の値を設定値の型に変換して設定するファンクション
+func setConfigValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	default:
+		ptr := reflect.New(v.Type())
+		if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+			return err
+		}
+		v.Set(ptr.Elem())
+	}
+	return nil
+}
+
+// applyEnvOverrides はAGENT_*の環境変数で設定値を上書きするファンクション
+// envはos.Environ()の形式("KEY=value")。どの設定値にも対応しないAGENT_*の環境変数は無視する
+func applyEnvOverrides(config *Config, env []string, sources configSources) error {
+	values := map[string]string{}
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv, configEnvPrefix) {
+			values[kv[:i]] = kv[i+1:]
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	for _, field := range walkConfigFields(reflect.ValueOf(config).Elem(), nil, nil) {
+		name := configEnvName(field.path)
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		if err := setConfigValue(field.value, value); err != nil {
+			return errors.New("Invalid value for " + name + ": " + err.Error())
+		}
+		sources[strings.Join(field.path, ".")] = configSourceEnv
+	}
+	overrideAPIKeySettings(config, sources)
+	return nil
+}
+
+// apiKeySettingPaths はAPIキーの指定方法の設定値のパス
+var apiKeySettingPaths = []string{"Server.APIKey", "Server.APIKeyFile", "Server.APIKeyEnv"}
+
+// overrideAPIKeySettings はAPIキーの指定方法のいずれかを環境変数で指定した場合に、環境変数で指定していない指定方法を空にするファンクション
+// resolveAPIKeyはAPIKey、APIKeyFile、APIKeyEnvの順に使うため、空にしないと設定ファイルのAPIKeyが環境変数のAPIKeyFileより優先されてしまう
+func overrideAPIKeySettings(config *Config, sources configSources) {
+	fromEnv := false
+	for _, path := range apiKeySettingPaths {
+		if sources[path] == configSourceEnv {
+			fromEnv = true
+		}
+	}
+	if !fromEnv {
+		return
+	}
+
+	if sources["Server.APIKey"] != configSourceEnv {
+		config.Server.APIKey = ""
+		sources["Server.APIKey"] = configSourceDefault
+	}
+	if sources["Server.APIKeyFile"] != configSourceEnv {
+		config.Server.APIKeyFile = ""
+		sources["Server.APIKeyFile"] = configSourceDefault
+	}
+	if sources["Server.APIKeyEnv"] != configSourceEnv {
+		config.Server.APIKeyEnv = ""
+		sources["Server.APIKeyEnv"] = configSourceDefault
+	}
+}
+
+// lastConfigSources はGetConfigで構成した設定値の取得元と値。LogConfigSourcesで出力する
+var lastConfigSources = struct {
+	sync.Mutex
+	sources configSources
+}{}
+
+// setConfigSources はGetConfigで構成した設定値の取得元を保存するファンクション
+func setConfigSources(sources configSources) {
+	lastConfigSources.Lock()
+	lastConfigSources.sources = sources
+	lastConfigSources.Unlock()
+}
+
+// LogConfigSources は最終的な設定値と、その値をコマンドライン引数、環境変数、設定ファイル、デフォルト値の
+// どこから設定したかをDebugで出力するファンクション。APIKeyなどSecret型の値は出力しない
+func LogConfigSources(serverConfig ServerConfig, agentConfig AgentConfig) {
+	lastConfigSources.Lock()
+	sources := lastConfigSources.sources
+	lastConfigSources.Unlock()
+
+	config := Config{Server: serverConfig, Agent: agentConfig}
+	fields := walkConfigFields(reflect.ValueOf(&config).Elem(), nil, nil)
+	sort.Slice(fields, func(i, j int) bool {
+		return strings.Join(fields[i].path, ".") < strings.Join(fields[j].path, ".")
+	})
+	for _, field := range fields {
+		path := strings.Join(field.path, ".")
+		source, ok := sources[path]
+		if !ok {
+			source = configSourceDefault
+		}
+		value := fmt.Sprintf("%v", field.value.Interface())
+		logging.Debug("Config value.", logging.Fields{"key": path, "source": source, "value": value})
+	}
+}
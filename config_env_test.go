@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     []string
+		check   func(config Config) bool
+		sources map[string]string
+		fails   bool
+	}{
+		{
+			name:    "string",
+			env:     []string{"AGENT_SERVER_ENDPOINT=api.example.com"},
+			check:   func(c Config) bool { return c.Server.EndPoint == "api.example.com" },
+			sources: map[string]string{"Server.EndPoint": configSourceEnv},
+		},
+		{
+			name:    "bool",
+			env:     []string{"AGENT_AGENT_DEBUGMODE=true"},
+			check:   func(c Config) bool { return c.Agent.DebugMode },
+			sources: map[string]string{"Agent.DebugMode": configSourceEnv},
+		},
+		{
+			name:    "int",
+			env:     []string{"AGENT_AGENT_MAXCONCURRENTACTIONS=8"},
+			check:   func(c Config) bool { return c.Agent.MaxConcurrentActions == 8 },
+			sources: map[string]string{"Agent.MaxConcurrentActions": configSourceEnv},
+		},
+		{
+			name:    "nested uint",
+			env:     []string{"AGENT_AGENT_EXECUTION_CPULIMITSECS=60", "AGENT_AGENT_EXECUTION_RUNASUSER=nobody"},
+			check:   func(c Config) bool { return c.Agent.Execution.CPULimitSecs == 60 && c.Agent.Execution.RunAsUser == "nobody" },
+			sources: map[string]string{"Agent.Execution.CPULimitSecs": configSourceEnv, "Agent.Execution.RunAsUser": configSourceEnv},
+		},
+		{
+			name: "json slice",
+			env:  []string{`AGENT_AGENT_LOGSINKS=[{"Type":"stderr"}]`},
+			check: func(c Config) bool {
+				return reflect.DeepEqual(c.Agent.LogSinks, []logging.SinkConfig{{Type: logging.SinkStderr}})
+			},
+			sources: map[string]string{"Agent.LogSinks": configSourceEnv},
+		},
+		{
+			name:    "unknown keys are ignored",
+			env:     []string{"AGENT_SERVER_UNKNOWN=x", "AGENT_=x", "OTHER_SERVER_ENDPOINT=x", "AGENT_SERVER_ENDPOINT"},
+			check:   func(c Config) bool { return c.Server.EndPoint == "file.example.com" },
+			sources: map[string]string{"Server.EndPoint": configSourceFile},
+		},
+		{
+			name:    "value with equal sign",
+			env:     []string{"AGENT_SERVER_APIKEY=a=b"},
+			check:   func(c Config) bool { return c.Server.APIKey.Value() == "a=b" },
+			sources: map[string]string{"Server.APIKey": configSourceEnv},
+		},
+		{
+			name:    "APIKeyFile beats APIKey in the file",
+			env:     []string{"AGENT_SERVER_APIKEYFILE=/etc/agent/api_key"},
+			check:   func(c Config) bool { return c.Server.APIKey == "" && c.Server.APIKeyFile == "/etc/agent/api_key" },
+			sources: map[string]string{"Server.APIKey": configSourceDefault, "Server.APIKeyFile": configSourceEnv},
+		},
+		{
+			name:    "APIKeyEnv beats APIKey in the file",
+			env:     []string{"AGENT_SERVER_APIKEYENV=API_KEY"},
+			check:   func(c Config) bool { return c.Server.APIKey == "" && c.Server.APIKeyEnv == "API_KEY" },
+			sources: map[string]string{"Server.APIKey": configSourceDefault, "Server.APIKeyEnv": configSourceEnv},
+		},
+		{
+			name:    "APIKey in the file is kept without env",
+			env:     []string{"AGENT_AGENT_DEBUGMODE=false"},
+			check:   func(c Config) bool { return c.Server.APIKey == "from-file" },
+			sources: map[string]string{"Server.APIKey": configSourceFile},
+		},
+		{name: "invalid bool", env: []string{"AGENT_AGENT_DEBUGMODE=maybe"}, fails: true},
+		{name: "invalid int", env: []string{"AGENT_AGENT_MAXCONCURRENTACTIONS=many"}, fails: true},
+		{name: "negative uint", env: []string{"AGENT_AGENT_EXECUTION_CPULIMITSECS=-1"}, fails: true},
+		{name: "invalid json", env: []string{"AGENT_AGENT_LOGSINKS=stderr"}, fails: true},
+	}
+	for _, test := range tests {
+		config := getDefaultConfig()
+		sources := newConfigSources(&config)
+		config.Server.APIKey = "from-file"
+		config.Server.EndPoint = "file.example.com"
+		sources["Server.APIKey"] = configSourceFile
+		sources["Server.EndPoint"] = configSourceFile
+
+		err := applyEnvOverrides(&config, test.env, sources)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: applyEnvOverrides should fail", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.check(config) {
+			t.Errorf("%s: unexpected config %+v", test.name, config)
+		}
+		for path, want := range test.sources {
+			if sources[path] != want {
+				t.Errorf("%s: source of %s = %s, want %s", test.name, path, sources[path], want)
+			}
+		}
+	}
+}
+
+// TestGetConfigEnvAPIKeyFileBeatsFileAPIKey は環境変数で指定したAPIKeyFileが設定ファイルのAPIKeyより優先されることを確認するテスト
+func TestGetConfigEnvAPIKeyFileBeatsFileAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	configFilePath := filepath.Join(dir, "agent.json")
+	if err := ioutil.WriteFile(configFilePath, []byte(`{"Server": {"APIKey": "from-config"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "api_key"), []byte("from-key-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("AGENT_SERVER_APIKEYFILE", "api_key")
+	defer os.Unsetenv("AGENT_SERVER_APIKEYFILE")
+
+	serverConfig, _, err := GetConfig(configFilePath, ServerConfig{}, make(chan error, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverConfig.APIKey.Value() != "from-key-file" {
+		t.Errorf("APIKey = %q, want the key from AGENT_SERVER_APIKEYFILE", serverConfig.APIKey.Value())
+	}
+}
@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// 設定値の範囲
+const (
+	maxLogLevelResetSecs    = 60 * 60 * 24
+	maxCPULimitSecs         = 60 * 60 * 24
+	maxConcurrentActionsCap = 64
+)
+
+// applyConfigDefaults は値が空(0値)の設定値にデフォルト値を設定するファンクション
+// 設定ファイルや環境変数で空の値を指定した場合もデフォルト値を使う
+func applyConfigDefaults(config *Config, sources configSources) {
+	defaults := getDefaultConfig()
+	defaultFields := walkConfigFields(reflect.ValueOf(&defaults).Elem(), nil, nil)
+	fields := walkConfigFields(reflect.ValueOf(config).Elem(), nil, nil)
+	for i, field := range fields {
+		defaultValue := defaultFields[i].value
+		if field.value.IsZero() && !defaultValue.IsZero() {
+			field.value.Set(defaultValue)
+			sources[strings.Join(field.path, ".")] = configSourceDefault
+		}
+	}
+}
+
+// ResolveConfigPath は相対パスを設定ファイルのディレクトリからのパスに変換するファンクション
+func ResolveConfigPath(configFilePath string, p string) string {
+	if len(p) == 0 || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(filepath.Dir(configFilePath), p)
+}
+
+// GetLogConfig はAgentConfigからログの設定を構成するファンクション
+// ログの出力先が指定されていない場合はLogFileにローテートして出力する。ファイルのパスは設定ファイルのディレクトリから解決する
+func GetLogConfig(configFilePath string, agentConfig AgentConfig) logging.LogConfig {
+	logConfig := logging.LogConfig{Format: agentConfig.LogFormat}
+	logConfig.Sinks = append(logConfig.Sinks, agentConfig.LogSinks...)
+	if len(logConfig.Sinks) == 0 {
+		logConfig.Sinks = []logging.SinkConfig{{Type: logging.SinkFile, Path: agentConfig.LogFile}}
+	}
+	for i, sink := range logConfig.Sinks {
+		if sink.Type == "" || sink.Type == logging.SinkFile {
+			logConfig.Sinks[i].Path = ResolveConfigPath(configFilePath, sink.Path)
+		}
+	}
+	return logConfig
+}
+
+// checkWritableDir はディレクトリにファイルを作成できるかを検証するファンクション
+func checkWritableDir(dir string) error {
+	f, err := ioutil.TempFile(dir, ".agent-validate")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkRange は設定値が範囲内かを検証するファンクション
+func checkRange(name string, value, min, max int64) error {
+	if value < min || value > max {
+		return errors.New(name + " must be between " + strconv.FormatInt(min, 10) + " and " + strconv.FormatInt(max, 10) + ".")
+	}
+	return nil
+}
+
+// ValidateConfig は設定値を検証して見つかった全ての問題を返却するファンクション。問題がない場合は空を返却する
+// 相対パスは設定ファイルのディレクトリから解決する
+func ValidateConfig(configFilePath string, serverConfig ServerConfig, agentConfig AgentConfig) []error {
+	var problems []error
+	add := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	// Server
+	if len(serverConfig.APIKey) == 0 {
+		add(errors.New("Server API key is missing. Set APIKey, APIKeyFile or APIKeyEnv."))
+	}
+	if len(serverConfig.EndPoint) == 0 {
+		add(errors.New("Server endpoint is missing."))
+	} else if strings.Contains(serverConfig.EndPoint, "://") {
+		// joinURLが"https://"を付けるため、エンドポイントにはスキームを含めない
+		add(errors.New("Server endpoint must be a host without a scheme: " + serverConfig.EndPoint))
+	} else if strings.ContainsAny(serverConfig.EndPoint, " \t?#") {
+		add(errors.New("Server endpoint is not a valid host: " + serverConfig.EndPoint))
+	}
+
+	// ログ
+	logConfig := GetLogConfig(configFilePath, agentConfig)
+	switch strings.ToLower(logConfig.Format) {
+	case "", logging.FormatText, logging.FormatJSON, logging.FormatLogfmt:
+	default:
+		add(errors.New("Unknown log format: " + logConfig.Format))
+	}
+	for _, sink := range logConfig.Sinks {
+		switch sink.Type {
+		case "", logging.SinkFile:
+			if len(sink.Path) == 0 {
+				add(errors.New("Log file path is missing."))
+			} else if err := checkWritableDir(filepath.Dir(sink.Path)); err != nil {
+				add(errors.New("Log directory is not writable: " + err.Error()))
+			}
+		case logging.SinkStderr, logging.SinkSyslog, logging.SinkJournald:
+		default:
+			add(errors.New("Unknown log sink: " + sink.Type))
+		}
+		if len(sink.Level) > 0 {
+			add(logging.ValidateLevel(sink.Level))
+		}
+	}
+	add(checkRange("LogLevelResetSecs", int64(agentConfig.LogLevelResetSecs), 0, maxLogLevelResetSecs))
+	if agentConfig.ControlAddress != ControlDisabled && len(agentConfig.ControlAddress) > 0 {
+		add(checkLoopbackAddress(agentConfig.ControlAddress))
+	}
+
+	// Actionキュー
+	switch agentConfig.ActionQueueType {
+	case "", QueueTypeSQS:
+	case QueueTypeLocal:
+		if len(agentConfig.LocalQueueDir) == 0 {
+			add(errors.New("LocalQueueDir is required for the local action queue."))
+		}
+	default:
+		add(errors.New("Unsupported action queue type: " + agentConfig.ActionQueueType))
+	}
+	add(checkRange("MaxConcurrentActions", int64(agentConfig.MaxConcurrentActions), 0, maxConcurrentActionsCap))
+	add(checkRange("PollIntervalSecs", int64(agentConfig.PollIntervalSecs), 0, maxPollIntervalSecs))
+
+	// Runbook
+	switch agentConfig.RunbookSource {
+	case "", RunbookSourceGithub:
+	case RunbookSourceGit:
+		if len(agentConfig.RunbookSourceURL) == 0 {
+			add(errors.New("Runbook source directory is missing."))
+		}
+	default:
+		add(errors.New("Unsupported runbook source: " + agentConfig.RunbookSource))
+	}
+
+	// ローカル実行ポリシーと実行設定
+	if len(agentConfig.PolicyFile) > 0 {
+		policyFilePath := ResolveConfigPath(configFilePath, agentConfig.PolicyFile)
+		if _, err := os.Stat(policyFilePath); err != nil {
+			add(errors.New("Policy file does not exist: " + policyFilePath))
+		}
+	}
+	add(agentConfig.Execution.validate())
+	add(checkRange("Execution.CPULimitSecs", int64(agentConfig.Execution.CPULimitSecs), 0, maxCPULimitSecs))
+
+	for _, key := range agentConfig.VerificationKeys {
+		if _, err := parseVerificationKey(key); err != nil {
+			add(err)
+		}
+	}
+	// Action実行記録が期限切れになったEventを受け付けないように、Action実行記録の保存期間を上限とする
+	add(checkRange("MaxEventAgeSecs", int64(agentConfig.MaxEventAgeSecs), 0, int64(actionLedgerTTL/time.Second)))
+	return problems
+}
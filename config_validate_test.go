@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newValidTestConfig は問題のない設定値を生成するファンクション。ログファイルはdirに出力する
+func newValidTestConfig(dir string) (ServerConfig, AgentConfig) {
+	config := getDefaultConfig()
+	config.Server.APIKey = "key"
+	config.Agent.LogFile = filepath.Join(dir, "agent.log")
+	return config.Server, config.Agent
+}
+
+func TestValidateConfigAcceptsValidConfig(t *testing.T) {
+	dir := t.TempDir()
+	serverConfig, agentConfig := newValidTestConfig(dir)
+	if problems := ValidateConfig(filepath.Join(dir, "agent.json"), serverConfig, agentConfig); len(problems) != 0 {
+		t.Errorf("problems = %v", problems)
+	}
+}
+
+func TestValidateConfigCollectsAllProblems(t *testing.T) {
+	dir := t.TempDir()
+	serverConfig, agentConfig := newValidTestConfig(dir)
+	serverConfig.APIKey = ""
+	serverConfig.EndPoint = "https://api.example.com"
+	agentConfig.LogFormat = "xml"
+	agentConfig.ActionQueueType = "kafka"
+	agentConfig.MaxConcurrentActions = maxConcurrentActionsCap + 1
+	agentConfig.PollIntervalSecs = -1
+	agentConfig.RunbookSource = "svn"
+	agentConfig.MaxEventAgeSecs = int(actionLedgerTTL.Seconds()) + 1
+	agentConfig.VerificationKeys = []VerificationKey{{KeyID: "broken", Algorithm: AlgorithmEd25519, PublicKey: "not a key"}}
+
+	problems := ValidateConfig(filepath.Join(dir, "agent.json"), serverConfig, agentConfig)
+	want := []string{
+		"API key is missing",
+		"without a scheme",
+		"Unknown log format",
+		"Unsupported action queue type",
+		"MaxConcurrentActions",
+		"PollIntervalSecs",
+		"Unsupported runbook source",
+		"MaxEventAgeSecs",
+		"PEM",
+	}
+	if len(problems) != len(want) {
+		t.Errorf("got %d problems, want %d: %v", len(problems), len(want), problems)
+	}
+	for _, message := range want {
+		found := false
+		for _, problem := range problems {
+			if strings.Contains(problem.Error(), message) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("problem %q is not reported: %v", message, problems)
+		}
+	}
+}
+
+func TestApplyConfigDefaults(t *testing.T) {
+	var config Config
+	config.Server.EndPoint = "api.example.com"
+	config.Agent.MaxConcurrentActions = 2
+	sources := newConfigSources(&config)
+	sources["Server.EndPoint"] = configSourceFile
+	sources["Agent.MaxConcurrentActions"] = configSourceEnv
+	sources["Agent.StateDir"] = configSourceFile
+
+	applyConfigDefaults(&config, sources)
+
+	defaults := getDefaultConfig()
+	if config.Server.EndPoint != "api.example.com" || config.Agent.MaxConcurrentActions != 2 {
+		t.Errorf("configured values should be kept: %+v", config)
+	}
+	if config.Agent.StateDir != defaults.Agent.StateDir || config.Agent.LogFile != defaults.Agent.LogFile ||
+		config.Agent.ActionQueueType != defaults.Agent.ActionQueueType || config.Agent.RunbookSource != defaults.Agent.RunbookSource {
+		t.Errorf("empty values should be defaults: %+v", config.Agent)
+	}
+	if sources["Agent.StateDir"] != configSourceDefault || sources["Server.EndPoint"] != configSourceFile ||
+		sources["Agent.MaxConcurrentActions"] != configSourceEnv {
+		t.Errorf("sources = %v", sources)
+	}
+}
+
+// TestGetConfigAppliesDefaultsAfterMerge は設定ファイルと環境変数で空の値を指定した場合もデフォルト値を使うことを確認するテスト
+func TestGetConfigAppliesDefaultsAfterMerge(t *testing.T) {
+	dir := t.TempDir()
+	configFilePath := filepath.Join(dir, "agent.json")
+	content := `{"Server": {"APIKey": "key", "EndPoint": ""}, "Agent": {"StateDir": "", "MaxConcurrentActions": 0, "LogFile": "custom.log"}}`
+	if err := ioutil.WriteFile(configFilePath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("AGENT_AGENT_RUNBOOKSOURCE", "")
+	defer os.Unsetenv("AGENT_AGENT_RUNBOOKSOURCE")
+
+	serverConfig, agentConfig, err := GetConfig(configFilePath, ServerConfig{}, make(chan error, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := getDefaultConfig()
+	if serverConfig.EndPoint != defaults.Server.EndPoint || agentConfig.StateDir != defaults.Agent.StateDir ||
+		agentConfig.MaxConcurrentActions != defaults.Agent.MaxConcurrentActions || agentConfig.RunbookSource != defaults.Agent.RunbookSource {
+		t.Errorf("empty values should be defaults: %+v %+v", serverConfig, agentConfig)
+	}
+	if agentConfig.LogFile != "custom.log" {
+		t.Errorf("LogFile = %q, want the value in the file", agentConfig.LogFile)
+	}
+
+	lastConfigSources.Lock()
+	sources := lastConfigSources.sources
+	lastConfigSources.Unlock()
+	if sources["Agent.StateDir"] != configSourceDefault || sources["Agent.RunbookSource"] != configSourceDefault ||
+		sources["Agent.LogFile"] != configSourceFile {
+		t.Errorf("sources = %v", sources)
+	}
+}
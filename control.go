@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// ローカル制御エンドポイントの定数
+const (
+	// DefaultControlAddress はローカル制御エンドポイントのデフォルトのアドレス
+	DefaultControlAddress = "127.0.0.1:7070"
+	// ControlDisabled をControlAddressに指定した場合はローカル制御エンドポイントを起動しない
+	ControlDisabled     = "disabled"
+	controlLogLevelPath = "/loglevel"
+	controlStatusPath   = "/status"
+	// controlClientTimeoutSecs はQueryAgentStatusの応答を待つ秒数
+	controlClientTimeoutSecs = 5
+	// controlTokenFileName はローカル制御エンドポイントの認証トークンを保存するstateDirのファイル名
+	controlTokenFileName = "control.token"
+	controlTokenBytes    = 32
+	bearerPrefix         = "Bearer "
+)
+
+// LogLevelRequest はログレベルを変更するリクエストとログレベルを返却するレスポンスの構造体
+type LogLevelRequest struct {
+	Level        string
+	BaseLevel    string `json:",omitempty"` // 設定ファイルによるログレベル。レスポンスのみ
+	DurationSecs int    `json:",omitempty"` // 元のログレベルに戻すまでの秒数。0の場合はLogLevelResetSecs
+}
+
+// controlMux はローカル制御エンドポイントのハンドラ
+var controlMux = http.NewServeMux()
+
+func init() {
+	controlMux.HandleFunc(controlLogLevelPath, handleLogLevel)
+	controlMux.HandleFunc(controlStatusPath, handleStatus)
+}
+
+// writeControlResponse はレスポンスをJSONで書き込むファンクション
+func writeControlResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleLogLevel はGETで現在のログレベルを返却し、PUTまたはPOSTでログレベルを変更するファンクション
+// DELETEの場合は設定ファイルによるログレベルに戻す
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		var request LogLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeControlResponse(w, http.StatusBadRequest, map[string]string{"Error": err.Error()})
+			return
+		}
+		if err := logging.ChangeLevel(request.Level, "control", time.Second*time.Duration(request.DurationSecs)); err != nil {
+			writeControlResponse(w, http.StatusBadRequest, map[string]string{"Error": err.Error()})
+			return
+		}
+	case "DELETE":
+		logging.ResetLevel("control")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	current, base := logging.GetLevel()
+	writeControlResponse(w, http.StatusOK, &LogLevelRequest{Level: current, BaseLevel: base})
+}
+
+// handleStatus はGETで実行中のAgentのステータスを返却するファンクション
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	status := getAgentStatus()
+	writeControlResponse(w, http.StatusOK, &status)
+}
+
+// newControlHandler はAuthorizationヘッダのトークンを検証してからcontrolMuxで処理するハンドラを生成するファンクション
+func newControlHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, bearerPrefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, bearerPrefix)), []byte(token)) != 1 {
+			writeControlResponse(w, http.StatusUnauthorized, map[string]string{"Error": "Invalid control token."})
+			return
+		}
+		controlMux.ServeHTTP(w, r)
+	})
+}
+
+// controlTokenPath はローカル制御エンドポイントの認証トークンのファイルパスを返却するファンクション
+func controlTokenPath(stateDir string) string {
+	return filepath.Join(stateDir, controlTokenFileName)
+}
+
+// writeControlToken はランダムな認証トークンを生成して、Agentの実行ユーザだけが読めるファイルに保存するファンクション
+// 起動するたびに生成し直すため、以前のトークンは使えなくなる
+func writeControlToken(stateDir string) (string, error) {
+	buf := make([]byte, controlTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(controlTokenPath(stateDir), []byte(token), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// checkLoopbackAddress はアドレスがループバックアドレスかを検証するファンクション
+// ホストの外部からは接続させない
+func checkLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.New("The control address must be a loopback address: " + address)
+	}
+	return nil
+}
+
+// StartControlServer はローカル制御エンドポイントをgo routineで起動するファンクション
+// addressが空の場合はDefaultControlAddress、ControlDisabledの場合は起動しない
+// ホストの他のユーザがログレベルを変更できないように、stateDirに保存した認証トークンがないリクエストは拒否する
+func StartControlServer(address, stateDir string) error {
+	if address == ControlDisabled {
+		return nil
+	}
+	if len(address) == 0 {
+		address = DefaultControlAddress
+	}
+	if err := checkLoopbackAddress(address); err != nil {
+		return err
+	}
+	token, err := writeControlToken(stateDir)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	logging.Info("Started the local control endpoint.", logging.Fields{"address": listener.Addr().String()})
+	go func() {
+		if err := http.Serve(listener, newControlHandler(token)); err != nil {
+			logging.Error("The local control endpoint stopped.", logging.Fields{"error": err})
+		}
+	}()
+	return nil
+}
+
+// QueryAgentStatus はローカル制御エンドポイントから実行中のAgentのステータスを取得するファンクション
+// addressが空の場合はDefaultControlAddress。認証トークンは実行中のAgentのstateDirから読み込む
+func QueryAgentStatus(address, stateDir string) (*AgentStatus, error) {
+	if address == ControlDisabled {
+		return nil, errors.New("The local control endpoint is disabled.")
+	}
+	if len(address) == 0 {
+		address = DefaultControlAddress
+	}
+	if err := checkLoopbackAddress(address); err != nil {
+		return nil, err
+	}
+
+	token, err := ioutil.ReadFile(controlTokenPath(stateDir))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", "http://"+address+controlStatusPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", bearerPrefix+strings.TrimSpace(string(token)))
+
+	client := &http.Client{Timeout: time.Second * controlClientTimeoutSecs}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("The agent returned unexpected status: " + strconv.Itoa(resp.StatusCode))
+	}
+	status := AgentStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
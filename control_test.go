@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestControlHandlerRequiresToken は認証トークンがないリクエストでログレベルを変更できないことを確認するテスト
+func TestControlHandlerRequiresToken(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	token, err := writeControlToken(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(controlTokenPath(stateDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("token file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	server := httptest.NewServer(newControlHandler(token))
+	defer server.Close()
+
+	for _, auth := range []string{"", "Bearer wrong", token} {
+		req, _ := http.NewRequest("PUT", server.URL+controlLogLevelPath, strings.NewReader(`{"Level":"debug"}`))
+		if len(auth) > 0 {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status = %d, want 401", auth, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+controlLogLevelPath, nil)
+	req.Header.Set("Authorization", bearerPrefix+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// TestQueryAgentStatusSendsToken はQueryAgentStatusがstateDirの認証トークンを送信することを確認するテスト
+func TestQueryAgentStatusSendsToken(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	token, err := writeControlToken(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newControlHandler(token))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	if _, err := QueryAgentStatus(address, stateDir); err != nil {
+		t.Errorf("QueryAgentStatus: %v", err)
+	}
+
+	// 別のAgentの起動でトークンが生成し直された場合は拒否される
+	if _, err := writeControlToken(stateDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := QueryAgentStatus(address, stateDir); err == nil {
+		t.Errorf("QueryAgentStatus with a stale token should fail")
+	}
+}
@@ -1,18 +1,227 @@
 package agent
 
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// エラー送信の定数
+const (
+	errorsChannelSize      = 100
+	errorRequestTypePath   = "error"
+	errorReportIntervalSec = 60
+	// maxPendingAgentErrors は送信待ちにするエラーの種類の上限。超えた場合は新しい種類のエラーを破棄する
+	maxPendingAgentErrors     = 100
+	maxErrorReportBackoffSecs = 600
+)
+
+// Agentのステータス
+const (
+	agentStatusRunning = "running"
+	agentStatusPaused  = "paused"
+)
+
 // ErrorsChannel はAgentにエラーが発生したら、このチャネルにエラーをプッシュ
-var ErrorsChannel = make(chan string, 10)
+var ErrorsChannel = make(chan string, errorsChannelSize)
 
 // AgentError はAgentエラーに必要な情報の構造体
+// 同じメッセージのエラーは1つにまとめ、Countに発生回数を設定する
 type AgentError struct {
 	ErrorMessage string
 	AgentID      string
 	FullLogs     bool
 	Hostname     string
 	Status       string
+	Count        int
+	FirstTime    int64
+	LastTime     int64
+	dropped      bool // 破棄したエラーの件数を示すエラーの場合はtrue
 }
 
+// errorReporter はErrorsChannelのエラーを送信待ちに溜めてServerに送信する
+var errorReporter = struct {
+	sync.Mutex
+	pending map[string]*AgentError
+	order   []string
+	// dropped はチャネルまたは送信待ちが一杯で破棄したエラーの件数
+	dropped int
+	// sinceHeartbeat は前回のハートビート以降に発生したエラーの件数
+	sinceHeartbeat int
+}{pending: map[string]*AgentError{}}
+
 // ReportError はAgentにエラーが発生した場合にチャネルにエラーをプッシュ
+// エラーの送信が遅れても呼び出し元を止めないように、チャネルが一杯の場合はエラーを破棄して件数を記録する
 func ReportError(err string) {
-	ErrorsChannel <- err
+	select {
+	case ErrorsChannel <- err:
+	default:
+		errorReporter.Lock()
+		errorReporter.dropped++
+		errorReporter.sinceHeartbeat++
+		errorReporter.Unlock()
+	}
+}
+
+// recordError はエラーを送信待ちに加えるファンクション。同じメッセージのエラーは発生回数を増やす
+func recordError(message string) {
+	errorReporter.Lock()
+	defer errorReporter.Unlock()
+
+	errorReporter.sinceHeartbeat++
+	now := nowInMillis()
+	if agentError, ok := errorReporter.pending[message]; ok {
+		agentError.Count++
+		agentError.LastTime = now
+		return
+	}
+	if len(errorReporter.pending) >= maxPendingAgentErrors {
+		errorReporter.dropped++
+		return
+	}
+	errorReporter.pending[message] = &AgentError{
+		ErrorMessage: message,
+		Count:        1,
+		FirstTime:    now,
+		LastTime:     now,
+	}
+	errorReporter.order = append(errorReporter.order, message)
+}
+
+// takeErrorCount は前回のハートビート以降に発生したエラーの件数を返却してリセットするファンクション
+func takeErrorCount() int {
+	errorReporter.Lock()
+	defer errorReporter.Unlock()
+	count := errorReporter.sinceHeartbeat
+	errorReporter.sinceHeartbeat = 0
+	return count
+}
+
+// restoreErrorCount はハートビートの送信に失敗した場合にエラーの件数を戻すファンクション
+func restoreErrorCount(count int) {
+	errorReporter.Lock()
+	errorReporter.sinceHeartbeat += count
+	errorReporter.Unlock()
+}
+
+// takePendingErrors は送信待ちのエラーを発生順に取り出すファンクション
+// 破棄したエラーがある場合は件数を示すエラーを加える
+func takePendingErrors() []*AgentError {
+	errorReporter.Lock()
+	defer errorReporter.Unlock()
+
+	var agentErrors []*AgentError
+	for _, message := range errorReporter.order {
+		agentErrors = append(agentErrors, errorReporter.pending[message])
+	}
+	if errorReporter.dropped > 0 {
+		now := nowInMillis()
+		agentErrors = append(agentErrors, &AgentError{
+			ErrorMessage: strconv.Itoa(errorReporter.dropped) + " errors were dropped.",
+			Count:        errorReporter.dropped,
+			FirstTime:    now,
+			LastTime:     now,
+			dropped:      true,
+		})
+	}
+	errorReporter.pending = map[string]*AgentError{}
+	errorReporter.order = nil
+	errorReporter.dropped = 0
+	return agentErrors
+}
+
+// restorePendingErrors は送信に失敗したエラーを送信待ちに戻すファンクション
+func restorePendingErrors(agentErrors []*AgentError) {
+	errorReporter.Lock()
+	defer errorReporter.Unlock()
+
+	var order []string
+	for _, agentError := range agentErrors {
+		if agentError.dropped {
+			errorReporter.dropped += agentError.Count
+			continue
+		}
+		if current, ok := errorReporter.pending[agentError.ErrorMessage]; ok {
+			current.Count += agentError.Count
+			current.FirstTime = agentError.FirstTime
+			continue
+		}
+		if len(errorReporter.pending) >= maxPendingAgentErrors {
+			errorReporter.dropped += agentError.Count
+			continue
+		}
+		errorReporter.pending[agentError.ErrorMessage] = agentError
+		order = append(order, agentError.ErrorMessage)
+	}
+	errorReporter.order = append(order, errorReporter.order...)
+}
+
+// SendErrors はServerにHTTP POSTしてAgentエラーを送信するファンクション
+func SendErrors(agentErrors []*AgentError, configObj *ServerConfig, agentID string) error {
+	// Session.Post(url, payload, result, errMsg)
+	server := configObj.get()
+	resp, err := newServerSession(server).Post(joinURL(server.EndPoint, errorRequestTypePath, agentID), &agentErrors, nil, nil)
+	if err != nil {
+		return err
+	}
+	if 200 <= resp.Status() && resp.Status() <= 299 {
+		return nil
+	}
+	return errors.New("Server returned unexpected status: " + strconv.Itoa(resp.Status()))
+}
+
+// reportErrors は送信待ちのエラーにAgentの情報を設定してServerに送信するファンクション
+// 送信に失敗した場合はエラーを送信待ちに戻す
+func reportErrors(regManager *RegistrationManager, configObj *ServerConfig) error {
+	agentErrors := takePendingErrors()
+	if len(agentErrors) == 0 {
+		return nil
+	}
+
+	status := agentStatusRunning
+	if isActionExecutionPaused() {
+		status = agentStatusPaused
+	}
+	agentID := regManager.Get().AgentID
+	for _, agentError := range agentErrors {
+		agentError.AgentID = agentID
+		agentError.Hostname = regManager.hostname()
+		agentError.Status = status
+	}
+
+	if err := SendErrors(agentErrors, configObj, agentID); err != nil {
+		restorePendingErrors(agentErrors)
+		return err
+	}
+	logging.Debug("Successfully sent the agent errors.", logging.Fields{"count": len(agentErrors)})
+	return nil
+}
+
+// ErrorReportLoop はErrorsChannelからエラーを取り出し、errorReportIntervalSecごとにまとめてServerに送信するファンクション
+// 送信の失敗をErrorで記録すると再びErrorsChannelに送られて送信が繰り返されるため、失敗はWarnで記録する
+func ErrorReportLoop(regManager *RegistrationManager, configObj *ServerConfig) {
+	interval := time.Second * errorReportIntervalSec
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	backoff := float64(errorReportIntervalSec)
+
+	for {
+		select {
+		case message := <-ErrorsChannel:
+			recordError(message)
+		case <-timer.C:
+			if err := reportErrors(regManager, configObj); err != nil {
+				backoff = math.Min(backoff*2, maxErrorReportBackoffSecs)
+				logging.Warn("Could not send the agent errors.", logging.Fields{"error": err, "retryAfter": backoff})
+				timer.Reset(time.Second * time.Duration(backoff))
+				continue
+			}
+			backoff = errorReportIntervalSec
+			timer.Reset(interval)
+		}
+	}
 }
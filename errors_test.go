@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// resetErrorReporter はテストの前後で送信待ちのエラーとErrorsChannelを空にするファンクション
+func resetErrorReporter(t *testing.T) {
+	reset := func() {
+		for len(ErrorsChannel) > 0 {
+			<-ErrorsChannel
+		}
+		takePendingErrors()
+		takeErrorCount()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestReportErrorDoesNotBlock(t *testing.T) {
+	resetErrorReporter(t)
+	const extra = 3
+	for i := 0; i < errorsChannelSize+extra; i++ {
+		ReportError("error")
+	}
+	for len(ErrorsChannel) > 0 {
+		recordError(<-ErrorsChannel)
+	}
+
+	agentErrors := takePendingErrors()
+	if len(agentErrors) != 2 {
+		t.Fatalf("got %d errors, want the deduplicated error and the dropped count", len(agentErrors))
+	}
+	if agentErrors[0].ErrorMessage != "error" || agentErrors[0].Count != errorsChannelSize {
+		t.Errorf("error = %+v", agentErrors[0])
+	}
+	if !agentErrors[1].dropped || agentErrors[1].Count != extra {
+		t.Errorf("dropped = %+v, want %d", agentErrors[1], extra)
+	}
+	if count := takeErrorCount(); count != errorsChannelSize+extra {
+		t.Errorf("error count = %d, want %d", count, errorsChannelSize+extra)
+	}
+}
+
+func TestRecordErrorDeduplicatesInOrder(t *testing.T) {
+	resetErrorReporter(t)
+	for _, message := range []string{"b", "a", "b", "b"} {
+		recordError(message)
+	}
+	agentErrors := takePendingErrors()
+	if len(agentErrors) != 2 || agentErrors[0].ErrorMessage != "b" || agentErrors[0].Count != 3 ||
+		agentErrors[1].ErrorMessage != "a" || agentErrors[1].Count != 1 {
+		t.Errorf("errors = %+v", agentErrors)
+	}
+	if agentErrors[0].FirstTime > agentErrors[0].LastTime {
+		t.Errorf("FirstTime %d is after LastTime %d", agentErrors[0].FirstTime, agentErrors[0].LastTime)
+	}
+	if len(takePendingErrors()) != 0 {
+		t.Error("pending errors should be cleared")
+	}
+}
+
+func TestReportErrorsSendsAgentInformation(t *testing.T) {
+	resetErrorReporter(t)
+	t.Cleanup(func() { SetVerificationKeys(nil) })
+	var mu sync.Mutex
+	var path string
+	var received []AgentError
+	status := http.StatusOK
+	configObj := newTestTLSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	})
+	regManager := NewRegistrationManager(HostMetaData{HostName: "host"}, configObj, nil)
+	regManager.set(&RegistrationInfo{AgentID: "agent"})
+
+	// 送信に失敗した場合は送信待ちに戻し、後から発生した同じエラーとまとめる
+	mu.Lock()
+	status = http.StatusServiceUnavailable
+	mu.Unlock()
+	recordError("error")
+	if err := reportErrors(regManager, configObj); err == nil {
+		t.Fatal("reportErrors should fail")
+	}
+	recordError("error")
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	if err := reportErrors(regManager, configObj); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if path != agentAPI+errorRequestTypePath+"/agent" {
+		t.Errorf("path = %q", path)
+	}
+	if len(received) != 1 || received[0].ErrorMessage != "error" || received[0].Count != 2 || received[0].AgentID != "agent" ||
+		received[0].Hostname != "host" || received[0].Status != agentStatusRunning {
+		t.Errorf("received = %+v", received)
+	}
+	if len(takePendingErrors()) != 0 {
+		t.Error("sent errors should not be pending")
+	}
+}
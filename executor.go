@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// Action実行の定数
+const (
+	defaultActionTimeoutSecs = 300
+)
+
+// Action実行結果のステータス
+const (
+	ActionStatusSucceeded    = "succeeded"
+	ActionStatusFailed       = "failed"
+	ActionStatusTimedOut     = "timed_out"
+	ActionStatusError        = "error"
+	ActionStatusPolicyDenied = "policy_denied"
+	ActionStatusInterrupted  = "interrupted"
+)
+
+// ActionResult はRunbookの実行結果の構造体
+type ActionResult struct {
+	EventID          string
+	InflightActionID string
+	RuleID           string
+	AgentID          string
+	Status           string
+	ExitCode         int
+	Stdout           string
+	Stderr           string
+	ErrorMessage     string
+	StartTime        int64
+	EndTime          int64
+	TimedOut         bool
+	OutputTruncated  bool // 出力がMaxOutputBytesを超えて切り詰められた場合はtrue
+	// OutputUnavailable はAction実行記録から再送した実行結果で、出力を含まない場合はtrue
+	// Serverは以前に受け付けた実行結果の出力をこの実行結果で上書きしてはならない
+	OutputUnavailable bool
+	event             *Event        // 実行結果の送信後にメッセージを削除するために使う
+	stream            *outputStream // 実行中の出力をServerにストリーミングする。nilの場合はストリーミングしない
+}
+
+// newActionResult はEventの識別情報を持つActionResultを生成するファンクション
+func newActionResult(event *Event) *ActionResult {
+	return &ActionResult{
+		EventID:          event.EventID,
+		InflightActionID: event.InflightActionID,
+		RuleID:           event.RuleID,
+		AgentID:          event.AgentID,
+		StartTime:        nowInMillis(),
+		event:            event,
+	}
+}
+
+// nowInMillis は現在時刻をミリ秒で返却するファンクション
+func nowInMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// getActionTimeout はEventのタイムアウト値を求めるファンクション
+// タイムアウト値が未指定の場合はdefaultActionTimeoutSecsとする
+func getActionTimeout(event *Event) time.Duration {
+	if event.Timeout <= 0 {
+		return time.Second * defaultActionTimeoutSecs
+	}
+	return time.Second * time.Duration(event.Timeout)
+}
+
+// reservedEnvKeys はEventで指定できない環境変数。コマンドの検索パスや動的リンク、シェルの初期化を変えられないようにする
+var reservedEnvKeys = map[string]bool{
+	"PATH":     true,
+	"IFS":      true,
+	"ENV":      true,
+	"BASH_ENV": true,
+}
+
+// reservedEnvPrefixes はEventで指定できない環境変数の接頭辞
+var reservedEnvPrefixes = []string{"LD_", "DYLD_"}
+
+// validateEnviroment はEventの環境変数にreservedEnvKeysとreservedEnvPrefixesの環境変数がないことを検証するファンクション
+func validateEnviroment(env map[string]string) error {
+	for k := range env {
+		if reservedEnvKeys[k] {
+			return errors.New("Event must not set the environment variable: " + k)
+		}
+		for _, prefix := range reservedEnvPrefixes {
+			if strings.HasPrefix(k, prefix) {
+				return errors.New("Event must not set the environment variable: " + k)
+			}
+		}
+	}
+	return nil
+}
+
+// buildEnviroment はAgentプロセスの環境変数にEventの環境変数をマージするファンクション
+// 同じキーの場合はEventの環境変数が優先される。reservedEnvKeysなどはExecuteActionでvalidateEnviromentが拒否する
+func buildEnviroment(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := os.Environ()
+	for _, k := range keys {
+		result = append(result, k+"="+env[k])
+	}
+	return result
+}
+
+// replaceEnv は環境変数のリストのキーの値を置き換えるファンクション
+func replaceEnv(env []string, key, value string) []string {
+	result := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			result = append(result, kv)
+		}
+	}
+	return append(result, key+"="+value)
+}
+
+// runCommand はコマンドを実行して標準出力、標準エラー出力、終了コードをresultに設定するファンクション
+// 実行ユーザ、作業ディレクトリ、umask、リソース制限はgetExecutionSettingsで求めた設定を適用する
+// ctxの期限が切れた場合はプロセスグループ全体がkillされる
+func runCommand(ctx context.Context, event *Event, result *ActionResult, name string, args ...string) error {
+	return runCommandWithInput(ctx, event, result, nil, name, args...)
+}
+
+// runCommandWithInput はstdinを標準入力としてコマンドを実行するファンクション。stdinがnilの場合は標準入力を渡さない
+func runCommandWithInput(ctx context.Context, event *Event, result *ActionResult, stdin io.Reader, name string, args ...string) error {
+	settings, err := getExecutionSettings(event)
+	if err != nil {
+		return err
+	}
+	name, args = settings.wrapCommand(name, args)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = buildEnviroment(event.Enviroment)
+	cmd.Dir = settings.WorkingDir
+	cmd.Stdin = stdin
+	if err := configureProcess(cmd, settings); err != nil {
+		return err
+	}
+	stdout := &cappedBuffer{limit: settings.maxOutputBytes()}
+	stderr := &cappedBuffer{limit: settings.maxOutputBytes()}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if result.stream != nil {
+		cmd.Stdout = io.MultiWriter(stdout, result.stream.writer(outputStreamStdout))
+		cmd.Stderr = io.MultiWriter(stderr, result.stream.writer(outputStreamStderr))
+	}
+
+	err = cmd.Run()
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	result.OutputTruncated = stdout.truncated || stderr.truncated
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitErr.ExitCode()
+			return nil
+		}
+		return err
+	}
+	result.ExitCode = 0
+	return nil
+}
+
+// failAction はActionを実行できなかったことを実行結果に設定するファンクション
+func failAction(result *ActionResult, status string, err error) (*ActionResult, error) {
+	result.EndTime = nowInMillis()
+	result.Status = status
+	result.ExitCode = -1
+	result.ErrorMessage = err.Error()
+	return result, err
+}
+
+// ExecuteAction はEventに対応するRunbookを実行して実行結果を返却するファンクション
+// ActionTypeに登録されたActionHandlerでパラメータを検証し、ローカル実行ポリシーで許可されていることを確認してから、
+// Eventのタイムアウト値を期限として実行する。ストリーミングが設定されている場合は実行中の出力をServerに送信する
+// 実行できなかった場合もステータスとエラーを設定した実行結果を返却する
+func ExecuteAction(event *Event) (*ActionResult, error) {
+	logging.Info("Executing the action.", logging.Fields{
+		"eventID":     event.EventID,
+		"actionType":  event.ActionType,
+		"runbookName": event.RunbookName,
+	})
+	result := newActionResult(event)
+
+	handler, err := getActionHandler(event.ActionType)
+	if err != nil {
+		return failAction(result, ActionStatusError, err)
+	}
+	if err := handler.Validate(event); err != nil {
+		return failAction(result, ActionStatusError, err)
+	}
+	if err := validateEnviroment(event.Enviroment); err != nil {
+		return failAction(result, ActionStatusError, err)
+	}
+	if err := checkPolicy(event); err != nil {
+		logging.Warn("The action is denied by the local execution policy.", logging.Fields{"eventID": event.EventID, "reason": err})
+		return failAction(result, ActionStatusPolicyDenied, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), getActionTimeout(event))
+	defer cancel()
+
+	// 実行中の出力をストリーミングし、終了後に実行結果のステータスを含むOutputSummaryを送信する
+	result.stream = startOutputStream(event)
+	defer result.stream.close(result)
+
+	err = handler.Execute(ctx, event, result)
+	result.EndTime = nowInMillis()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		// タイムアウトした場合はプロセスがkillされている
+		result.TimedOut = true
+		result.ExitCode = -1
+		result.Status = ActionStatusTimedOut
+		return result, nil
+	}
+	if err != nil {
+		return failAction(result, ActionStatusError, err)
+	}
+	if result.ExitCode == 0 {
+		result.Status = ActionStatusSucceeded
+	} else {
+		result.Status = ActionStatusFailed
+	}
+	return result, nil
+}
+
+// pushResult は実行結果をresultsChannelにプッシュするファンクション
+// 実行結果の送信が遅れてもActionの実行を止めないように、チャネルが一杯の場合は実行結果を破棄する
+// 破棄した場合はメッセージを削除しないため、可視時間が切れた後に再度受信される
+func pushResult(result *ActionResult, resultsChannel chan<- *ActionResult) {
+	select {
+	case resultsChannel <- result:
+	default:
+		logging.Error("Results channel is full. Dropping the action result.", logging.Fields{"eventID": result.EventID})
+		releaseEvent(result.event, false)
+	}
+}
+
+// handleEvent は1つのEventのActionを実行し、実行結果を記録してresultsChannelにプッシュするファンクション
+// Actionキューのメッセージは実行結果の送信に成功した後に削除する
+func handleEvent(event *Event, ledger *ActionLedger, resultsChannel chan<- *ActionResult) {
+	actionStarted()
+	result, err := ExecuteAction(event)
+	actionFinished()
+	if err != nil {
+		logging.Error("Could not execute the action.", logging.Fields{"eventID": event.EventID, "status": result.Status, "error": err})
+	} else {
+		logging.Info("Action completed.", logging.Fields{
+			"eventID":  event.EventID,
+			"status":   result.Status,
+			"exitCode": result.ExitCode,
+			"timedOut": result.TimedOut,
+			"duration": time.Duration(result.EndTime-result.StartTime) * time.Millisecond,
+		})
+	}
+
+	if ledger != nil {
+		ledger.complete(event, result)
+	}
+	pushResult(result, resultsChannel)
+}
+
+// ProcessEvents はeventsChannelからEventを取り出してActionを実行し、実行結果をresultsChannelにプッシュするファンクション
+// 最大maxConcurrentActions個のActionを並列に実行するが、RuleIDかRunbookNameが同じEventは受信順に1つずつ実行する
+// maxConcurrentActionsが0以下の場合はdefaultMaxConcurrentActionsとする
+// ledgerがnilでない場合は実行済みのEventを実行せずに、記録した実行結果を再度送信する
+func ProcessEvents(eventsChannel <-chan *Event, resultsChannel chan<- *ActionResult, ledger *ActionLedger, maxConcurrentActions int) {
+	if maxConcurrentActions <= 0 {
+		maxConcurrentActions = defaultMaxConcurrentActions
+	}
+	newWorkerPool(maxConcurrentActions, ledger, resultsChannel).run(eventsChannel)
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExecuteActionRejectsReservedEnviroment(t *testing.T) {
+	for _, key := range []string{"PATH", "LD_PRELOAD", "LD_LIBRARY_PATH", "BASH_ENV"} {
+		event := &Event{EventID: "event", ActionType: actionTypeScript, RawCommand: "true", Enviroment: map[string]string{key: "/tmp/evil"}}
+		result, err := ExecuteAction(event)
+		if err == nil || result.Status != ActionStatusError {
+			t.Errorf("%s: status = %s, want %s (%v)", key, result.Status, ActionStatusError, err)
+		}
+	}
+
+	event := &Event{EventID: "event", ActionType: actionTypeScript, RawCommand: `test "$GREETING" = hello`, Enviroment: map[string]string{"GREETING": "hello"}}
+	if result, err := ExecuteAction(event); err != nil || result.Status != ActionStatusSucceeded {
+		t.Errorf("status = %s, want %s (%v)", result.Status, ActionStatusSucceeded, err)
+	}
+}
+
+func TestInProcessActionRejectsRunAsUser(t *testing.T) {
+	if err := ConfigureExecution(ExecutionSettings{RunAsUser: "nobody"}); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureExecution(ExecutionSettings{})
+
+	events := []*Event{
+		newPolicyTestEvent(t, actionTypeFile, fileParameters{Path: "/tmp/app.conf", Content: "x"}),
+		newPolicyTestEvent(t, actionTypeHTTP, httpParameters{URL: "http://127.0.0.1/"}),
+	}
+	for _, event := range events {
+		result, err := ExecuteAction(event)
+		if err == nil || result.Status != ActionStatusError {
+			t.Errorf("%s: status = %s, want %s (%v)", event.ActionType, result.Status, ActionStatusError, err)
+		}
+	}
+}
+
+func TestExecuteActionCapturesOutputAndExitCode(t *testing.T) {
+	event := &Event{EventID: "event", InflightActionID: "inflight", RuleID: "rule", AgentID: "agent", ActionType: actionTypeScript,
+		RawCommand: `echo "out $NAME"; echo err >&2; exit 3`, Enviroment: map[string]string{"NAME": "runbook"}}
+	result, err := ExecuteAction(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != ActionStatusFailed || result.ExitCode != 3 || result.TimedOut {
+		t.Errorf("status = %s, exitCode = %d, timedOut = %v", result.Status, result.ExitCode, result.TimedOut)
+	}
+	if result.Stdout != "out runbook\n" || result.Stderr != "err\n" {
+		t.Errorf("stdout = %q, stderr = %q", result.Stdout, result.Stderr)
+	}
+	if result.EventID != "event" || result.InflightActionID != "inflight" || result.RuleID != "rule" || result.AgentID != "agent" {
+		t.Errorf("result does not identify the event: %+v", result)
+	}
+	if result.StartTime == 0 || result.EndTime < result.StartTime {
+		t.Errorf("startTime = %d, endTime = %d", result.StartTime, result.EndTime)
+	}
+}
+
+func TestExecuteActionEnforcesTimeout(t *testing.T) {
+	event := &Event{EventID: "event", ActionType: actionTypeScript, RawCommand: "echo started; sleep 10", Timeout: 1}
+	start := time.Now()
+	result, _ := ExecuteAction(event)
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Errorf("action ran for %v, want it killed after the timeout", elapsed)
+	}
+	if result.Status != ActionStatusTimedOut || !result.TimedOut {
+		t.Errorf("status = %s, timedOut = %v", result.Status, result.TimedOut)
+	}
+	if result.Stdout != "started\n" {
+		t.Errorf("output before the timeout should be kept: %q", result.Stdout)
+	}
+}
+
+// TestHandleEventKeepsMessageUntilResultIsSent はActionが完了しても、実行結果を送信するまでメッセージを削除しないことを確認するテスト
+func TestHandleEventKeepsMessageUntilResultIsSent(t *testing.T) {
+	queue := &fakeActionQueue{}
+	event := &Event{EventID: "event", ActionType: actionTypeScript, RawCommand: "true", ReceiptHandle: "receipt", queue: queue}
+	ledger, err := OpenActionLedger(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger.begin(event)
+
+	results := make(chan *ActionResult, 1)
+	handleEvent(event, ledger, results)
+	result := <-results
+	if result.Status != ActionStatusSucceeded || result.event != event {
+		t.Errorf("result = %+v", result)
+	}
+	if deleted := queue.deletedHandles(); len(deleted) != 0 {
+		t.Errorf("message should not be deleted before the result is sent: %v", deleted)
+	}
+	if entry, _ := ledger.begin(event); entry == nil || entry.State != ledgerStateCompleted {
+		t.Errorf("ledger entry = %+v, want completed", entry)
+	}
+}
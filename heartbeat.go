@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// ハートビート設定の定数
+const (
+	heartbeatIntervalSecs = 60
+	minPollIntervalSecs   = 1
+	maxPollIntervalSecs   = 300
+)
+
+// HeartbeatRequest はAgentからServerに送信するハートビートメッセージの構造体
+type HeartbeatRequest struct {
+	AgentID         string
+	AgentVersion    string
+	Uptime          int64 // Agent開始からのミリ秒
+	LastPollTime    int64 // 最後にSQSポーリングに成功した時刻(ミリ秒)
+	InflightActions int
+	QueuedActions   int // 実行待ちのEvent数
+	ErrorCount      int // 前回のハートビート以降に発生したエラーの件数。エラーの内容はErrorReportLoopで送信する
+}
+
+// HeartbeatResponse はハートビートに対してServerからAgentへ返却するメッセージの構造体
+type HeartbeatResponse struct {
+	Reregister       bool // trueの場合はAgentを再登録する
+	PollIntervalSecs int  // 0より大きい場合はSQSポーリング間隔を変更する
+	PauseActions     bool // trueの場合はAction実行を一時停止する(SQSポーリングを止める)
+	FullLogs         bool // trueの場合はローテートされたログファイルも含めて全てのログを送信する
+	// LogLevel が空でなく現在のログレベルと異なる場合はLogLevelDurationSecsの間ログレベルを変更する
+	LogLevel             string
+	LogLevelDurationSecs int
+}
+
+// AgentStatus はローカル制御エンドポイントで返却する実行中のAgentのステータスの構造体
+type AgentStatus struct {
+	AgentVersion     string
+	AgentID          string // AgentRegistrationが完了していない場合は空
+	Uptime           int64  // Agent開始からのミリ秒
+	LastPollTime     int64  // 最後にSQSポーリングに成功した時刻(ミリ秒)
+	InflightActions  int
+	QueuedActions    int
+	PollIntervalSecs int
+	Paused           bool // ServerからAction実行の一時停止を指示されている場合はtrue
+	LogLevel         string
+	BaseLogLevel     string // 設定ファイルによるログレベル
+}
+
+// agentState はハートビートで送信するAgentのステータスとServerから指示された動作を保持する
+var agentState = struct {
+	sync.Mutex
+	agentID         string
+	lastPollTime    int64
+	inflightActions int
+	queuedActions   int
+	pollInterval    time.Duration
+	paused          bool
+}{pollInterval: time.Second * sqsPollingFrequencySecs}
+
+// recordAgentID はAgentRegistrationで得たAgentIDを記録するファンクション
+func recordAgentID(agentID string) {
+	agentState.Lock()
+	agentState.agentID = agentID
+	agentState.Unlock()
+}
+
+// recordSuccessfulPoll はSQSポーリングに成功した時刻を記録するファンクション
+func recordSuccessfulPoll() {
+	agentState.Lock()
+	agentState.lastPollTime = nowInMillis()
+	agentState.Unlock()
+}
+
+// actionStarted は実行中のAction数を増やすファンクション
+func actionStarted() {
+	agentState.Lock()
+	agentState.inflightActions++
+	agentState.Unlock()
+}
+
+// actionFinished は実行中のAction数を減らすファンクション
+func actionFinished() {
+	agentState.Lock()
+	agentState.inflightActions--
+	agentState.Unlock()
+}
+
+// setQueuedActions は実行待ちのEvent数を記録するファンクション
+func setQueuedActions(n int) {
+	agentState.Lock()
+	agentState.queuedActions = n
+	agentState.Unlock()
+}
+
+// getPollInterval はSQSポーリング間隔を返却するファンクション
+func getPollInterval() time.Duration {
+	agentState.Lock()
+	defer agentState.Unlock()
+	return agentState.pollInterval
+}
+
+// clampPollInterval はSQSポーリング間隔(秒)をminPollIntervalSecsからmaxPollIntervalSecsの範囲に収めるファンクション
+func clampPollInterval(secs int) time.Duration {
+	if secs < minPollIntervalSecs {
+		secs = minPollIntervalSecs
+	} else if secs > maxPollIntervalSecs {
+		secs = maxPollIntervalSecs
+	}
+	return time.Second * time.Duration(secs)
+}
+
+// ConfigurePollInterval は設定ファイルのSQSポーリング間隔(秒)を設定するファンクション。0の場合はデフォルト
+// Serverからハートビートでポーリング間隔を指示された場合はそちらで上書きされる
+func ConfigurePollInterval(secs int) {
+	interval := time.Second * sqsPollingFrequencySecs
+	if secs > 0 {
+		interval = clampPollInterval(secs)
+	}
+	agentState.Lock()
+	defer agentState.Unlock()
+	if interval != agentState.pollInterval {
+		logging.Info("Changing the poll interval.", logging.Fields{"interval": interval, "source": "config"})
+		agentState.pollInterval = interval
+	}
+}
+
+// isActionExecutionPaused はServerからAction実行の一時停止を指示されているかを返却するファンクション
+func isActionExecutionPaused() bool {
+	agentState.Lock()
+	defer agentState.Unlock()
+	return agentState.paused
+}
+
+// getHeartbeatRequest は現在のAgentステータスからハートビートメッセージを構成するファンクション
+func getHeartbeatRequest(regInfo *RegistrationInfo) HeartbeatRequest {
+	agentState.Lock()
+	defer agentState.Unlock()
+
+	return HeartbeatRequest{
+		AgentID:         regInfo.AgentID,
+		AgentVersion:    AgentVersion,
+		Uptime:          nowInMillis() - startTime,
+		LastPollTime:    agentState.lastPollTime,
+		InflightActions: agentState.inflightActions,
+		QueuedActions:   agentState.queuedActions,
+		ErrorCount:      takeErrorCount(),
+	}
+}
+
+// getAgentStatus は現在のAgentのステータスを返却するファンクション
+func getAgentStatus() AgentStatus {
+	current, base := logging.GetLevel()
+	agentState.Lock()
+	defer agentState.Unlock()
+
+	return AgentStatus{
+		AgentVersion:     AgentVersion,
+		AgentID:          agentState.agentID,
+		Uptime:           nowInMillis() - startTime,
+		LastPollTime:     agentState.lastPollTime,
+		InflightActions:  agentState.inflightActions,
+		QueuedActions:    agentState.queuedActions,
+		PollIntervalSecs: int(agentState.pollInterval / time.Second),
+		Paused:           agentState.paused,
+		LogLevel:         current,
+		BaseLogLevel:     base,
+	}
+}
+
+// Beat はServerにHTTP POSTしてAgentステータスを送信し、Serverからの指示を得るファンクション
+func Beat(regInfo *RegistrationInfo, configObj *ServerConfig) (*HeartbeatResponse, error) {
+	request := getHeartbeatRequest(regInfo)
+	response := HeartbeatResponse{}
+	logging.Debug("Sending the heartbeat.", logging.Fields{
+		"inflightActions": request.InflightActions,
+		"queuedActions":   request.QueuedActions,
+		"errorCount":      request.ErrorCount,
+	})
+
+	// Session.Post(url, payload, result, errMsg)
+	server := configObj.get()
+	resp, err := newServerSession(server).Post(joinURL(server.EndPoint, "heartbeat", regInfo.AgentID), &request, &response, nil)
+	if err != nil {
+		restoreErrorCount(request.ErrorCount)
+		logging.Warn("Could not post the heartbeat to server.", logging.Fields{"error": err, "response": resp})
+		return nil, err
+	}
+
+	if 200 <= resp.Status() && resp.Status() <= 299 {
+		return &response, nil
+	}
+	restoreErrorCount(request.ErrorCount)
+	logging.Warn("Unexpected status from server.", logging.Fields{"status": resp.Status()})
+	return nil, errors.New("Server returned unexpected status: " + strconv.Itoa(resp.Status()))
+}
+
+// applyHeartbeatResponse はServerから指示された動作をAgentに反映するファンクション
+func applyHeartbeatResponse(response *HeartbeatResponse, regChannel chan<- time.Time) {
+	agentState.Lock()
+	if response.PollIntervalSecs > 0 {
+		if interval := clampPollInterval(response.PollIntervalSecs); interval != agentState.pollInterval {
+			logging.Info("Changing the poll interval.", logging.Fields{"interval": interval})
+			agentState.pollInterval = interval
+		}
+	}
+	if response.PauseActions != agentState.paused {
+		logging.Info("Changing the action execution state.", logging.Fields{"paused": response.PauseActions})
+		agentState.paused = response.PauseActions
+	}
+	agentState.Unlock()
+
+	if len(response.LogLevel) > 0 {
+		if current, _ := logging.GetLevel(); current != response.LogLevel {
+			duration := time.Second * time.Duration(response.LogLevelDurationSecs)
+			if err := logging.ChangeLevel(response.LogLevel, "server", duration); err != nil {
+				logging.Warn("Server requested an invalid log level.", logging.Fields{"level": response.LogLevel, "error": err})
+			}
+		}
+	}
+
+	if response.FullLogs {
+		logging.Info("Server requested the full logs.", nil)
+		requestFullLogs()
+	}
+
+	if response.Reregister {
+		logging.Info("Server requested re-registration.", nil)
+		select {
+		case regChannel <- time.Now():
+		default:
+			logging.Warn("Re-registration is already pending.", nil)
+		}
+	}
+}
+
+// HeartbeatLoop はheartbeatIntervalSecsごとにBeatを呼び出すファンクション
+func HeartbeatLoop(regManager *RegistrationManager, configObj *ServerConfig, regChannel chan<- time.Time) {
+	ticker := time.NewTicker(time.Second * heartbeatIntervalSecs)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		response, err := Beat(regManager.Get(), configObj)
+		if err != nil {
+			continue
+		}
+		applyHeartbeatResponse(response, regChannel)
+	}
+}
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetAgentState はテストの後にAgentのステータスとエラーの件数を元に戻すファンクション
+func resetAgentState(t *testing.T) {
+	agentState.Lock()
+	saved := agentState.pollInterval
+	agentState.Unlock()
+	takeErrorCount()
+	t.Cleanup(func() {
+		agentState.Lock()
+		agentState.lastPollTime = 0
+		agentState.inflightActions = 0
+		agentState.queuedActions = 0
+		agentState.pollInterval = saved
+		agentState.paused = false
+		agentState.Unlock()
+		takeErrorCount()
+	})
+}
+
+func TestBeatSendsAgentStatus(t *testing.T) {
+	resetAgentState(t)
+	var mu sync.Mutex
+	var path string
+	var request HeartbeatRequest
+	configObj := newTestTLSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(HeartbeatResponse{PollIntervalSecs: 20, PauseActions: true})
+	})
+
+	actionStarted()
+	actionStarted()
+	actionFinished()
+	setQueuedActions(3)
+	recordSuccessfulPoll()
+	recordError("first")
+	recordError("first")
+	takePendingErrors()
+
+	response, err := Beat(&RegistrationInfo{AgentID: "agent"}, configObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.PollIntervalSecs != 20 || !response.PauseActions {
+		t.Errorf("response = %+v", response)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if path != agentAPI+"heartbeat/agent" {
+		t.Errorf("path = %q", path)
+	}
+	if request.AgentID != "agent" || request.InflightActions != 1 || request.QueuedActions != 3 ||
+		request.ErrorCount != 2 || request.LastPollTime == 0 || request.Uptime < 0 {
+		t.Errorf("request = %+v", request)
+	}
+	if count := takeErrorCount(); count != 0 {
+		t.Errorf("error count after a heartbeat = %d, want 0", count)
+	}
+}
+
+func TestBeatKeepsErrorCountOnFailure(t *testing.T) {
+	resetAgentState(t)
+	configObj := newTestTLSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	recordError("error")
+	takePendingErrors()
+
+	if _, err := Beat(&RegistrationInfo{AgentID: "agent"}, configObj); err == nil {
+		t.Fatal("Beat should fail")
+	}
+	if count := takeErrorCount(); count != 1 {
+		t.Errorf("error count = %d, want it kept for the next heartbeat", count)
+	}
+}
+
+func TestApplyHeartbeatResponse(t *testing.T) {
+	resetAgentState(t)
+	regChannel := make(chan time.Time, 1)
+
+	applyHeartbeatResponse(&HeartbeatResponse{PollIntervalSecs: maxPollIntervalSecs * 10, PauseActions: true}, regChannel)
+	if interval := getPollInterval(); interval != time.Second*maxPollIntervalSecs {
+		t.Errorf("poll interval = %v, want it clamped to %ds", interval, maxPollIntervalSecs)
+	}
+	if !isActionExecutionPaused() {
+		t.Error("action execution should be paused")
+	}
+	if len(regChannel) != 0 {
+		t.Error("re-registration should not be triggered")
+	}
+
+	// 0のポーリング間隔は変更せず、PauseActionsがfalseの場合は再開する
+	applyHeartbeatResponse(&HeartbeatResponse{Reregister: true}, regChannel)
+	if interval := getPollInterval(); interval != time.Second*maxPollIntervalSecs {
+		t.Errorf("poll interval = %v, want it unchanged", interval)
+	}
+	if isActionExecutionPaused() {
+		t.Error("action execution should be resumed")
+	}
+	if len(regChannel) != 1 {
+		t.Error("re-registration should be triggered")
+	}
+
+	// 再AgentRegistrationが既に待っている場合はブロックしない
+	done := make(chan struct{})
+	go func() {
+		applyHeartbeatResponse(&HeartbeatResponse{Reregister: true}, regChannel)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("applyHeartbeatResponse blocked on a pending re-registration")
+	}
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// 可視時間キープアライブの定数
+// visibilityKeepaliveIntervalSecsごとにメッセージの可視時間をvisibilityExtensionSecs後まで延長する
+const (
+	visibilityKeepaliveIntervalSecs = 30
+	visibilityExtensionSecs         = 90
+)
+
+// visibilityKeepalive はActionの実行中と実行結果の送信中にメッセージの可視時間を延長し続ける構造体
+// 延長しないとActionが可視時間より長くかかった場合にメッセージが再度受信され、同じRunbookが二重に実行される
+// SQSは受信するごとに新しいReceiptHandleを発行し、可視時間の変更と削除には最後に受信したReceiptHandleが必要なため、
+// 実行中に同じメッセージを再度受信した場合はrenewで新しいReceiptHandleに入れ替える
+type visibilityKeepalive struct {
+	stop          chan struct{}
+	stopOnce      sync.Once
+	mu            sync.Mutex
+	receiptHandle string
+}
+
+// startVisibilityKeepalive はメッセージの可視時間の延長を開始するファンクション
+func startVisibilityKeepalive(queue ActionQueue, receiptHandle, eventID string) *visibilityKeepalive {
+	return startVisibilityKeepaliveEvery(queue, receiptHandle, eventID, time.Second*visibilityKeepaliveIntervalSecs)
+}
+
+// startVisibilityKeepaliveEvery はintervalごとにメッセージの可視時間を延長するファンクション
+func startVisibilityKeepaliveEvery(queue ActionQueue, receiptHandle, eventID string, interval time.Duration) *visibilityKeepalive {
+	k := &visibilityKeepalive{stop: make(chan struct{}), receiptHandle: receiptHandle}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-k.stop:
+				return
+			case <-ticker.C:
+				logging.Debug("Extending the message visibility.", logging.Fields{"eventID": eventID})
+				queue.ChangeVisibility(k.currentReceiptHandle(), visibilityExtensionSecs)
+			}
+		}
+	}()
+	return k
+}
+
+// Stop はメッセージの可視時間の延長を止めるファンクション
+// nilや停止済みの場合は何もしない
+func (k *visibilityKeepalive) Stop() {
+	if k == nil {
+		return
+	}
+	k.stopOnce.Do(func() { close(k.stop) })
+}
+
+// renew は可視時間の延長と削除に使うReceiptHandleを、同じメッセージを再度受信した時のReceiptHandleに入れ替えるファンクション
+// nilの場合は何もしない
+func (k *visibilityKeepalive) renew(receiptHandle string) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	k.receiptHandle = receiptHandle
+	k.mu.Unlock()
+}
+
+// currentReceiptHandle は最後に受信した時のReceiptHandleを返却するファンクション。nilの場合は空文字を返却する
+func (k *visibilityKeepalive) currentReceiptHandle() string {
+	if k == nil {
+		return ""
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.receiptHandle
+}
+
+// releaseEvent はEventの可視時間の延長を止めて、deleteMessageがtrueの場合はActionキューのメッセージを削除するファンクション
+// 削除しない場合はメッセージの可視時間が切れた後に再度受信される
+func releaseEvent(event *Event, deleteMessage bool) {
+	if event == nil {
+		return
+	}
+	event.keepalive.Stop()
+	if deleteMessage && event.queue != nil {
+		receiptHandle := event.ReceiptHandle
+		if renewed := event.keepalive.currentReceiptHandle(); len(renewed) > 0 {
+			receiptHandle = renewed
+		}
+		event.queue.Delete(receiptHandle)
+	}
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// visibilityRecorderQueue は可視時間の変更を記録するActionQueue
+type visibilityRecorderQueue struct {
+	fakeActionQueue
+	mu      sync.Mutex
+	handles []string
+	timeout []int64
+}
+
+func (q *visibilityRecorderQueue) ChangeVisibility(receiptHandle string, timeout int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handles = append(q.handles, receiptHandle)
+	q.timeout = append(q.timeout, timeout)
+	return nil
+}
+
+func (q *visibilityRecorderQueue) changes() ([]string, []int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string{}, q.handles...), append([]int64{}, q.timeout...)
+}
+
+func TestVisibilityKeepaliveExtendsUntilStopped(t *testing.T) {
+	queue := &visibilityRecorderQueue{}
+	keepalive := startVisibilityKeepaliveEvery(queue, "first", "event", time.Millisecond*10)
+	waitFor(t, "the visibility extensions", func() bool {
+		handles, _ := queue.changes()
+		return len(handles) >= 2
+	})
+
+	keepalive.renew("second")
+	waitFor(t, "the extension with the renewed receipt handle", func() bool {
+		handles, _ := queue.changes()
+		return handles[len(handles)-1] == "second"
+	})
+
+	keepalive.Stop()
+	keepalive.Stop()
+	time.Sleep(time.Millisecond * 20)
+	stopped, _ := queue.changes()
+	time.Sleep(time.Millisecond * 50)
+	handles, timeouts := queue.changes()
+	if len(handles) != len(stopped) {
+		t.Errorf("visibility was extended %d times after Stop", len(handles)-len(stopped))
+	}
+	for _, timeout := range timeouts {
+		if timeout != visibilityExtensionSecs {
+			t.Errorf("timeout = %d, want %d", timeout, visibilityExtensionSecs)
+		}
+	}
+}
+
+func TestReleaseEvent(t *testing.T) {
+	queue := &fakeActionQueue{}
+	kept := &Event{ReceiptHandle: "kept", queue: queue, keepalive: startVisibilityKeepalive(queue, "kept", "kept")}
+	releaseEvent(kept, false)
+	select {
+	case <-kept.keepalive.stop:
+	default:
+		t.Error("keepalive should be stopped")
+	}
+
+	deleted := &Event{ReceiptHandle: "first", queue: queue, keepalive: startVisibilityKeepalive(queue, "first", "deleted")}
+	deleted.keepalive.renew("second")
+	releaseEvent(deleted, true)
+
+	// キープアライブがないEventと、再起動後に読み込んだメッセージを持たないEventでも失敗しない
+	releaseEvent(&Event{ReceiptHandle: "plain", queue: queue}, true)
+	releaseEvent(&Event{ReceiptHandle: "orphan"}, true)
+	releaseEvent(nil, true)
+
+	if handles := queue.deletedHandles(); len(handles) != 2 || handles[0] != "second" || handles[1] != "plain" {
+		t.Errorf("deleted = %v, want [second plain]", handles)
+	}
+}
@@ -0,0 +1,310 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// Action実行記録の定数
+const (
+	actionLedgerFileName   = "actions.log"
+	actionLedgerTTL        = time.Hour * 24
+	maxActionLedgerEntries = 1000
+	// maxActionLedgerBytes は記録ファイルのサイズの上限
+	// 超える場合は有効な記録だけを書き込んだファイルに置き換え、それでも超える場合は古い記録から削除する
+	maxActionLedgerBytes = 1024 * 1024
+	// maxLedgerErrorMessageBytes は記録するエラーメッセージの上限
+	maxLedgerErrorMessageBytes = 1024
+)
+
+// Action実行記録の状態
+const (
+	ledgerStateStarted   = "started"
+	ledgerStateCompleted = "completed"
+)
+
+// ledgerEntry は1つのActionの実行記録の構造体
+type ledgerEntry struct {
+	Key        string
+	EventID    string
+	State      string
+	UpdateTime int64
+	Result     *ledgerResult `json:",omitempty"`
+}
+
+// ledgerResult は記録する実行結果の構造体
+// 記録ファイルを小さく保つため、標準出力と標準エラー出力は保存せずにダイジェストだけを記録する
+type ledgerResult struct {
+	Status          string
+	ExitCode        int
+	ErrorMessage    string
+	StartTime       int64
+	EndTime         int64
+	TimedOut        bool
+	OutputTruncated bool
+	OutputDigest    string // 標準出力と標準エラー出力のSHA-256
+}
+
+// newLedgerResult は実行結果から記録する実行結果を生成するファンクション
+func newLedgerResult(result *ActionResult) *ledgerResult {
+	digest := sha256.New()
+	digest.Write([]byte(result.Stdout))
+	digest.Write([]byte{0})
+	digest.Write([]byte(result.Stderr))
+
+	errorMessage := result.ErrorMessage
+	if len(errorMessage) > maxLedgerErrorMessageBytes {
+		errorMessage = errorMessage[:maxLedgerErrorMessageBytes] + truncatedOutputNote
+	}
+	return &ledgerResult{
+		Status:          result.Status,
+		ExitCode:        result.ExitCode,
+		ErrorMessage:    errorMessage,
+		StartTime:       result.StartTime,
+		EndTime:         result.EndTime,
+		TimedOut:        result.TimedOut,
+		OutputTruncated: result.OutputTruncated,
+		OutputDigest:    hex.EncodeToString(digest.Sum(nil)),
+	}
+}
+
+// actionResult は記録した実行結果からEventの実行結果を生成するファンクション
+// 出力は記録していないため、標準出力と標準エラー出力は空にしてOutputUnavailableをtrueにする
+func (r *ledgerResult) actionResult(event *Event) *ActionResult {
+	result := newActionResult(event)
+	result.Status = r.Status
+	result.ExitCode = r.ExitCode
+	result.ErrorMessage = r.ErrorMessage
+	result.StartTime = r.StartTime
+	result.EndTime = r.EndTime
+	result.TimedOut = r.TimedOut
+	result.OutputTruncated = r.OutputTruncated
+	result.OutputUnavailable = true
+	return result
+}
+
+// ActionLedger は実行を開始または完了したActionをInflightActionID(ない場合はEventID)ごとに記録する構造体
+// SQSは同じメッセージを複数回配信することがあるため、記録をディスクに保存して同じActionを二重に実行しないようにする
+// 記録ファイルは1行に1つの記録を追記してfsyncし、読み込む時は同じキーの最後の記録を使う
+// 記録はactionLedgerTTLを過ぎるか、maxActionLedgerEntriesかmaxActionLedgerBytesを超えると古いものから削除する
+type ActionLedger struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	entries map[string]*ledgerEntry
+	// active はこのAgentプロセスで実行中のActionのキー
+	active map[string]bool
+}
+
+// ledgerKey はEventを識別するキーを求めるファンクション
+func ledgerKey(event *Event) string {
+	if len(event.InflightActionID) > 0 {
+		return event.InflightActionID
+	}
+	return event.EventID
+}
+
+// OpenActionLedger はstateDirに保存されたAction実行記録を読み込むファンクション
+// 記録ファイルがない場合は空の記録を返却する。パースできない行は書き込み途中で終了したものとして無視する
+func OpenActionLedger(stateDir string) (*ActionLedger, error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, err
+	}
+	l := &ActionLedger{
+		path:    filepath.Join(stateDir, actionLedgerFileName),
+		entries: map[string]*ledgerEntry{},
+		active:  map[string]bool{},
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	// 期限切れの記録と書き込み途中で終了した行を取り除く
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load は記録ファイルを読み込むファンクション
+func (l *ActionLedger) load() error {
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && err == nil {
+			var entry ledgerEntry
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil || len(entry.Key) == 0 {
+				logging.Warn("Skipping a broken record in the action ledger.", logging.Fields{"path": l.path, "error": jsonErr})
+			} else {
+				l.entries[entry.Key] = &entry
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// prune は期限切れの記録と上限を超えた古い記録を削除するファンクション
+func (l *ActionLedger) prune() {
+	expiry := nowInMillis() - int64(actionLedgerTTL/time.Millisecond)
+	var entries []*ledgerEntry
+	for key, entry := range l.entries {
+		if entry.UpdateTime < expiry && !l.active[key] {
+			delete(l.entries, key)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) > maxActionLedgerEntries {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].UpdateTime < entries[j].UpdateTime })
+		for _, entry := range entries[:len(entries)-maxActionLedgerEntries] {
+			if !l.active[entry.Key] {
+				delete(l.entries, entry.Key)
+			}
+		}
+	}
+}
+
+// marshal は記録を1行に1つのJSONに変換するファンクション
+// maxActionLedgerBytesを超える場合は実行中でない古い記録から削除する
+func (l *ActionLedger) marshal() ([]byte, error) {
+	entries := make([]*ledgerEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].UpdateTime > entries[j].UpdateTime })
+
+	var lines [][]byte
+	size := 0
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		if size+len(line)+1 > maxActionLedgerBytes && !l.active[entry.Key] {
+			delete(l.entries, entry.Key)
+			continue
+		}
+		lines = append(lines, append(line, '\n'))
+		size += len(line) + 1
+	}
+
+	// 読み込む時に新しい記録で上書きされないように古い順に並べる
+	content := make([]byte, 0, size)
+	for i := len(lines) - 1; i >= 0; i-- {
+		content = append(content, lines[i]...)
+	}
+	return content, nil
+}
+
+// compact は期限切れの記録を削除し、有効な記録だけを書き込んだファイルで記録ファイルを置き換えるファンクション
+func (l *ActionLedger) compact() error {
+	l.prune()
+	content, err := l.marshal()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(l.path, content, 0600); err != nil {
+		return err
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		l.file = nil
+		return err
+	}
+	l.size = int64(len(content))
+	return nil
+}
+
+// append は記録を記録ファイルに追記してfsyncするファンクション
+// 記録ファイルがmaxActionLedgerBytesを超える場合は追記せずに有効な記録でファイルを置き換える
+func (l *ActionLedger) append(entry *ledgerEntry) {
+	l.entries[entry.Key] = entry
+	line, err := json.Marshal(entry)
+	if err == nil {
+		line = append(line, '\n')
+		if l.file == nil || l.size+int64(len(line)) > maxActionLedgerBytes {
+			err = l.compact()
+		} else {
+			var n int
+			n, err = l.file.Write(line)
+			l.size += int64(n)
+			if err == nil {
+				err = l.file.Sync()
+			}
+		}
+	}
+	if err != nil {
+		logging.Error("Could not save the action ledger.", logging.Fields{"path": l.path, "error": err})
+	}
+}
+
+// begin はEventの実行開始を記録するファンクション
+// 既に記録がある場合は記録を変更せずに既存の記録とfalseを返却する
+func (l *ActionLedger) begin(event *Event) (*ledgerEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ledgerKey(event)
+	if entry, ok := l.entries[key]; ok {
+		copied := *entry
+		return &copied, false
+	}
+	l.active[key] = true
+	l.append(&ledgerEntry{
+		Key:        key,
+		EventID:    event.EventID,
+		State:      ledgerStateStarted,
+		UpdateTime: nowInMillis(),
+	})
+	return nil, true
+}
+
+// isActive はEventがこのAgentプロセスで実行中かを返却するファンクション
+func (l *ActionLedger) isActive(event *Event) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active[ledgerKey(event)]
+}
+
+// complete はEventの実行完了と実行結果のステータスを記録するファンクション
+func (l *ActionLedger) complete(event *Event, result *ActionResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ledgerKey(event)
+	delete(l.active, key)
+	l.append(&ledgerEntry{
+		Key:        key,
+		EventID:    event.EventID,
+		State:      ledgerStateCompleted,
+		UpdateTime: nowInMillis(),
+		Result:     newLedgerResult(result),
+	})
+}
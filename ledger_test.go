@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestActionLedgerStoresDigestInsteadOfOutput(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenActionLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &Event{EventID: "event", InflightActionID: "inflight"}
+	if _, isNew := ledger.begin(event); !isNew {
+		t.Fatal("first begin should be new")
+	}
+	result := newActionResult(event)
+	result.Status = ActionStatusSucceeded
+	result.Stdout = "secret output"
+	ledger.complete(event, result)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, actionLedgerFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "secret output") {
+		t.Error("ledger should not store the action output")
+	}
+
+	reopened, err := OpenActionLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, isNew := reopened.begin(event)
+	if isNew || entry.State != ledgerStateCompleted {
+		t.Fatalf("reopened ledger should have the completed entry: %+v", entry)
+	}
+	stored := entry.Result.actionResult(event)
+	if stored.Status != ActionStatusSucceeded || len(stored.Stdout) != 0 || !stored.OutputUnavailable || len(entry.Result.OutputDigest) == 0 {
+		t.Errorf("stored result = %+v, digest = %q", stored, entry.Result.OutputDigest)
+	}
+}
+
+func TestActionLedgerIsCappedBySize(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenActionLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 記録を直接追加してからファイルを置き換える
+	for i := 0; i < maxActionLedgerEntries; i++ {
+		event := &Event{EventID: "event" + strconv.Itoa(i)}
+		result := newActionResult(event)
+		result.ErrorMessage = strings.Repeat("x", maxLedgerErrorMessageBytes*2)
+		ledger.entries[event.EventID] = &ledgerEntry{Key: event.EventID, EventID: event.EventID, State: ledgerStateCompleted,
+			UpdateTime: nowInMillis() - int64(maxActionLedgerEntries-i), Result: newLedgerResult(result)}
+	}
+	if err := ledger.compact(); err != nil {
+		t.Fatal(err)
+	}
+	last := &Event{EventID: "last"}
+	ledger.begin(last)
+	ledger.complete(last, newActionResult(last))
+
+	info, err := os.Stat(filepath.Join(dir, actionLedgerFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > maxActionLedgerBytes || info.Size() < maxActionLedgerBytes/2 {
+		t.Errorf("ledger size = %d, want close to %d", info.Size(), maxActionLedgerBytes)
+	}
+	reopened, err := OpenActionLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isNew := reopened.begin(last); isNew {
+		t.Error("the newest entry should be kept")
+	}
+}
+
+func TestActionLedgerAppendsRecords(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenActionLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, actionLedgerFileName)
+
+	first := &Event{EventID: "first"}
+	ledger.begin(first)
+	ledger.complete(first, newActionResult(first))
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(before), "\n"); lines != 2 {
+		t.Fatalf("ledger has %d lines, want 2", lines)
+	}
+
+	second := &Event{EventID: "second"}
+	ledger.begin(second)
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(after), string(before)) || strings.Count(string(after), "\n") != 3 {
+		t.Errorf("begin should append one line to the ledger:\n%s", after)
+	}
+
+	// 書き込み途中で終了した行は無視し、同じキーの最後の記録を使う
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Key":"second","State":`)
+	file.Close()
+
+	reopened, err := OpenActionLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, isNew := reopened.begin(first); isNew || entry.State != ledgerStateCompleted {
+		t.Errorf("first entry = %+v, want completed", entry)
+	}
+	if entry, isNew := reopened.begin(second); isNew || entry.State != ledgerStateStarted {
+		t.Errorf("second entry = %+v, want started", entry)
+	}
+}
@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// ローカルキューのディレクトリ構成の定数
+// Serverやオペレータはメッセージファイルを一時ファイルに書き込んでからnewディレクトリにリネームして送信する
+// Agentはメッセージファイルをinflightディレクトリにリネームすることでメッセージを受信し、
+// ファイルの更新時刻を可視時間の期限として使う
+const (
+	localQueueNewDir      = "new"
+	localQueueInflightDir = "inflight"
+	localQueueFileExt     = ".json"
+)
+
+// localQueueFile はローカルキューのメッセージファイルの構造体
+// ファイル例：{"Attributes": {"agentID": "123456789", "signature": "..."}, "Body": "{...msg.jsonと同じEvent...}"}
+type localQueueFile struct {
+	Attributes map[string]string
+	Body       string
+}
+
+// localQueue はローカルディレクトリをスプールとして使うActionキューの構造体
+type localQueue struct {
+	newDir      string
+	inflightDir string
+}
+
+// newLocalQueue はローカルキューを生成するファンクション
+func newLocalQueue(dir string) (*localQueue, error) {
+	if len(dir) == 0 {
+		return nil, errors.New("Local queue directory is missing.")
+	}
+	q := &localQueue{
+		newDir:      filepath.Join(dir, localQueueNewDir),
+		inflightDir: filepath.Join(dir, localQueueInflightDir),
+	}
+	for _, d := range []string{q.newDir, q.inflightDir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// listMessageFiles はディレクトリ内のメッセージファイル名を名前順に返却するファンクション
+func listMessageFiles(dir string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []os.FileInfo
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), localQueueFileExt) {
+			result = append(result, f)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+// requeueExpired は可視時間の期限が切れたinflightのメッセージをnewに戻すファンクション
+func (q *localQueue) requeueExpired() {
+	files, err := listMessageFiles(q.inflightDir)
+	if err != nil {
+		logging.Warn("Could not list inflight messages.", logging.Fields{"error": err})
+		return
+	}
+	now := time.Now()
+	for _, f := range files {
+		if f.ModTime().Before(now) {
+			os.Rename(filepath.Join(q.inflightDir, f.Name()), filepath.Join(q.newDir, f.Name()))
+		}
+	}
+}
+
+// Receive はnewディレクトリのメッセージを最大maxNumMessagesToFetch件受信するファンクション
+func (q *localQueue) Receive() ([]*QueueMessage, error) {
+	logging.Debug("Polling local queue for messages.", nil)
+	q.requeueExpired()
+
+	files, err := listMessageFiles(q.newDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*QueueMessage
+	for _, f := range files {
+		if len(messages) >= maxNumMessagesToFetch {
+			break
+		}
+		inflightPath := filepath.Join(q.inflightDir, f.Name())
+		// リネームに失敗した場合は他のプロセスが受信済み
+		if err := os.Rename(filepath.Join(q.newDir, f.Name()), inflightPath); err != nil {
+			continue
+		}
+		deadline := time.Now().Add(time.Second * defaultVisibilityTimeout)
+		if err := os.Chtimes(inflightPath, deadline, deadline); err != nil {
+			logging.Warn("Could not set the message visibility.", logging.Fields{"file": f.Name(), "error": err})
+		}
+
+		content, err := ioutil.ReadFile(inflightPath)
+		var file localQueueFile
+		if err == nil {
+			err = json.Unmarshal(content, &file)
+		}
+		if err != nil {
+			logging.Error("Could not read the local queue message. Deleting the message.", logging.Fields{"file": f.Name(), "error": err})
+			os.Remove(inflightPath)
+			continue
+		}
+
+		messages = append(messages, &QueueMessage{
+			MessageID:     strings.TrimSuffix(f.Name(), localQueueFileExt),
+			ReceiptHandle: f.Name(),
+			Body:          file.Body,
+			Attributes:    file.Attributes,
+		})
+	}
+	return messages, nil
+}
+
+// inflightPath はReceiptHandleからinflightのメッセージファイルパスを求めるファンクション
+func (q *localQueue) inflightPath(receiptHandle string) string {
+	return filepath.Join(q.inflightDir, filepath.Base(receiptHandle))
+}
+
+// ChangeVisibility はinflightのメッセージファイルの更新時刻を可視時間の期限に変更するファンクション
+// timeoutが0の場合はすぐにnewディレクトリに戻す
+func (q *localQueue) ChangeVisibility(receiptHandle string, timeout int64) error {
+	path := q.inflightPath(receiptHandle)
+	var err error
+	if timeout <= 0 {
+		err = os.Rename(path, filepath.Join(q.newDir, filepath.Base(receiptHandle)))
+	} else {
+		deadline := time.Now().Add(time.Second * time.Duration(timeout))
+		err = os.Chtimes(path, deadline, deadline)
+	}
+	if err != nil {
+		logging.Error("Cloud not change the message visibility.", logging.Fields{
+			"receipt": receiptHandle,
+			"error":   err,
+		})
+		return err
+	}
+	return nil
+}
+
+// Delete はinflightのメッセージファイルを削除するファンクション
+func (q *localQueue) Delete(receiptHandle string) error {
+	logging.Debug("Deleting the event from local queue.", nil)
+	if err := os.Remove(q.inflightPath(receiptHandle)); err != nil {
+		logging.Error("Cloud not delete the event.", logging.Fields{"error": err})
+		return err
+	}
+	return nil
+}
+
+// WriteLocalQueueMessage はdirのローカルキューにメッセージファイルを送信するファンクション
+// 受信中のAgentが書き込み途中のファイルを読まないように、一時ファイルに書き込んでからnewディレクトリにリネームする
+func WriteLocalQueueMessage(dir, messageID string, content []byte) error {
+	q, err := newLocalQueue(dir)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(q.newDir, messageID+".tmp")
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(q.newDir, messageID+localQueueFileExt))
+}
+
+// EncodeLocalQueueMessage はagentID属性とsignature属性を付けたEventの本文をローカルキューのメッセージファイルの内容に変換するファンクション
+func EncodeLocalQueueMessage(agentID, signature string, body []byte) ([]byte, error) {
+	return json.Marshal(&localQueueFile{
+		Attributes: map[string]string{agentIDAttribute: agentID, signatureAttribute: signature},
+		Body:       string(body),
+	})
+}
+
+// LocalQueueLength はdirのローカルキューにある受信前と受信中のメッセージの数を返却するファンクション
+func LocalQueueLength(dir string) (int, error) {
+	q, err := newLocalQueue(dir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, d := range []string{q.newDir, q.inflightDir} {
+		files, err := listMessageFiles(d)
+		if err != nil {
+			return 0, err
+		}
+		count += len(files)
+	}
+	return count, nil
+}
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeLocalQueueMessage はnewディレクトリにメッセージファイルを書き込むファンクション
+func writeLocalQueueMessage(t *testing.T, dir, name, body string) {
+	content, err := json.Marshal(localQueueFile{Attributes: map[string]string{"agentID": "agent"}, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, localQueueNewDir, name), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustReceive(t *testing.T, q *localQueue) []*QueueMessage {
+	messages, err := q.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+// expire はinflightのメッセージの可視時間の期限を過去にするファンクション
+func expire(t *testing.T, q *localQueue, receiptHandle string) {
+	past := time.Now().Add(-time.Second)
+	if err := os.Chtimes(q.inflightPath(receiptHandle), past, past); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalQueueVisibility(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newLocalQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLocalQueueMessage(t, dir, "0001.json", `{"EventID":"event"}`)
+
+	messages := mustReceive(t, q)
+	if len(messages) != 1 || messages[0].Body != `{"EventID":"event"}` || messages[0].Attributes["agentID"] != "agent" {
+		t.Fatalf("messages = %+v", messages)
+	}
+	receipt := messages[0].ReceiptHandle
+	info, err := os.Stat(q.inflightPath(receipt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().After(time.Now()) {
+		t.Errorf("inflight deadline %v should be in the future", info.ModTime())
+	}
+	if messages := mustReceive(t, q); len(messages) != 0 {
+		t.Errorf("inflight message should not be redelivered before the deadline: %+v", messages)
+	}
+
+	// 可視時間の期限が切れたメッセージは再度受信される
+	expire(t, q, receipt)
+	messages = mustReceive(t, q)
+	if len(messages) != 1 || messages[0].ReceiptHandle != receipt {
+		t.Fatalf("expired message should be redelivered: %+v", messages)
+	}
+
+	// 可視時間を延長したメッセージは期限まで再度受信されない
+	if err := q.ChangeVisibility(receipt, visibilityExtensionSecs); err != nil {
+		t.Fatal(err)
+	}
+	if messages := mustReceive(t, q); len(messages) != 0 {
+		t.Errorf("extended message should not be redelivered: %+v", messages)
+	}
+
+	// 可視時間を0にしたメッセージはすぐに再度受信される
+	if err := q.ChangeVisibility(receipt, 0); err != nil {
+		t.Fatal(err)
+	}
+	if messages := mustReceive(t, q); len(messages) != 1 {
+		t.Errorf("released message should be redelivered: %+v", messages)
+	}
+}
+
+func TestLocalQueueDeleteAfterAck(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newLocalQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLocalQueueMessage(t, dir, "0001.json", `{"EventID":"event"}`)
+
+	messages := mustReceive(t, q)
+	if len(messages) != 1 {
+		t.Fatalf("messages = %+v", messages)
+	}
+	if err := q.Delete(messages[0].ReceiptHandle); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(q.inflightPath(messages[0].ReceiptHandle)); !os.IsNotExist(err) {
+		t.Error("deleted message should be removed from inflight")
+	}
+
+	// 削除したメッセージは期限が過ぎても再度受信されない
+	if messages := mustReceive(t, q); len(messages) != 0 {
+		t.Errorf("deleted message should not be redelivered: %+v", messages)
+	}
+	if err := q.Delete(messages[0].ReceiptHandle); err == nil {
+		t.Error("deleting an already deleted message should fail")
+	}
+}
+
+func TestLocalQueueDropsBrokenMessages(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newLocalQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, localQueueNewDir, "0001.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, localQueueNewDir, "0002.tmp"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeLocalQueueMessage(t, dir, "0003.json", `{"EventID":"event"}`)
+
+	messages := mustReceive(t, q)
+	if len(messages) != 1 || messages[0].MessageID != "0003" {
+		t.Errorf("messages = %+v", messages)
+	}
+	if _, err := os.Stat(q.inflightPath("0001.json")); !os.IsNotExist(err) {
+		t.Error("broken message should be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, localQueueNewDir, "0002.tmp")); err != nil {
+		t.Error("file being written should be left in new")
+	}
+}
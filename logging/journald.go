@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// defaultJournaldSocket はjournaldのネイティブプロトコルのソケット
+const defaultJournaldSocket = "/run/systemd/journal/socket"
+
+// journaldSink はjournaldのネイティブプロトコルでログのフィールドをそのままジャーナルのフィールドとして送るsinkWriter
+type journaldSink struct {
+	socket *datagramSocket
+}
+
+// newJournaldSink はjournaldのソケットに接続するファンクション。pathが空の場合はデフォルトのソケットを使う
+func newJournaldSink(path string) (*journaldSink, error) {
+	if len(path) == 0 {
+		path = defaultJournaldSocket
+	}
+	socket, err := dialDatagramSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{socket: socket}, nil
+}
+
+func (s *journaldSink) close() error {
+	return s.socket.close()
+}
+
+// journalFieldName はログのフィールド名をジャーナルのフィールド名(英大文字、数字、"_")に変換するファンクション
+// "_"で始まる名前はjournaldが予約しているため、先頭の"_"を取り除く
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, key)
+	return strings.TrimLeft(name, "_")
+}
+
+// writeJournalField はフィールドをネイティブプロトコルの形式で書き込むファンクション
+// 改行を含む値は"名前\n<値の長さ(64bitリトルエンディアン)><値>\n"の形式にする
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// writeEntry はメッセージ、重要度、識別子とログのフィールドをジャーナルに送るファンクション
+func (s *journaldSink) writeEntry(entry *logrus.Entry, formatted []byte) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(syslogSeverity(entry.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", logIdentifier)
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := journalFieldName(k)
+		if len(name) == 0 {
+			continue
+		}
+		v := entry.Data[k]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		writeJournalField(&b, name, fmt.Sprint(v))
+	}
+	return s.socket.write(b.Bytes())
+}
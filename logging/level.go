@@ -0,0 +1,234 @@
+package logging
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ログレベル名
+// logrusにはtraceレベルがないため、traceはdebugレベルにSQSの通信内容などのTraceのログを加えたものとして扱う
+const (
+	LevelTrace = "trace"
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// defaultLevelResetDuration は変更したログレベルを元に戻すまでのデフォルトの時間
+const defaultLevelResetDuration = time.Minute * 15
+
+// traceField はTraceのログに付けるフィールド名。ServerHookはこのフィールドのあるログをServerに送信しない
+const traceField = "trace"
+
+// levelChangeField はログレベルの変更を記録するログに付けるフィールド名
+// ログレベルをerrorに変更した場合やerrorから変更した場合も記録が残るように、このフィールドのあるログは出力先のログレベルに関係なく出力する
+const levelChangeField = "levelChange"
+
+// traceEnabled はtraceレベルが有効な場合は1
+var traceEnabled int32
+
+// loggerLevel はloggerが出力するログレベル(logrus.Level)
+// logrusのLoggerのLevelはロックせずに読まれるため、loggerのLevelはDebugLevelのまま変更せず、このログレベルで出力を判定する
+var loggerLevel = int32(logrus.InfoLevel)
+
+// isLevelEnabled はログレベルのログを出力するかを返却するファンクション
+func isLevelEnabled(level logrus.Level) bool {
+	return logrus.Level(atomic.LoadInt32(&loggerLevel)) >= level
+}
+
+// levelState は設定ファイルによるログレベルと、実行中に変更したログレベルを保持する
+var levelState = struct {
+	sync.Mutex
+	base       string // SetupLoggerで設定したログレベル
+	current    string
+	resetAfter time.Duration
+	timer      *time.Timer
+}{base: LevelInfo, current: LevelInfo, resetAfter: defaultLevelResetDuration}
+
+// normalizeLevel はログレベル名を検証して正規化するファンクション
+func normalizeLevel(level string) (string, error) {
+	level = strings.ToLower(level)
+	if level == LevelTrace {
+		return level, nil
+	}
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return "", errors.New("Unknown log level: " + level)
+	}
+	if parsed == logrus.WarnLevel {
+		return LevelWarn, nil
+	}
+	return parsed.String(), nil
+}
+
+// ValidateLevel はログレベル名が正しいかを検証するファンクション
+func ValidateLevel(level string) error {
+	_, err := normalizeLevel(level)
+	return err
+}
+
+// applyLevel はloggerとログレベルを指定していない出力先のログレベルを変更するファンクション
+// loggerのログレベルは出力先のログレベルのうち最も詳細なものにする
+func applyLevel(level string) {
+	logrusLevel := logrus.DebugLevel
+	if level != LevelTrace {
+		logrusLevel, _ = logrus.ParseLevel(level)
+	}
+	if level == LevelTrace {
+		atomic.StoreInt32(&traceEnabled, 1)
+	} else {
+		atomic.StoreInt32(&traceEnabled, 0)
+	}
+
+	sinks.RLock()
+	defer sinks.RUnlock()
+	enabledLevel := logrus.PanicLevel
+	for _, hook := range sinks.hooks {
+		hook.mu.Lock()
+		if !hook.fixed {
+			hook.level = logrusLevel
+		}
+		if hook.level > enabledLevel {
+			enabledLevel = hook.level
+		}
+		hook.mu.Unlock()
+	}
+	if len(sinks.hooks) == 0 {
+		enabledLevel = logrusLevel
+	}
+	atomic.StoreInt32(&loggerLevel, int32(enabledLevel))
+}
+
+// setBaseLevel は設定ファイルによるログレベルを設定するファンクション
+// 実行中に変更したログレベルが有効な場合は元に戻すまでそのログレベルを使う
+func setBaseLevel(level string) {
+	levelState.Lock()
+	defer levelState.Unlock()
+	levelState.base = level
+	if levelState.timer == nil {
+		levelState.current = level
+	}
+	applyLevel(levelState.current)
+}
+
+// SetLevelResetDuration は変更したログレベルを元に戻すまでのデフォルトの時間を設定するファンクション
+func SetLevelResetDuration(d time.Duration) {
+	if d <= 0 {
+		d = defaultLevelResetDuration
+	}
+	levelState.Lock()
+	levelState.resetAfter = d
+	levelState.Unlock()
+}
+
+// GetLevel は現在のログレベルと設定ファイルによるログレベルを返却するファンクション
+func GetLevel() (current string, base string) {
+	levelState.Lock()
+	defer levelState.Unlock()
+	return levelState.current, levelState.base
+}
+
+// IsTraceEnabled はtraceレベルが有効かを返却するファンクション
+func IsTraceEnabled() bool {
+	return atomic.LoadInt32(&traceEnabled) == 1
+}
+
+// ChangeLevel は実行中にログレベルを変更し、durationの後に設定ファイルによるログレベルに戻すファンクション
+// durationが0の場合はSetLevelResetDurationで設定した時間を使う。sourceは変更の契機としてログに記録する
+func ChangeLevel(level string, source string, duration time.Duration) error {
+	level, err := normalizeLevel(level)
+	if err != nil {
+		return err
+	}
+
+	levelState.Lock()
+	defer levelState.Unlock()
+	if duration <= 0 {
+		duration = levelState.resetAfter
+	}
+	if levelState.timer != nil {
+		levelState.timer.Stop()
+	}
+	from := levelState.current
+	levelState.current = level
+	applyLevel(level)
+	logLevelChange("Changed the log level.", Fields{"from": from, "to": level, "source": source, "revertAfter": duration.String()})
+
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		levelState.Lock()
+		defer levelState.Unlock()
+		if levelState.timer != timer {
+			return
+		}
+		resetLevel("timer")
+	})
+	levelState.timer = timer
+	return nil
+}
+
+// ResetLevel は実行中に変更したログレベルを設定ファイルによるログレベルに戻すファンクション
+func ResetLevel(source string) {
+	levelState.Lock()
+	defer levelState.Unlock()
+	resetLevel(source)
+}
+
+// resetLevel はlevelStateをロックした状態でログレベルを元に戻すファンクション
+func resetLevel(source string) {
+	if levelState.timer != nil {
+		levelState.timer.Stop()
+		levelState.timer = nil
+	}
+	if levelState.current == levelState.base {
+		return
+	}
+	from := levelState.current
+	levelState.current = levelState.base
+	applyLevel(levelState.base)
+	logLevelChange("Reverted the log level.", Fields{"from": from, "to": levelState.base, "source": source})
+}
+
+// logLevelChange はログレベルの変更を現在のログレベルに関係なく出力するファンクション
+// Errorで出力するとServerにエラーとして送信されるため、Warnで出力して出力先のログレベルによる判定を省く
+func logLevelChange(msg string, fields Fields) {
+	changeFields := Fields{levelChangeField: true}
+	for k, v := range fields {
+		changeFields[k] = v
+	}
+	log.WithFields(convertToLogrusFields(changeFields)).Warn(msg)
+}
+
+// RaiseLevel は現在のログレベルより1段階詳細なログレベルに変更するファンクション
+// 既にtraceレベルの場合は元に戻すまでの時間を延長する
+func RaiseLevel(source string) error {
+	current, _ := GetLevel()
+	next := LevelTrace
+	switch current {
+	case LevelError:
+		next = LevelWarn
+	case LevelWarn:
+		next = LevelInfo
+	case LevelInfo:
+		next = LevelDebug
+	}
+	return ChangeLevel(next, source, 0)
+}
+
+// Trace はtraceレベルが有効な場合にメッセージとlogrusフィールドをレベルDebugとして出力するファンクション
+func Trace(msg string, fields Fields) {
+	if !IsTraceEnabled() {
+		return
+	}
+	traceFields := Fields{traceField: true}
+	for k, v := range fields {
+		traceFields[k] = v
+	}
+	Debug(msg, traceFields)
+}
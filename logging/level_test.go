@@ -0,0 +1,121 @@
+package logging
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// TestApplyLevelConcurrentWithLogging はログの出力中にログレベルを変更しても競合しないことを確認するテスト
+func TestApplyLevelConcurrentWithLogging(t *testing.T) {
+	defer applyLevel(LevelInfo)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			Debug("debug", nil)
+			Info("info", nil)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if i%2 == 0 {
+				applyLevel("debug")
+			} else {
+				applyLevel(LevelTrace)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if log.Level != logrus.DebugLevel {
+		t.Errorf("logger level = %v, want debug", log.Level)
+	}
+}
+
+// TestApplyLevelGatesLevels はapplyLevelで変更したログレベルで出力を判定することを確認するテスト
+func TestApplyLevelGatesLevels(t *testing.T) {
+	defer applyLevel(LevelInfo)
+
+	applyLevel(LevelInfo)
+	if isLevelEnabled(logrus.DebugLevel) || !isLevelEnabled(logrus.InfoLevel) {
+		t.Errorf("info level should enable info but not debug")
+	}
+	applyLevel(LevelTrace)
+	if !isLevelEnabled(logrus.DebugLevel) || !IsTraceEnabled() {
+		t.Errorf("trace level should enable debug and trace")
+	}
+}
+
+// TestServerHookSkipsTrace はTraceのログをServerの送信待ちに追加しないことを確認するテスト
+func TestServerHookSkipsTrace(t *testing.T) {
+	hook := NewServerHook(func(gzipped []byte) error { return nil })
+
+	hook.Fire(&logrus.Entry{Logger: log, Data: logrus.Fields{traceField: true, "body": "secret"}, Message: "SQS response"})
+	hook.Fire(&logrus.Entry{Logger: log, Data: logrus.Fields{"eventID": "1"}, Message: "Received the event."})
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if len(hook.entries) != 1 || hook.entries[0].Message != "Received the event." {
+		t.Errorf("entries = %+v, want only the non-trace entry", hook.entries)
+	}
+}
+
+// TestLevelChangesAreAlwaysLogged はerrorレベルへの変更とerrorレベルからの変更と元に戻したことが、
+// 出力先のログレベルに関係なく出力されることを確認するテスト
+func TestLevelChangesAreAlwaysLogged(t *testing.T) {
+	dir := t.TempDir()
+	defaultPath := filepath.Join(dir, "agent.log")
+	errorPath := filepath.Join(dir, "error.log")
+	config := LogConfig{Sinks: []SinkConfig{{Path: defaultPath}, {Path: errorPath, Level: LevelError}}}
+	if err := SetupLogger(config, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ResetLevel("test")
+		sinks.Lock()
+		hooks := sinks.hooks
+		sinks.hooks = nil
+		sinks.Unlock()
+		for _, hook := range hooks {
+			hook.close()
+		}
+		applyLevel(LevelInfo)
+	}()
+
+	if err := ChangeLevel(LevelError, "test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	Warn("hidden warning", nil)
+	if err := ChangeLevel(LevelDebug, "test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChangeLevel(LevelError, "test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ResetLevel("test")
+
+	for _, path := range []string{defaultPath, errorPath} {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(content), "Changed the log level."); n != 3 {
+			t.Errorf("%s: %d level changes logged, want 3:\n%s", path, n, content)
+		}
+		if !strings.Contains(string(content), "Reverted the log level.") {
+			t.Errorf("%s: revert is not logged:\n%s", path, content)
+		}
+		if strings.Contains(string(content), "hidden warning") {
+			t.Errorf("%s: warning should not be logged at error level", path)
+		}
+	}
+}
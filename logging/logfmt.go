@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// logfmtFormatter はログをlogfmt形式(key=value)の1行にするFormatter
+// 時刻はUTCのRFC3339、キーはソートし、空白や記号を含む値はクォートする
+type logfmtFormatter struct{}
+
+// Format はログをlogfmt形式にするファンクション
+func (f *logfmtFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	var b bytes.Buffer
+	writeLogfmtPair(&b, "ts", entry.Time.UTC().Format(time.RFC3339Nano))
+	writeLogfmtPair(&b, "level", entry.Level.String())
+	writeLogfmtPair(&b, "msg", entry.Message)
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := entry.Data[k]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		writeLogfmtPair(&b, k, fmt.Sprint(v))
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// writeLogfmtPair はkey=valueをバッファに書き込むファンクション
+func writeLogfmtPair(b *bytes.Buffer, key, value string) {
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	b.WriteString(key)
+	b.WriteByte('=')
+	if needsLogfmtQuote(value) {
+		b.WriteString(strconv.Quote(value))
+	} else {
+		b.WriteString(value)
+	}
+}
+
+// needsLogfmtQuote は値をクォートする必要があるかを返却するファンクション
+func needsLogfmtQuote(value string) bool {
+	if len(value) == 0 {
+		return true
+	}
+	return strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == 0x7f || !strconv.IsPrint(r)
+	}) >= 0
+}
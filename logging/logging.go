@@ -1,24 +1,47 @@
 package logging
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
-
-	"gopkg.in/natefinch/lumberjack.v2"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 )
 
 const (
-	maxLogFileSizeInMB = 10
-	maxNumLogFiles     = 10
+	defaultMaxLogFileSizeInMB = 10
+	defaultMaxNumLogFiles     = 10
 )
 
 // Fields はlogrusフィールド用オブジェクト
 type Fields map[string]interface{}
 
-// logはlogrusオブジェクト
-var log = logrus.New()
+// logはlogrusオブジェクト。出力するログレベルはloggerLevelで判定するため、LevelはDebugLevelのまま変更しない
+var log = newLogger()
+
+// newLogger はlogrusオブジェクトを生成するファンクション
+func newLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Level = logrus.DebugLevel
+	return logger
+}
+
+// logFilePath はSetupLoggerで設定した最初の"file"の出力先のパス。UploadFullLogsで使う
+var (
+	logFileMu   sync.Mutex
+	logFilePath string
+)
+
+// sinks はSetupLoggerで設定したログの出力先。loggerに1度だけ追加したsinkDispatcherから書き込む
+var sinks = struct {
+	sync.RWMutex
+	hooks []*sinkHook
+}{}
+
+// setupOnce はloggerにHookを1度だけ追加するために使う
+var setupOnce sync.Once
 
 // convertToLogrusFields はlogrusフィールドに変換するファンクション
 func convertToLogrusFields(fields Fields) logrus.Fields {
@@ -32,6 +55,9 @@ func convertToLogrusFields(fields Fields) logrus.Fields {
 // Debug はメッセージとlogrusフィールドをレベルDebugとして定義するファンクション
 // 出力例：time="2015-03-26T01:27:38-04:00" level=debug msg="Failed to send event" url=... error=... response=...
 func Debug(msg string, fields Fields) {
+	if !isLevelEnabled(logrus.DebugLevel) {
+		return
+	}
 	if fields != nil {
 		log.WithFields(convertToLogrusFields(fields)).Debug(msg)
 	} else {
@@ -41,6 +67,9 @@ func Debug(msg string, fields Fields) {
 
 // Info はメッセージとlogrusフィールドをレベルInfoとして定義するファンクション
 func Info(msg string, fields Fields) {
+	if !isLevelEnabled(logrus.InfoLevel) {
+		return
+	}
 	if fields != nil {
 		log.WithFields(convertToLogrusFields(fields)).Info(msg)
 	} else {
@@ -50,6 +79,9 @@ func Info(msg string, fields Fields) {
 
 // Warn はメッセージとlogrusフィールドをレベルWarnとして定義するファンクション
 func Warn(msg string, fields Fields) {
+	if !isLevelEnabled(logrus.WarnLevel) {
+		return
+	}
 	if fields != nil {
 		log.WithFields(convertToLogrusFields(fields)).Warn(msg)
 	} else {
@@ -59,6 +91,9 @@ func Warn(msg string, fields Fields) {
 
 // Error はメッセージとlogrusフィールドをレベルErrorとして定義するファンクション
 func Error(msg string, fields Fields) {
+	if !isLevelEnabled(logrus.ErrorLevel) {
+		return
+	}
 	if fields != nil {
 		log.WithFields(convertToLogrusFields(fields)).Error(msg)
 	} else {
@@ -66,35 +101,117 @@ func Error(msg string, fields Fields) {
 	}
 }
 
-// SetupLogger はAgentのログフォーマットを定義するファンクション
-func SetupLogger(logfile string, debugMode bool, errorsChannel chan string) error {
-	f, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// SetupLogger はAgentのログフォーマットと出力先を定義するファンクション
+// 出力先ごとにログレベルを指定でき、指定しない出力先のログレベルはDebugModeによる、infoかdebugか
+// 再度呼び出した場合は出力先を入れ替える
+func SetupLogger(config LogConfig, debugMode bool, errorsChannel chan string) error {
+	formatter, err := newFormatter(config.Format)
 	if err != nil {
-		fmt.Printf("Error opening file: %v\n", err)
 		return err
 	}
-	defer f.Close()
+	baseLevel := LevelInfo
+	if debugMode {
+		baseLevel = LevelDebug
+	}
+	defaultLevel, _ := logrus.ParseLevel(baseLevel)
+
+	var hooks []*sinkHook
+	var filePath string
+	for _, sink := range config.Sinks {
+		level, fixed, err := parseSinkLevel(sink, defaultLevel)
+		if err != nil {
+			return err
+		}
+		writer, err := newSinkWriter(sink)
+		if err != nil {
+			fmt.Printf("Error opening log sink %s: %v\n", sink.Type, err)
+			return err
+		}
+		if (sink.Type == "" || sink.Type == SinkFile) && len(filePath) == 0 {
+			filePath = sink.Path
+		}
+		hooks = append(hooks, &sinkHook{sinkType: sink.Type, level: level, fixed: fixed, formatter: formatter, writer: writer})
+	}
+	if len(hooks) == 0 {
+		return errors.New("At least one log sink is required.")
+	}
+
+	logFileMu.Lock()
+	logFilePath = filePath
+	logFileMu.Unlock()
 
-	//ログ出力設定をローテートlibraryのlumberjack構造体に定義
-	log.Out = &lumberjack.Logger{
-		Filename:   logfile,
-		MaxSize:    maxLogFileSizeInMB, // megabytes
-		MaxBackups: maxNumLogFiles,
-		LocalTime:  true,
+	sinks.Lock()
+	oldHooks := sinks.hooks
+	sinks.hooks = hooks
+	sinks.Unlock()
+
+	// 入れ替えた出力先を閉じる。ログファイルの場所を変更した場合に古いファイルを開いたままにしない
+	for _, hook := range oldHooks {
+		if err := hook.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not close the log sink %s: %v\n", hook.sinkType, err)
+		}
 	}
 
 	//Hook処理
+	setupOnce.Do(func() {
+		// 出力は各出力先のsinkHookが行うため、loggerのOutには何も書き込まない
+		log.Out = ioutil.Discard
+		log.Formatter = &discardFormatter{}
+		log.Hooks.Add(&sinkDispatcher{})
+		// ErrorレベルのログをerrorsChannelに送り、Serverにエラーとして送信させる
+		if errorsChannel != nil {
+			log.Hooks.Add(&errorsChannelHook{errorsChannel: errorsChannel})
+		}
+	})
+
+	// ログレベルは設定ファイルのDebugModeによる、infoかdebugか。実行中に変更したログレベルが有効な場合はそれを使う
+	setBaseLevel(baseLevel)
+	return nil
+}
 
-	// ログレベルは設定ファイルのDebugModeによる、infoかdebugか
-	if debugMode {
-		log.Level = logrus.DebugLevel
-	} else {
-		log.Level = logrus.InfoLevel
+// sinkDispatcher はSetupLoggerで設定した全ての出力先にログを書き込むlogrusのHook
+type sinkDispatcher struct{}
+
+// Levels は全てのログレベルでHookを呼び出すように指定するファンクション
+func (d *sinkDispatcher) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire は全ての出力先にログを書き込むファンクション。書き込めない出力先があっても他の出力先には書き込む
+// エラーを返却すると後に追加したHookが呼び出されないため、書き込めなかったことは標準エラー出力に出力する
+func (d *sinkDispatcher) Fire(entry *logrus.Entry) error {
+	sinks.RLock()
+	hooks := sinks.hooks
+	sinks.RUnlock()
+
+	for _, hook := range hooks {
+		if err := hook.Fire(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write the log to %s: %v\n", hook.sinkType, err)
+		}
 	}
+	return nil
+}
+
+// errorsChannelHook はErrorレベル以上のログのメッセージをエラーのチャネルに送るlogrusのHook
+type errorsChannelHook struct {
+	errorsChannel chan string
+}
 
-	log.Formatter = &logrus.TextFormatter{
-		DisableColors: true,
-		FullTimestamp: true,
+// Levels はErrorレベル以上のログでHookを呼び出すように指定するファンクション
+func (h *errorsChannelHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+// Fire はログのメッセージとerrorフィールドをチャネルに送るファンクション
+// ログの出力を止めないように、チャネルが一杯の場合は送らない
+func (h *errorsChannelHook) Fire(entry *logrus.Entry) error {
+	message := entry.Message
+	if err, ok := entry.Data["error"]; ok {
+		message = fmt.Sprintf("%s Error: %v", message, err)
+	}
+	select {
+	case h.errorsChannel <- message:
+	default:
 	}
 	return nil
 }
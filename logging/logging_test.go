@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// TestErrorsChannelHook はErrorレベルのログをエラーのチャネルに送り、チャネルが一杯でもブロックしないことを確認するテスト
+func TestErrorsChannelHook(t *testing.T) {
+	errorsChannel := make(chan string, 1)
+	hook := &errorsChannelHook{errorsChannel: errorsChannel}
+	for _, level := range hook.Levels() {
+		if level > logrus.ErrorLevel {
+			t.Errorf("hook should not receive %v logs", level)
+		}
+	}
+
+	hook.Fire(&logrus.Entry{Logger: log, Level: logrus.ErrorLevel, Message: "Could not send.", Data: logrus.Fields{"error": errors.New("timeout")}})
+	hook.Fire(&logrus.Entry{Logger: log, Level: logrus.ErrorLevel, Message: "dropped", Data: logrus.Fields{}})
+
+	if message := <-errorsChannel; message != "Could not send. Error: timeout" {
+		t.Errorf("message = %q", message)
+	}
+	if len(errorsChannel) != 0 {
+		t.Error("hook should drop the message when the channel is full")
+	}
+}
@@ -0,0 +1,265 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ログ送信の定数
+const (
+	// maxBufferedLogEntries は送信待ちのログの上限。超えた場合は古いログから破棄する
+	maxBufferedLogEntries = 5000
+	logBatchSize          = 500
+	logShipIntervalSecs   = 30
+	// shipFailureReportIntervalSecs は送信の失敗を標準エラー出力に書き込む間隔
+	shipFailureReportIntervalSecs = 300
+)
+
+// LogEntry はServerに送信する1件のログの構造体
+type LogEntry struct {
+	Time    int64 // ミリ秒
+	Level   string
+	Message string
+	Fields  map[string]string
+}
+
+// LogBatch はServerにまとめて送信するログの構造体
+// Droppedは前回の送信以降に送信待ちが一杯で破棄したログの件数
+type LogBatch struct {
+	Entries []LogEntry
+	Dropped int64
+}
+
+// LogSender はgzip圧縮したLogBatchのJSONをServerに送信するファンクションの型
+type LogSender func(gzipped []byte) error
+
+// LogFileSender はgzip圧縮したログファイルをServerに送信するファンクションの型
+type LogFileSender func(name string, gzipped []byte) error
+
+// ServerHook はログを送信待ちに溜めて、まとめてServerに送信するlogrusのHook
+// ログの出力を止めないようにFireはブロックせず、送信はRunのgo routineで行う
+type ServerHook struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	dropped int64
+	send    LogSender
+	notify  chan struct{}
+	// failures は最後に送信に成功してから連続して送信に失敗した回数
+	failures int64
+	// lastFailureReport は最後に送信の失敗を書き込んだ時刻
+	lastFailureReport time.Time
+	// errorOutput は送信の失敗を書き込む出力先。ログに書き込むと送信待ちに戻ってしまうため、ロガーとは別に書き込む
+	errorOutput io.Writer
+}
+
+// NewServerHook はsendでログを送信するServerHookを生成するファンクション
+func NewServerHook(send LogSender) *ServerHook {
+	return &ServerHook{
+		send:        send,
+		notify:      make(chan struct{}, 1),
+		errorOutput: os.Stderr,
+	}
+}
+
+// Levels は全てのログレベルでHookを呼び出すように指定するファンクション
+func (h *ServerHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire はログを送信待ちに追加するファンクション
+// SQSの通信内容などのTraceのログは認証情報を含むことがあるため、Serverには送信しない
+func (h *ServerHook) Fire(entry *logrus.Entry) error {
+	if _, ok := entry.Data[traceField]; ok {
+		return nil
+	}
+	fields := map[string]string{}
+	for k, v := range entry.Data {
+		if err, ok := v.(error); ok {
+			fields[k] = err.Error()
+		} else {
+			fields[k] = fmt.Sprint(v)
+		}
+	}
+	logEntry := LogEntry{
+		Time:    entry.Time.UnixNano() / int64(time.Millisecond),
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+		Fields:  fields,
+	}
+
+	h.mu.Lock()
+	h.entries = append(h.entries, logEntry)
+	h.trim()
+	full := len(h.entries) >= logBatchSize
+	h.mu.Unlock()
+
+	if full {
+		select {
+		case h.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// trim は送信待ちの上限を超えたログを古いものから破棄するファンクション
+func (h *ServerHook) trim() {
+	if overflow := len(h.entries) - maxBufferedLogEntries; overflow > 0 {
+		h.entries = append([]LogEntry{}, h.entries[overflow:]...)
+		h.dropped += int64(overflow)
+	}
+}
+
+// Flush は送信待ちのログをlogBatchSize件ずつServerに送信するファンクション
+// 送信に失敗した場合はログを送信待ちに戻してエラーを返却する
+func (h *ServerHook) Flush() error {
+	for {
+		h.mu.Lock()
+		if len(h.entries) == 0 && h.dropped == 0 {
+			h.mu.Unlock()
+			return nil
+		}
+		n := len(h.entries)
+		if n > logBatchSize {
+			n = logBatchSize
+		}
+		batch := LogBatch{Entries: append([]LogEntry{}, h.entries[:n]...), Dropped: h.dropped}
+		h.entries = h.entries[n:]
+		h.dropped = 0
+		h.mu.Unlock()
+
+		gzipped, err := gzipJSON(&batch)
+		if err == nil {
+			err = h.send(gzipped)
+		}
+		if err != nil {
+			h.mu.Lock()
+			h.entries = append(batch.Entries, h.entries...)
+			h.dropped += batch.Dropped
+			h.trim()
+			h.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// Run はlogShipIntervalSecsごと、または送信待ちがlogBatchSize件に達した時にログを送信するファンクション
+// 送信に失敗したログは次の送信で再送する
+func (h *ServerHook) Run() {
+	ticker := time.NewTicker(time.Second * logShipIntervalSecs)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.notify:
+		}
+		h.ship()
+	}
+}
+
+// ship はログを送信し、送信の失敗を数えるファンクション
+// Serverが停止している間に送信間隔ごとに出力しないように、失敗は最初の1回とshipFailureReportIntervalSecsごとに標準エラー出力に書き込む
+func (h *ServerHook) ship() {
+	err := h.Flush()
+	if err == nil {
+		if h.failures > 0 {
+			fmt.Fprintf(h.errorOutput, "Sent logs to server after %d failed attempts.\n", h.failures)
+			h.failures = 0
+		}
+		return
+	}
+
+	h.failures++
+	now := time.Now()
+	if h.failures == 1 || now.Sub(h.lastFailureReport) >= time.Second*shipFailureReportIntervalSecs {
+		fmt.Fprintf(h.errorOutput, "Could not send logs to server (%d failed attempts). Error: %v\n", h.failures, err)
+		h.lastFailureReport = now
+	}
+}
+
+// AddHook はloggerにHookを追加するファンクション
+func AddHook(hook logrus.Hook) {
+	log.Hooks.Add(hook)
+}
+
+// gzipJSON はvをJSONにしてgzip圧縮するファンクション
+func gzipJSON(v interface{}) ([]byte, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return gzipBytes(content)
+}
+
+// gzipBytes はcontentをgzip圧縮するファンクション
+func gzipBytes(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// logFiles はローテートされたログファイルと現在のログファイルを古い順に返却するファンクション
+// lumberjackはローテートしたファイルを"<名前>-<タイムスタンプ><拡張子>"で保存する
+func logFiles(logfile string) ([]string, error) {
+	ext := filepath.Ext(logfile)
+	prefix := strings.TrimSuffix(logfile, ext)
+	backups, err := filepath.Glob(prefix + "-*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups)
+	return append(backups, logfile), nil
+}
+
+// UploadFullLogs はローテートされたログファイルも含めて全てのログファイルをsendで送信するファンクション
+// 圧縮されていないファイルはgzip圧縮してから送信する
+func UploadFullLogs(send LogFileSender) error {
+	logFileMu.Lock()
+	logfile := logFilePath
+	logFileMu.Unlock()
+	if len(logfile) == 0 {
+		return errors.New("The log file is not configured.")
+	}
+
+	files, err := logFiles(logfile)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(file)
+		if !strings.HasSuffix(name, ".gz") {
+			if content, err = gzipBytes(content); err != nil {
+				return err
+			}
+			name += ".gz"
+		}
+		if err := send(name, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
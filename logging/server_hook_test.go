@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// TestServerHookRateLimitsShipFailures は送信の失敗を数え、標準エラー出力への書き込みを間引くことを確認するテスト
+func TestServerHookRateLimitsShipFailures(t *testing.T) {
+	var sendErr error = errors.New("server is down")
+	hook := NewServerHook(func(gzipped []byte) error { return sendErr })
+	var output bytes.Buffer
+	hook.errorOutput = &output
+	hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "message", Data: logrus.Fields{}})
+
+	for i := 0; i < 3; i++ {
+		hook.ship()
+	}
+	if hook.failures != 3 {
+		t.Errorf("failures = %d, want 3", hook.failures)
+	}
+	if lines := strings.Count(output.String(), "\n"); lines != 1 {
+		t.Fatalf("wrote %d lines, want 1:\n%s", lines, output.String())
+	}
+
+	hook.lastFailureReport = time.Now().Add(-time.Second * shipFailureReportIntervalSecs)
+	hook.ship()
+	if !strings.Contains(output.String(), "(4 failed attempts)") {
+		t.Errorf("failure should be reported again after the interval:\n%s", output.String())
+	}
+
+	sendErr = nil
+	hook.ship()
+	if hook.failures != 0 || !strings.Contains(output.String(), "after 4 failed attempts") {
+		t.Errorf("failures = %d, output:\n%s", hook.failures, output.String())
+	}
+	if len(hook.entries) != 0 {
+		t.Errorf("%d entries left after a successful send", len(hook.entries))
+	}
+}
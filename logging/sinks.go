@@ -0,0 +1,189 @@
+package logging
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ログフォーマット
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// ログの出力先の種類
+const (
+	SinkFile     = "file"
+	SinkStderr   = "stderr"
+	SinkSyslog   = "syslog"
+	SinkJournald = "journald"
+)
+
+// ログの識別子。syslogのタグとjournaldのSYSLOG_IDENTIFIERに使う
+const logIdentifier = "agent"
+
+// SinkConfig はログの出力先の設定の構造体
+type SinkConfig struct {
+	Type string // "file"(デフォルト)、"stderr"、"syslog"、"journald"
+	// Level はこの出力先に出力するログレベル("debug"、"info"、"warn"、"error")。空の場合はDebugModeによる
+	Level string
+	// Path は"file"の場合はログファイル、"syslog"と"journald"の場合はUNIXドメインソケットのパス。空の場合はデフォルト
+	Path       string
+	MaxSizeMB  int // "file"のローテートするサイズ(MB)。0の場合はデフォルト
+	MaxBackups int // "file"のローテートしたファイルを残す数。0の場合はデフォルト
+}
+
+// LogConfig はログのフォーマットと出力先の設定の構造体
+type LogConfig struct {
+	Format string // "text"(デフォルト)、"json"、"logfmt"
+	Sinks  []SinkConfig
+}
+
+// sinkWriter はフォーマット済みのログを出力先に書き込むインターフェース
+type sinkWriter interface {
+	writeEntry(entry *logrus.Entry, formatted []byte) error
+	close() error
+}
+
+// streamSink はファイルや標準エラー出力にログを書き込むsinkWriter
+type streamSink struct {
+	w      io.Writer
+	closer io.Closer // 出力先を入れ替えたときに閉じるファイル。標準エラー出力の場合はnil
+}
+
+func (s *streamSink) writeEntry(entry *logrus.Entry, formatted []byte) error {
+	_, err := s.w.Write(formatted)
+	return err
+}
+
+func (s *streamSink) close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// sinkHook は1つの出力先にログレベル以上のログを書き込むlogrusのHook
+// ログレベルを後から変更できるように全てのレベルで呼び出し、Fireでレベルを判定する
+type sinkHook struct {
+	mu        sync.Mutex
+	sinkType  string
+	level     logrus.Level
+	fixed     bool // SinkConfigでログレベルを指定した場合はtrue
+	closed    bool // 出力先を入れ替えて閉じた場合はtrue
+	formatter logrus.Formatter
+	writer    sinkWriter
+}
+
+// Levels は全てのログレベルでHookを呼び出すように指定するファンクション
+func (h *sinkHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire はログレベル以上のログをフォーマットして出力先に書き込むファンクション
+// ログレベルの変更を記録するログはログレベルに関係なく書き込む
+func (h *sinkHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	if _, levelChange := entry.Data[levelChangeField]; entry.Level > h.level && !levelChange {
+		return nil
+	}
+	formatted, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	return h.writer.writeEntry(entry, formatted)
+}
+
+// close は書き込み中のログを待って出力先を閉じるファンクション
+func (h *sinkHook) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	return h.writer.close()
+}
+
+// discardFormatter はloggerのOutに何も書き込まないようにするFormatter。出力は各sinkHookが行う
+type discardFormatter struct{}
+
+func (f *discardFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// newFormatter はログフォーマット名からFormatterを生成するファンクション
+func newFormatter(format string) (logrus.Formatter, error) {
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		return &logrus.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		}, nil
+	case FormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	case FormatLogfmt:
+		return &logfmtFormatter{}, nil
+	}
+	return nil, errors.New("Unknown log format: " + format)
+}
+
+// newSinkWriter は出力先の設定からsinkWriterを生成するファンクション
+func newSinkWriter(sink SinkConfig) (sinkWriter, error) {
+	switch sink.Type {
+	case "", SinkFile:
+		if len(sink.Path) == 0 {
+			return nil, errors.New("Log file path is required.")
+		}
+		f, err := os.OpenFile(sink.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+
+		maxSize := sink.MaxSizeMB
+		if maxSize <= 0 {
+			maxSize = defaultMaxLogFileSizeInMB
+		}
+		maxBackups := sink.MaxBackups
+		if maxBackups <= 0 {
+			maxBackups = defaultMaxNumLogFiles
+		}
+		//ログ出力設定をローテートlibraryのlumberjack構造体に定義
+		logger := &lumberjack.Logger{
+			Filename:   sink.Path,
+			MaxSize:    maxSize, // megabytes
+			MaxBackups: maxBackups,
+			LocalTime:  true,
+		}
+		return &streamSink{w: logger, closer: logger}, nil
+	case SinkStderr:
+		return &streamSink{w: os.Stderr}, nil
+	case SinkSyslog:
+		return newSyslogSink(sink.Path)
+	case SinkJournald:
+		return newJournaldSink(sink.Path)
+	}
+	return nil, errors.New("Unknown log sink: " + sink.Type)
+}
+
+// parseSinkLevel は出力先のログレベルを求めるファンクション。指定されていない場合はdefaultLevelを使う
+func parseSinkLevel(sink SinkConfig, defaultLevel logrus.Level) (logrus.Level, bool, error) {
+	if len(sink.Level) == 0 {
+		return defaultLevel, false, nil
+	}
+	if strings.ToLower(sink.Level) == LevelTrace {
+		return logrus.DebugLevel, true, nil
+	}
+	level, err := logrus.ParseLevel(sink.Level)
+	return level, true, err
+}
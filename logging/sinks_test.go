@@ -0,0 +1,159 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// newTestEntry はフォーマットを確認するためのログを生成するファンクション
+func newTestEntry() *logrus.Entry {
+	return &logrus.Entry{
+		Logger:  log,
+		Time:    time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC),
+		Level:   logrus.WarnLevel,
+		Message: "Could not send.",
+		Data:    logrus.Fields{"error": errors.New("timeout"), "eventID": "1", "path": "/tmp/a b"},
+	}
+}
+
+func TestFormatters(t *testing.T) {
+	formatter, err := newFormatter(FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatted, err := formatter.Format(newTestEntry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal(formatted, &decoded); err != nil {
+		t.Fatalf("json format is not JSON: %s", formatted)
+	}
+	if decoded["msg"] != "Could not send." || decoded["level"] != "warning" || decoded["error"] != "timeout" || decoded["eventID"] != "1" {
+		t.Errorf("json = %v", decoded)
+	}
+
+	formatter, err = newFormatter(FormatLogfmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatted, _ = formatter.Format(newTestEntry())
+	want := `ts=2016-07-01T12:00:00Z level=warning msg="Could not send." error=timeout eventID=1 path="/tmp/a b"` + "\n"
+	if string(formatted) != want {
+		t.Errorf("logfmt = %q, want %q", formatted, want)
+	}
+
+	for _, format := range []string{"", FormatText, "JSON"} {
+		if _, err := newFormatter(format); err != nil {
+			t.Errorf("%q: %v", format, err)
+		}
+	}
+	if _, err := newFormatter("xml"); err == nil {
+		t.Error("unknown format should be rejected")
+	}
+}
+
+func TestParseSinkLevel(t *testing.T) {
+	tests := []struct {
+		level string
+		want  logrus.Level
+		fixed bool
+		fails bool
+	}{
+		{"", logrus.InfoLevel, false, false},
+		{"warn", logrus.WarnLevel, true, false},
+		{"ERROR", logrus.ErrorLevel, true, false},
+		{LevelTrace, logrus.DebugLevel, true, false},
+		{"verbose", 0, false, true},
+	}
+	for _, test := range tests {
+		level, fixed, err := parseSinkLevel(SinkConfig{Level: test.level}, logrus.InfoLevel)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: should fail", test.level)
+			}
+			continue
+		}
+		if err != nil || level != test.want || fixed != test.fixed {
+			t.Errorf("%q: level = %v, fixed = %v, err = %v", test.level, level, fixed, err)
+		}
+	}
+}
+
+func TestFileSinkRotationSettings(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := newSinkWriter(SinkConfig{Path: filepath.Join(dir, "agent.log"), MaxSizeMB: 5, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.close()
+	logger := writer.(*streamSink).w.(*lumberjack.Logger)
+	if logger.MaxSize != 5 || logger.MaxBackups != 2 {
+		t.Errorf("MaxSize = %d, MaxBackups = %d", logger.MaxSize, logger.MaxBackups)
+	}
+
+	defaults, err := newSinkWriter(SinkConfig{Type: SinkFile, Path: filepath.Join(dir, "default.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer defaults.close()
+	logger = defaults.(*streamSink).w.(*lumberjack.Logger)
+	if logger.MaxSize != defaultMaxLogFileSizeInMB || logger.MaxBackups != defaultMaxNumLogFiles {
+		t.Errorf("MaxSize = %d, MaxBackups = %d, want the defaults", logger.MaxSize, logger.MaxBackups)
+	}
+
+	if _, err := newSinkWriter(SinkConfig{Type: SinkFile}); err == nil {
+		t.Error("file sink without a path should be rejected")
+	}
+	if _, err := newSinkWriter(SinkConfig{Type: "kafka"}); err == nil {
+		t.Error("unknown sink should be rejected")
+	}
+}
+
+// TestSetupLoggerPerSinkLevels は出力先ごとに指定したログレベルとフォーマットで書き込むことを確認するテスト
+func TestSetupLoggerPerSinkLevels(t *testing.T) {
+	dir := t.TempDir()
+	allPath := filepath.Join(dir, "all.log")
+	errorPath := filepath.Join(dir, "error.log")
+	config := LogConfig{Format: FormatLogfmt, Sinks: []SinkConfig{{Path: allPath}, {Path: errorPath, Level: LevelError}}}
+	if err := SetupLogger(config, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		sinks.Lock()
+		hooks := sinks.hooks
+		sinks.hooks = nil
+		sinks.Unlock()
+		for _, hook := range hooks {
+			hook.close()
+		}
+		setBaseLevel(LevelInfo)
+	}()
+
+	Debug("debug message", nil)
+	Error("error message", nil)
+
+	all, err := ioutil.ReadFile(allPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorsOnly, err := ioutil.ReadFile(errorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(all), `level=debug msg="debug message"`) || !strings.Contains(string(all), "error message") {
+		t.Errorf("debug mode sink should have both logs:\n%s", all)
+	}
+	if strings.Contains(string(errorsOnly), "debug message") || !strings.Contains(string(errorsOnly), `level=error msg="error message"`) {
+		t.Errorf("error sink should have only the error log:\n%s", errorsOnly)
+	}
+}
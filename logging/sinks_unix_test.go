@@ -0,0 +1,83 @@
+//go:build !windows
+// +build !windows
+
+package logging
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// listenDatagram はテスト用のUNIXドメインソケット(datagram)を作成するファンクション
+func listenDatagram(t *testing.T) (string, *net.UnixConn) {
+	// UNIXドメインソケットのパスの長さの上限を超えないように短いディレクトリを使う
+	dir, err := os.MkdirTemp("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return path, conn
+}
+
+// readDatagram はソケットに届いたメッセージを1つ読み込むファンクション
+func readDatagram(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSyslogSink(t *testing.T) {
+	path, conn := listenDatagram(t)
+	sink, err := newSyslogSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.close()
+
+	entry := newTestEntry()
+	if err := sink.writeEntry(entry, []byte("formatted message\n")); err != nil {
+		t.Fatal(err)
+	}
+	message := readDatagram(t, conn)
+	// daemon(3) * 8 + warning(4)
+	want := "<28>" + entry.Time.Format("Jan _2 15:04:05") + " " + logIdentifier + "[" + strconv.Itoa(os.Getpid()) + "]: formatted message"
+	if message != want {
+		t.Errorf("message = %q, want %q", message, want)
+	}
+}
+
+func TestJournaldSink(t *testing.T) {
+	path, conn := listenDatagram(t)
+	sink, err := newJournaldSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.close()
+
+	entry := newTestEntry()
+	entry.Data["_private"] = "x"
+	entry.Data["multi"] = "a\nb"
+	if err := sink.writeEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+	message := readDatagram(t, conn)
+	for _, field := range []string{"MESSAGE=Could not send.\n", "PRIORITY=4\n", "SYSLOG_IDENTIFIER=" + logIdentifier + "\n",
+		"ERROR=timeout\n", "EVENTID=1\n", "PRIVATE=x\n", "MULTI\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"} {
+		if !strings.Contains(message, field) {
+			t.Errorf("journal message does not have %q:\n%q", field, message)
+		}
+	}
+}
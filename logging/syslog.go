@@ -0,0 +1,118 @@
+package logging
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// syslogの定数
+const (
+	defaultSyslogSocket  = "/dev/log"
+	syslogFacilityDaemon = 3
+)
+
+// syslogSeverity はログレベルに対応するsyslogとjournaldの重要度を返却するファンクション
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0 // emerg
+	case logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// datagramSocket はUNIXドメインソケット(datagram)に書き込み、書き込めない場合は1回だけ接続し直す
+type datagramSocket struct {
+	path string
+	conn net.Conn
+}
+
+// dialDatagramSocket はUNIXドメインソケットに接続するファンクション
+func dialDatagramSocket(path string) (*datagramSocket, error) {
+	s := &datagramSocket{path: path}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *datagramSocket) connect() error {
+	conn, err := net.Dial("unixgram", s.path)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// write はメッセージを書き込むファンクション。syslogデーモンの再起動などで書き込めない場合は接続し直す
+func (s *datagramSocket) write(message []byte) error {
+	if s.conn != nil {
+		if _, err := s.conn.Write(message); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(message)
+	return err
+}
+
+// close は接続を閉じるファンクション
+func (s *datagramSocket) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// syslogSink はローカルのsyslogデーモンにRFC3164形式でログを送るsinkWriter
+type syslogSink struct {
+	socket *datagramSocket
+	pid    string
+}
+
+// newSyslogSink はsyslogのソケットに接続するファンクション。pathが空の場合は/dev/logを使う
+func newSyslogSink(path string) (*syslogSink, error) {
+	if len(path) == 0 {
+		path = defaultSyslogSocket
+	}
+	socket, err := dialDatagramSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{socket: socket, pid: strconv.Itoa(os.Getpid())}, nil
+}
+
+func (s *syslogSink) close() error {
+	return s.socket.close()
+}
+
+// writeEntry は"<PRI>TIMESTAMP TAG[PID]: MSG"の形式でログを送るファンクション
+func (s *syslogSink) writeEntry(entry *logrus.Entry, formatted []byte) error {
+	var b bytes.Buffer
+	b.WriteByte('<')
+	b.WriteString(strconv.Itoa(syslogFacilityDaemon*8 + syslogSeverity(entry.Level)))
+	b.WriteByte('>')
+	b.WriteString(entry.Time.Format(time.Stamp))
+	b.WriteString(" " + logIdentifier + "[" + s.pid + "]: ")
+	b.Write(bytes.TrimRight(formatted, "\n"))
+	return s.socket.write(b.Bytes())
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/tsubauaaa/agent/logging"
+	"gopkg.in/jmcvetta/napping.v3"
+)
+
+// ログ送信の定数
+const (
+	logsRequestTypePath     = "logs"
+	fullLogsRequestTypePath = "full"
+)
+
+// fullLogsRequests はServerから全てのログファイルの送信を指示されたことをUpdateLogsに通知するチャネル
+var fullLogsRequests = make(chan struct{}, 1)
+
+// requestFullLogs は全てのログファイルの送信を要求するファンクション。既に要求されている場合は何もしない
+func requestFullLogs() {
+	select {
+	case fullLogsRequests <- struct{}{}:
+	default:
+	}
+}
+
+// postGzipped はServerにgzip圧縮したJSONをHTTP POSTするファンクション
+func postGzipped(server ServerConfig, url string, gzipped []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Encoding", "gzip")
+	request := napping.Request{
+		Url:        url,
+		Method:     "POST",
+		Payload:    bytes.NewBuffer(gzipped),
+		RawPayload: true,
+		Header:     &header,
+	}
+	resp, err := newServerSession(server).Send(&request)
+	if err != nil {
+		return err
+	}
+	if 200 <= resp.Status() && resp.Status() <= 299 {
+		return nil
+	}
+	return errors.New("Server returned unexpected status: " + strconv.Itoa(resp.Status()))
+}
+
+// UpdateLogs はAgentのログをServerに送信するファンクション
+// logrusのHookでログを溜めてまとめて送信し、Serverから指示された場合はローテートされたログファイルも含めて全て送信する
+func UpdateLogs(regManager *RegistrationManager, configObj *ServerConfig) {
+	hook := logging.NewServerHook(func(gzipped []byte) error {
+		server := configObj.get()
+		url := joinURL(server.EndPoint, logsRequestTypePath, regManager.Get().AgentID)
+		return postGzipped(server, url, gzipped)
+	})
+	logging.AddHook(hook)
+	go hook.Run()
+
+	for range fullLogsRequests {
+		logging.Info("Uploading the full logs.", nil)
+		err := logging.UploadFullLogs(func(name string, gzipped []byte) error {
+			server := configObj.get()
+			url := joinURL(server.EndPoint, logsRequestTypePath, regManager.Get().AgentID, fullLogsRequestTypePath, name)
+			return postGzipped(server, url, gzipped)
+		})
+		if err != nil {
+			logging.Warn("Could not upload the full logs.", logging.Fields{"error": err})
+			continue
+		}
+		logging.Info("Successfully uploaded the full logs.", nil)
+	}
+}
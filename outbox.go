@@ -0,0 +1,364 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// Action実行結果の送信待ちファイルの定数
+const (
+	outboxFileName = "outbox.log"
+	// maxOutboxBytes は送信待ちファイルのサイズの上限。超える場合は古い実行結果から破棄する
+	maxOutboxBytes          = 64 * 1024 * 1024
+	outboxRetryDelaySecs    = 5
+	maxOutboxRetryDelaySecs = 300
+	// outboxDeadLetterFileName はServerが受け付けない実行結果を移すファイル名
+	outboxDeadLetterFileName = "outbox.dead"
+	// maxOutboxFailures はServerが他の実行結果を受け付けている間に、同じ実行結果の送信が失敗できる回数
+	maxOutboxFailures = 10
+)
+
+// outboxRecord は送信待ちファイルの1行の構造体
+// 実行結果を追加した時はResultを、Serverが受け付けた時はAckをtrueにしたレコードを追記する
+type outboxRecord struct {
+	Seq    int64
+	Ack    bool          `json:",omitempty"`
+	Result *ActionResult `json:",omitempty"`
+	// failures はServerが他の実行結果を受け付けたのにこの実行結果の送信が失敗した回数。Runだけが参照する
+	failures int
+}
+
+// Outbox はServerに送信するAction実行結果をディスクに保存する送信待ちファイル
+// ファイルは追記のみで書き込むたびにfsyncするため、Serverが停止している間にAgentが再起動しても実行結果は失われない
+// Serverに受け付けられるまで送信を繰り返すため、同じ実行結果が複数回送信されることがある
+type Outbox struct {
+	mu             sync.Mutex
+	path           string
+	deadLetterPath string
+	file           *os.File
+	size           int64
+	nextSeq        int64
+	pending        []*outboxRecord
+	notify         chan struct{}
+}
+
+// OpenOutbox はstateDirの送信待ちファイルを開き、Serverが受け付けていない実行結果を読み込むファンクション
+func OpenOutbox(stateDir string) (*Outbox, error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		path:           filepath.Join(stateDir, outboxFileName),
+		deadLetterPath: filepath.Join(stateDir, outboxDeadLetterFileName),
+		nextSeq:        1,
+		notify:         make(chan struct{}, 1),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	// 受け付け済みの記録と書き込み途中で終了した行を取り除く
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+	if len(o.pending) > 0 {
+		logging.Info("Loaded unsent action results from the outbox.", logging.Fields{"path": o.path, "count": len(o.pending)})
+	}
+	return o, nil
+}
+
+// load は送信待ちファイルを読み込んで送信待ちの実行結果を求めるファンクション
+// パースできない行は書き込み途中で終了したものとして無視する
+func (o *Outbox) load() error {
+	file, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	records := map[int64]*outboxRecord{}
+	var order []int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && err == nil {
+			var record outboxRecord
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				logging.Warn("Skipping a broken record in the outbox.", logging.Fields{"path": o.path, "error": jsonErr})
+			} else if record.Ack {
+				delete(records, record.Seq)
+			} else if record.Result != nil {
+				records[record.Seq] = &record
+				order = append(order, record.Seq)
+			}
+			if record.Seq >= o.nextSeq {
+				o.nextSeq = record.Seq + 1
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	for _, seq := range order {
+		if record, ok := records[seq]; ok {
+			o.pending = append(o.pending, record)
+		}
+	}
+	return nil
+}
+
+// compact は送信待ちの実行結果だけを書き込んだファイルで送信待ちファイルを置き換えるファンクション
+func (o *Outbox) compact() error {
+	tmpPath := o.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, record := range o.pending {
+		line, err := json.Marshal(record)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		n, err := tmp.Write(append(line, '\n'))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		size += int64(n)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return err
+	}
+
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file, err = os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		o.file = nil
+		return err
+	}
+	o.size = size
+	return nil
+}
+
+// write はレコードを送信待ちファイルに追記してfsyncするファンクション
+func (o *Outbox) write(line []byte) error {
+	if o.file == nil {
+		return errors.New("The outbox is not open.")
+	}
+	n, err := o.file.Write(line)
+	o.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+// Append は実行結果を送信待ちファイルに追記するファンクション
+// ファイルサイズが上限を超える場合は受け付け済みの記録を取り除き、それでも超える場合は古い実行結果から破棄する
+func (o *Outbox) Append(result *ActionResult) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	record := &outboxRecord{Seq: o.nextSeq, Result: result}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if int64(len(line)) > maxOutboxBytes {
+		return errors.New("The action result is too large for the outbox.")
+	}
+
+	if o.size+int64(len(line)) > maxOutboxBytes {
+		if err := o.compact(); err != nil {
+			return err
+		}
+		for o.size+int64(len(line)) > maxOutboxBytes && len(o.pending) > 0 {
+			logging.Error("The outbox is full. Dropping the oldest action result.", logging.Fields{"eventID": o.pending[0].Result.EventID})
+			// 破棄した実行結果のメッセージは削除せずに、可視時間が切れた後に再度受信させる
+			releaseEvent(o.pending[0].Result.event, false)
+			o.pending = o.pending[1:]
+			if err := o.compact(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := o.write(line); err != nil {
+		return err
+	}
+	o.nextSeq++
+	o.pending = append(o.pending, record)
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// oldest は最も古い送信待ちの実行結果を返却するファンクション
+func (o *Outbox) oldest() (*outboxRecord, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		return nil, false
+	}
+	return o.pending[0], true
+}
+
+// snapshot は送信待ちの実行結果を古い順に返却するファンクション
+func (o *Outbox) snapshot() []*outboxRecord {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*outboxRecord{}, o.pending...)
+}
+
+// deadLetter はServerが受け付けない実行結果をデッドレターファイルに追記して、送信待ちから取り除くファンクション
+// デッドレターファイルのサイズもmaxOutboxBytesを上限とし、超える場合は実行結果を破棄する
+func (o *Outbox) deadLetter(record *outboxRecord, cause error) {
+	logging.Error("The server does not accept the action result. Moving it to the dead letter file.", logging.Fields{
+		"eventID": record.Result.EventID,
+		"path":    o.deadLetterPath,
+		"error":   cause,
+	})
+	if err := appendDeadLetter(o.deadLetterPath, record.Result); err != nil {
+		logging.Error("Could not write the action result to the dead letter file. Dropping it.", logging.Fields{"eventID": record.Result.EventID, "error": err})
+	}
+	o.ack(record.Seq)
+	// 再度受信して同じ実行結果を送信し続けないように、メッセージは削除する
+	releaseEvent(record.Result.event, true)
+}
+
+// appendDeadLetter は実行結果をデッドレターファイルに1行のJSONとして追記するファンクション
+func appendDeadLetter(path string, result *ActionResult) error {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size()+int64(len(line)) > maxOutboxBytes {
+		return errors.New("The dead letter file is full.")
+	}
+	if _, err := file.Write(line); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// ack はServerが実行結果を受け付けたことを送信待ちファイルに記録するファンクション
+// 送信待ちの実行結果がなくなった場合はファイルを空にする
+func (o *Outbox) ack(seq int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, record := range o.pending {
+		if record.Seq == seq {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			break
+		}
+	}
+
+	var err error
+	if len(o.pending) == 0 {
+		err = o.compact()
+	} else {
+		var line []byte
+		if line, err = json.Marshal(&outboxRecord{Seq: seq, Ack: true}); err == nil {
+			err = o.write(append(line, '\n'))
+		}
+	}
+	if err != nil {
+		// 記録できなかった場合は再起動後に同じ実行結果がもう一度送信される
+		logging.Error("Could not record the acknowledgement in the outbox.", logging.Fields{"path": o.path, "seq": seq, "error": err})
+	}
+}
+
+// sendPending は送信待ちの実行結果を古い順に1回ずつServerに送信するファンクション
+// 送信に失敗した実行結果があっても後続の実行結果の送信は続け、Serverが1件でも受け付けたかと失敗した件数を返却する
+// Serverが拒否した(4xx)実行結果と、他の実行結果を受け付けている間にmaxOutboxFailures回失敗した実行結果は
+// デッドレターファイルに移して、メッセージを削除する
+func (o *Outbox) sendPending(configObj *ServerConfig) (bool, int) {
+	accepted := false
+	var failed []*outboxRecord
+	for _, record := range o.snapshot() {
+		err := SendActionOutput(record.Result, configObj)
+		if err == nil {
+			accepted = true
+			o.ack(record.Seq)
+			// 再起動後に読み込んだ実行結果はメッセージを持たないため、releaseEventは何もしない
+			releaseEvent(record.Result.event, true)
+		} else if isPermanentSendError(err) {
+			o.deadLetter(record, err)
+		} else {
+			logging.Warn("Could not send the action output from the outbox.", logging.Fields{"eventID": record.Result.EventID, "error": err})
+			failed = append(failed, record)
+		}
+	}
+
+	// Serverが1件も受け付けない場合は停止中とみなし、失敗回数に数えない
+	if accepted {
+		for _, record := range failed {
+			if record.failures++; record.failures >= maxOutboxFailures {
+				o.deadLetter(record, errors.New("The action result failed repeatedly while other results were accepted."))
+			}
+		}
+	}
+	return accepted, len(failed)
+}
+
+// Run は送信待ちの実行結果をServerに送信し続けるファンクション
+// Serverが受け付けた後に実行結果のActionキューのメッセージを削除する。それまでは可視時間を延長し続けるため、
+// 送信前にAgentが停止した場合はメッセージが再度受信され、再起動後に送信待ちファイルから実行結果を送信する
+// 1件も受け付けられなかった場合は間隔を延ばしながらリトライする
+func (o *Outbox) Run(configObj *ServerConfig) {
+	delay := float64(outboxRetryDelaySecs)
+	for {
+		if _, ok := o.oldest(); !ok {
+			<-o.notify
+			continue
+		}
+
+		accepted, failed := o.sendPending(configObj)
+		if accepted || failed == 0 {
+			delay = outboxRetryDelaySecs
+			continue
+		}
+		logging.Warn("Could not send any action output from the outbox. Retrying..", logging.Fields{"count": failed, "delay": delay})
+		time.Sleep(time.Second * time.Duration(delay))
+		delay = math.Min(delay*2, maxOutboxRetryDelaySecs)
+	}
+}
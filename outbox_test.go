@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeActionQueue は削除されたメッセージを記録するActionQueue
+type fakeActionQueue struct {
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (q *fakeActionQueue) Receive() ([]*QueueMessage, error)                          { return nil, nil }
+func (q *fakeActionQueue) ChangeVisibility(receiptHandle string, timeout int64) error { return nil }
+
+func (q *fakeActionQueue) Delete(receiptHandle string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deleted = append(q.deleted, receiptHandle)
+	return nil
+}
+
+func (q *fakeActionQueue) deletedHandles() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string{}, q.deleted...)
+}
+
+// newTestActionServer はServerのスタンドインを起動し、受け付けた実行結果をreceivedに送るファンクション
+func newTestActionServer(t *testing.T, received chan<- ActionResult) *ServerConfig {
+	return newTestActionServerWithStatus(t, received, func(result ActionResult) int { return http.StatusOK })
+}
+
+// newTestActionServerWithStatus はstatusが返却したステータスで応答するServerのスタンドインを起動するファンクション
+// 2xxで応答した実行結果をreceivedに送る
+// SendActionOutputはhttpsで送信するため、テストの間はDefaultTransportをテスト用のサーバの証明書を信頼するものに入れ替える
+func newTestActionServerWithStatus(t *testing.T, received chan<- ActionResult, status func(ActionResult) int) *ServerConfig {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result ActionResult
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		code := status(result)
+		if 200 <= code && code <= 299 {
+			received <- result
+		}
+		w.WriteHeader(code)
+	}))
+	transport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+		server.Close()
+	})
+	return &ServerConfig{EndPoint: strings.TrimPrefix(server.URL, "https://")}
+}
+
+func TestOutboxKeepsMessageUntilServerAccepts(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := OpenOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := &fakeActionQueue{}
+	event := &Event{EventID: "event", ReceiptHandle: "receipt", queue: queue}
+	result := newActionResult(event)
+	result.Status = ActionStatusSucceeded
+	result.Stdout = "output"
+
+	results := make(chan *ActionResult, 1)
+	results <- result
+	close(results)
+	ReportActionResults(results, outbox, &ServerConfig{})
+	if deleted := queue.deletedHandles(); len(deleted) > 0 {
+		t.Fatalf("message was deleted before the server accepted the result: %v", deleted)
+	}
+
+	// 送信前にAgentが停止した場合も、再起動後に送信待ちファイルから同じ実行結果を送信できる
+	outbox.file.Close()
+	reopened, err := OpenOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, ok := reopened.oldest()
+	if !ok || record.Result.EventID != "event" || record.Result.Stdout != "output" {
+		t.Fatalf("reopened outbox lost the result: %+v", record)
+	}
+
+	received := make(chan ActionResult, 1)
+	configObj := newTestActionServer(t, received)
+	// 停止前のプロセスの送信待ちとして、メッセージの削除はOutboxから行う
+	record.Result.event = event
+	go reopened.Run(configObj)
+
+	select {
+	case sent := <-received:
+		if sent.EventID != "event" || sent.Stdout != "output" {
+			t.Errorf("server received %+v", sent)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("the outbox did not send the result")
+	}
+	for deadline := time.Now().Add(time.Second * 5); len(queue.deletedHandles()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if deleted := queue.deletedHandles(); len(deleted) != 1 || deleted[0] != "receipt" {
+		t.Errorf("deleted = %v, want [receipt]", deleted)
+	}
+	if _, ok := reopened.oldest(); ok {
+		t.Error("accepted result should be removed from the outbox")
+	}
+}
+
+func TestOutboxRejectedResultDoesNotBlock(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := OpenOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := &fakeActionQueue{}
+	for _, id := range []string{"rejected", "flaky", "accepted"} {
+		result := newActionResult(&Event{EventID: id, ReceiptHandle: id, queue: queue})
+		result.Status = ActionStatusSucceeded
+		if err := outbox.Append(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(chan ActionResult, 10)
+	configObj := newTestActionServerWithStatus(t, received, func(result ActionResult) int {
+		switch result.EventID {
+		case "rejected":
+			return http.StatusBadRequest
+		case "flaky":
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	if accepted, failed := outbox.sendPending(configObj); !accepted || failed != 1 {
+		t.Errorf("sendPending = %v, %d, want true, 1", accepted, failed)
+	}
+	select {
+	case sent := <-received:
+		if sent.EventID != "accepted" {
+			t.Errorf("server received %s, want accepted", sent.EventID)
+		}
+	default:
+		t.Fatal("a rejected result blocked the next result")
+	}
+
+	// 拒否された実行結果はデッドレターファイルに移してメッセージを削除する。一時的なエラーの実行結果は送信待ちに残す
+	deleted := queue.deletedHandles()
+	if len(deleted) != 2 || deleted[0] != "rejected" || deleted[1] != "accepted" {
+		t.Errorf("deleted = %v, want [rejected accepted]", deleted)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, outboxDeadLetterFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dead ActionResult
+	if err := json.Unmarshal(content, &dead); err != nil || dead.EventID != "rejected" {
+		t.Errorf("dead letter = %s (%v), want the rejected result", content, err)
+	}
+	if record, ok := outbox.oldest(); !ok || record.Result.EventID != "flaky" {
+		t.Errorf("the result with a transient error should stay in the outbox: %+v", record)
+	}
+}
+
+func TestOutboxDeadLettersRepeatedFailures(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := OpenOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := &fakeActionQueue{}
+	flaky := newActionResult(&Event{EventID: "flaky", ReceiptHandle: "flaky", queue: queue})
+	if err := outbox.Append(flaky); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan ActionResult, maxOutboxFailures+1)
+	configObj := newTestActionServerWithStatus(t, received, func(result ActionResult) int {
+		if result.EventID == "flaky" {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+
+	// 他の実行結果が受け付けられる間に失敗し続けた実行結果はデッドレターファイルに移す
+	for i := 0; i < maxOutboxFailures; i++ {
+		result := newActionResult(&Event{EventID: "ok", ReceiptHandle: "ok"})
+		if err := outbox.Append(result); err != nil {
+			t.Fatal(err)
+		}
+		records := outbox.snapshot()
+		if len(records) == 0 || records[0].Result.EventID != "flaky" {
+			t.Fatalf("flaky result was moved after %d failures", i)
+		}
+		outbox.sendPending(configObj)
+	}
+	if _, ok := outbox.oldest(); ok {
+		t.Error("the repeatedly failing result should be moved to the dead letter file")
+	}
+	if deleted := queue.deletedHandles(); len(deleted) != 1 || deleted[0] != "flaky" {
+		t.Errorf("deleted = %v, want [flaky]", deleted)
+	}
+}
@@ -0,0 +1,391 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// Policy はAgent側で実行を許可するActionを定義するローカル実行ポリシーの構造体
+// 空の項目は制限しない。ServerがRawCommandを自由に送信できるため、Server側が侵害されてもホストを守るために使う
+//
+// AllowedCommandPatternsかAllowedExecArgsを指定した場合、コマンドを評価できないAction種別("http"、"file"など)は
+// AllowedActionTypesに明示しない限り拒否する
+// リポジトリのRunbookは内容をコマンドの許可リストや禁止パスで評価できないため、それらを指定した場合は
+// AllowedRunbooksとAllowedRepositoriesの両方に一致するRunbookだけ実行する
+type Policy struct {
+	AllowedActionTypes     []string // 許可するAction種別
+	AllowedRunbooks        []string // 許可するRunbook名(path.Matchのパターン)
+	AllowedRepositories    []string // Runbookの取得を許可するリポジトリ(owner/repoのpath.Matchのパターン)
+	AllowedCommandPatterns []string // "script"のRawCommandで許可するコマンドの正規表現(コマンド全体に一致する必要がある)
+	// AllowedExecArgs は"exec"と"service"で許可するコマンドと引数の正規表現。引数ごとに一致し、引数の数も一致する必要がある
+	// 例：[["/usr/sbin/nginx", "-s", "reload|reopen"]]
+	AllowedExecArgs [][]string
+	AllowedEnvKeys  []string // 許可する環境変数のキー
+	MaxTimeout      int32    // 許可するタイムアウト値の上限(秒)
+	// ForbiddenPaths はコマンドやファイル書き込みで参照を禁止するパス。シンボリックリンクは解決してから比較する
+	// 指定した場合、クォートや変数展開などでパスを評価できないRawCommandは拒否する
+	ForbiddenPaths []string
+	// Runbooks はRunbook名ごとにAgentConfigのデフォルトを上書きする実行ユーザとリソース制限
+	// Runbook名はServerが指定するため、デフォルトより強い権限や緩い制限にはできない(ExecutionSettings.merge)
+	Runbooks map[string]ExecutionSettings
+}
+
+// compiledPolicy はパース済みのローカル実行ポリシーの構造体
+type compiledPolicy struct {
+	Policy
+	actionTypes     map[string]bool
+	commandPatterns []*regexp.Regexp
+	execArgPatterns [][]*regexp.Regexp
+	envKeys         map[string]bool
+	forbiddenPaths  []string // シンボリックリンクを解決したForbiddenPaths
+}
+
+// commandActionTypes はコマンドの許可リストで評価できるAction種別
+var commandActionTypes = map[string]bool{
+	actionTypeScript:  true,
+	actionTypeExec:    true,
+	actionTypeService: true,
+}
+
+// shellExpansionChars はシェルがクォートの除去や展開を行う文字。含むRawCommandは参照するパスを評価できない
+const shellExpansionChars = "$`'\"\\*?[{~"
+
+// shellSeparators はRawCommandを単語に分割する文字
+const shellSeparators = " \t\n;|&<>()"
+
+// PolicyDeniedError はローカル実行ポリシーで拒否されたことを示すエラー
+type PolicyDeniedError struct {
+	Reason string
+}
+
+func (e *PolicyDeniedError) Error() string {
+	return "Denied by the local execution policy: " + e.Reason
+}
+
+// policyStore は現在のローカル実行ポリシーを保持する。nilの場合は全てのActionを許可する
+var policyStore = struct {
+	sync.RWMutex
+	policy *compiledPolicy
+}{}
+
+// compilePolicy はローカル実行ポリシーのパターンをパースするファンクション
+func compilePolicy(policy Policy) (*compiledPolicy, error) {
+	compiled := &compiledPolicy{Policy: policy, actionTypes: map[string]bool{}, envKeys: map[string]bool{}}
+	for _, actionType := range policy.AllowedActionTypes {
+		compiled.actionTypes[actionType] = true
+	}
+	for _, pattern := range policy.AllowedCommandPatterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, errors.New("Invalid command pattern: " + pattern)
+		}
+		compiled.commandPatterns = append(compiled.commandPatterns, re)
+	}
+	for _, args := range policy.AllowedExecArgs {
+		if len(args) == 0 {
+			return nil, errors.New("AllowedExecArgs must not contain an empty list.")
+		}
+		var patterns []*regexp.Regexp
+		for _, pattern := range args {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, errors.New("Invalid exec arg pattern: " + pattern)
+			}
+			patterns = append(patterns, re)
+		}
+		compiled.execArgPatterns = append(compiled.execArgPatterns, patterns)
+	}
+	for _, forbidden := range policy.ForbiddenPaths {
+		if !filepath.IsAbs(forbidden) {
+			return nil, errors.New("Forbidden path must be an absolute path: " + forbidden)
+		}
+		compiled.forbiddenPaths = append(compiled.forbiddenPaths, resolvePath(forbidden))
+	}
+	for _, pattern := range policy.AllowedRunbooks {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("Invalid runbook pattern: " + pattern)
+		}
+	}
+	for _, pattern := range policy.AllowedRepositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("Invalid repository pattern: " + pattern)
+		}
+	}
+	for name, settings := range policy.Runbooks {
+		if err := settings.validate(); err != nil {
+			return nil, errors.New("Invalid execution settings for runbook " + name + ": " + err.Error())
+		}
+	}
+	for _, key := range policy.AllowedEnvKeys {
+		compiled.envKeys[key] = true
+	}
+	return compiled, nil
+}
+
+// readPolicy はローカル実行ポリシーファイル(JSON)を読み込んで検証するファンクション
+// policyFilePathが空の場合はnil(ローカル実行ポリシーなし)を返却する
+func readPolicy(policyFilePath string) (*compiledPolicy, error) {
+	if len(policyFilePath) == 0 {
+		return nil, nil
+	}
+
+	file, err := ioutil.ReadFile(policyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(file, &policy); err != nil {
+		return nil, err
+	}
+	return compilePolicy(policy)
+}
+
+// setPolicy はreadPolicyで読み込んだローカル実行ポリシーを有効にするファンクション
+func setPolicy(compiled *compiledPolicy, policyFilePath string) {
+	policyStore.Lock()
+	policyStore.policy = compiled
+	policyStore.Unlock()
+	if compiled != nil {
+		logging.Info("Loaded the local execution policy.", logging.Fields{"path": policyFilePath})
+	}
+}
+
+// LoadPolicy はローカル実行ポリシーファイル(JSON)を読み込んで有効にするファンクション
+// policyFilePathが空の場合はローカル実行ポリシーを無効にする
+func LoadPolicy(policyFilePath string) error {
+	compiled, err := readPolicy(policyFilePath)
+	if err != nil {
+		return err
+	}
+	setPolicy(compiled, policyFilePath)
+	return nil
+}
+
+// getPolicy は現在のローカル実行ポリシーを返却するファンクション
+func getPolicy() *compiledPolicy {
+	policyStore.RLock()
+	defer policyStore.RUnlock()
+	return policyStore.policy
+}
+
+// policyTargets はEventがシェルで実行するコマンド、シェルを介さずに実行するコマンドと引数、書き込むファイルのパスを求めるファンクション
+func policyTargets(event *Event) (shellCommands []string, argvs [][]string, paths []string) {
+	switch event.ActionType {
+	case actionTypeScript:
+		if len(event.RawCommand) > 0 {
+			shellCommands = append(shellCommands, event.RawCommand)
+		}
+	case actionTypeExec:
+		var params execParameters
+		if parseActionParameters(event, &params) == nil {
+			argvs = append(argvs, params.Args)
+		}
+	case actionTypeService:
+		if params, err := parseServiceParameters(event); err == nil {
+			argvs = append(argvs, serviceCommand(params))
+		}
+	case actionTypeFile:
+		if params, _, err := parseFileParameters(event); err == nil {
+			paths = append(paths, params.Path)
+		}
+	}
+	return shellCommands, argvs, paths
+}
+
+// isRepositoryRunbook はEventがリポジトリから取得したRunbookを実行するかを返却するファンクション
+func isRepositoryRunbook(event *Event) bool {
+	return event.ActionType == actionTypeScript && len(event.RawCommand) == 0
+}
+
+// matchAny は名前がpath.Matchのパターンのいずれかに一致するかを返却するファンクション
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath はシンボリックリンクを解決した絶対パスを返却するファンクション
+// パスが存在しない場合は存在する親ディレクトリまで解決し、残りのパスをつなげる
+func resolvePath(p string) string {
+	p = filepath.Clean(p)
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		return resolved
+	}
+	dir := filepath.Dir(p)
+	if dir == p {
+		return p
+	}
+	return filepath.Join(resolvePath(dir), filepath.Base(p))
+}
+
+// isUnderPath はpがbaseと同じか、base配下のパスかを返却するファンクション
+func isUnderPath(p, base string) bool {
+	base = strings.TrimRight(base, slash)
+	return p == base || strings.HasPrefix(p, base+slash)
+}
+
+// forbiddenPathIn はパスが禁止されたパスかその配下の場合に、その禁止されたパスを返却するファンクション
+func (p *compiledPolicy) forbiddenPathIn(target string) (string, bool) {
+	resolved := resolvePath(target)
+	for i, forbidden := range p.forbiddenPaths {
+		if isUnderPath(resolved, forbidden) || isUnderPath(filepath.Clean(target), filepath.Clean(p.ForbiddenPaths[i])) {
+			return p.ForbiddenPaths[i], true
+		}
+	}
+	return "", false
+}
+
+// checkArgPaths はコマンドの引数が禁止されたパスを参照していないかを検証するファンクション
+// "--file=/etc/shadow"のような"="の後のパスも検証する。"/"を含む相対パスはworkDirからのパスとして検証する
+func (p *compiledPolicy) checkArgPaths(args []string, workDir string) error {
+	for _, arg := range args {
+		candidates := []string{arg}
+		if i := strings.Index(arg, "="); i >= 0 {
+			candidates = append(candidates, arg[i+1:])
+		}
+		for _, candidate := range candidates {
+			if !filepath.IsAbs(candidate) {
+				if len(workDir) == 0 || (!strings.Contains(candidate, slash) && candidate != "." && candidate != "..") {
+					continue
+				}
+				candidate = filepath.Join(workDir, candidate)
+			}
+			if forbidden, ok := p.forbiddenPathIn(candidate); ok {
+				return &PolicyDeniedError{Reason: "command refers to a forbidden path: " + forbidden}
+			}
+		}
+	}
+	return nil
+}
+
+// policyWorkDir はActionのプロセスの作業ディレクトリを返却するファンクション。相対パスの引数の検証に使う
+func policyWorkDir(event *Event) string {
+	if settings, err := getExecutionSettings(event); err == nil && len(settings.WorkingDir) > 0 {
+		return settings.WorkingDir
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// matchExecArgs はコマンドと引数がAllowedExecArgsのいずれかに引数ごとに一致するかを返却するファンクション
+func (p *compiledPolicy) matchExecArgs(argv []string) bool {
+	for _, patterns := range p.execArgPatterns {
+		if len(patterns) != len(argv) {
+			continue
+		}
+		matched := true
+		for i, re := range patterns {
+			if !re.MatchString(argv[i]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// check はEventがローカル実行ポリシーに違反していないかを検証するファンクション
+func (p *compiledPolicy) check(event *Event) error {
+	if len(p.AllowedActionTypes) > 0 && !p.actionTypes[event.ActionType] {
+		return &PolicyDeniedError{Reason: "action type is not allowed: " + event.ActionType}
+	}
+
+	// コマンドの許可リストを指定した場合、許可リストで評価できないAction種別は明示的に許可したものだけ実行する
+	hasCommandAllowlist := len(p.commandPatterns) > 0 || len(p.execArgPatterns) > 0
+	if hasCommandAllowlist && !commandActionTypes[event.ActionType] && !p.actionTypes[event.ActionType] {
+		return &PolicyDeniedError{Reason: "action type cannot be evaluated by the command allowlist: " + event.ActionType}
+	}
+
+	if p.MaxTimeout > 0 && getActionTimeout(event) > time.Second*time.Duration(p.MaxTimeout) {
+		return &PolicyDeniedError{Reason: "timeout exceeds the maximum"}
+	}
+
+	if len(p.AllowedRunbooks) > 0 && !matchAny(p.AllowedRunbooks, event.RunbookName) {
+		return &PolicyDeniedError{Reason: "runbook is not allowed: " + event.RunbookName}
+	}
+
+	if isRepositoryRunbook(event) {
+		if len(p.AllowedRepositories) > 0 && !matchAny(p.AllowedRepositories, event.GithubFilePath) {
+			return &PolicyDeniedError{Reason: "runbook repository is not allowed: " + event.GithubFilePath}
+		}
+		// Runbookの内容はServerが送信するChecksumでしか検証できないため、コマンドとして評価できない
+		// コマンドの許可リストか禁止パスを指定した場合は、Runbook名とリポジトリを明示的に許可したものだけ実行する
+		if (hasCommandAllowlist || len(p.forbiddenPaths) > 0) && (len(p.AllowedRunbooks) == 0 || len(p.AllowedRepositories) == 0) {
+			return &PolicyDeniedError{Reason: "repository runbooks must be allowed by AllowedRunbooks and AllowedRepositories"}
+		}
+	}
+
+	if len(p.AllowedEnvKeys) > 0 {
+		for key := range event.Enviroment {
+			if !p.envKeys[key] {
+				return &PolicyDeniedError{Reason: "env key is not allowed: " + key}
+			}
+		}
+	}
+
+	shellCommands, argvs, paths := policyTargets(event)
+	for _, command := range shellCommands {
+		if hasCommandAllowlist {
+			allowed := false
+			for _, re := range p.commandPatterns {
+				if re.MatchString(command) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return &PolicyDeniedError{Reason: "command does not match any allowed pattern"}
+			}
+		}
+		if len(p.forbiddenPaths) > 0 {
+			// シェルが展開する文字を含む場合は実際に参照するパスを評価できない
+			if strings.ContainsAny(command, shellExpansionChars) {
+				return &PolicyDeniedError{Reason: "command cannot be checked against the forbidden paths because it contains shell expansion or quoting"}
+			}
+			words := strings.FieldsFunc(command, func(r rune) bool { return strings.ContainsRune(shellSeparators, r) })
+			if err := p.checkArgPaths(words, policyWorkDir(event)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, argv := range argvs {
+		if hasCommandAllowlist && !p.matchExecArgs(argv) {
+			return &PolicyDeniedError{Reason: "command does not match any allowed exec args"}
+		}
+		if err := p.checkArgPaths(argv, policyWorkDir(event)); err != nil {
+			return err
+		}
+	}
+	for _, target := range paths {
+		if forbidden, ok := p.forbiddenPathIn(target); ok {
+			return &PolicyDeniedError{Reason: "path is forbidden: " + forbidden}
+		}
+	}
+	return nil
+}
+
+// checkPolicy はEventがローカル実行ポリシーで許可されているかを検証するファンクション
+// ローカル実行ポリシーが設定されていない場合は全てのEventを許可する
+func checkPolicy(event *Event) error {
+	policy := getPolicy()
+	if policy == nil {
+		return nil
+	}
+	return policy.check(event)
+}
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newPolicyTestEvent はテスト用のEventを生成するファンクション
+func newPolicyTestEvent(t *testing.T, actionType string, params interface{}) *Event {
+	event := &Event{EventID: "event", ActionType: actionType, RunbookName: "runbook"}
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event.Parameters = raw
+	}
+	return event
+}
+
+func mustCompilePolicy(t *testing.T, policy Policy) *compiledPolicy {
+	compiled, err := compilePolicy(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compiled
+}
+
+func TestPolicyActionTypes(t *testing.T) {
+	policy := mustCompilePolicy(t, Policy{AllowedActionTypes: []string{actionTypeExec}})
+
+	if err := policy.check(newPolicyTestEvent(t, actionTypeExec, execParameters{Args: []string{"/bin/true"}})); err != nil {
+		t.Errorf("exec should be allowed: %v", err)
+	}
+	event := newPolicyTestEvent(t, actionTypeHTTP, httpParameters{URL: "http://127.0.0.1/"})
+	if err := policy.check(event); err == nil {
+		t.Error("http should be denied when it is not in AllowedActionTypes")
+	}
+}
+
+func TestPolicyScript(t *testing.T) {
+	policy := mustCompilePolicy(t, Policy{AllowedCommandPatterns: []string{`service nginx (stop|start)`}})
+
+	event := &Event{ActionType: actionTypeScript, RawCommand: "service nginx stop"}
+	if err := policy.check(event); err != nil {
+		t.Errorf("matching command should be allowed: %v", err)
+	}
+	event.RawCommand = "service nginx stop; rm -rf /"
+	if err := policy.check(event); err == nil {
+		t.Error("command with a suffix should be denied")
+	}
+}
+
+func TestPolicyScriptForbiddenPaths(t *testing.T) {
+	policy := mustCompilePolicy(t, Policy{ForbiddenPaths: []string{"/etc/shadow"}})
+
+	tests := []struct {
+		command string
+		denied  bool
+	}{
+		{"cat /var/log/messages", false},
+		{"cat /etc/shadow", true},
+		{"cat</etc/shadow", true},
+		{`cat "/etc/shadow"`, true},
+		{"cat /etc/sha*", true},
+		{"cat $(echo /etc/shadow)", true},
+		{"cat /etc/./shadow", true},
+	}
+	for _, test := range tests {
+		err := policy.check(&Event{ActionType: actionTypeScript, RawCommand: test.command})
+		if denied := err != nil; denied != test.denied {
+			t.Errorf("%q: denied = %v, want %v (%v)", test.command, denied, test.denied, err)
+		}
+	}
+}
+
+func TestPolicyRepositoryRunbook(t *testing.T) {
+	runbook := func(repository, name string) *Event {
+		return &Event{ActionType: actionTypeScript, GithubFilePath: repository, RunbookName: name, Checksum: "00"}
+	}
+	restricted := Policy{AllowedCommandPatterns: []string{"systemctl restart nginx"}, ForbiddenPaths: []string{"/etc/shadow"}}
+
+	// コマンドの許可リストと禁止パスはRunbookの内容を評価できないため、Runbookを明示的に許可していなければ拒否する
+	if err := mustCompilePolicy(t, restricted).check(runbook("evil/repo", "pwn")); err == nil {
+		t.Error("repository runbook should be denied when a command allowlist is configured")
+	}
+	if err := mustCompilePolicy(t, Policy{ForbiddenPaths: []string{"/etc/shadow"}}).check(runbook("evil/repo", "pwn")); err == nil {
+		t.Error("repository runbook should be denied when forbidden paths are configured")
+	}
+
+	restricted.AllowedRunbooks = []string{"nginx/*"}
+	if err := mustCompilePolicy(t, restricted).check(runbook("ops/runbooks", "nginx/restart")); err == nil {
+		t.Error("repository runbook should be denied without AllowedRepositories")
+	}
+
+	restricted.AllowedRepositories = []string{"ops/*"}
+	policy := mustCompilePolicy(t, restricted)
+	tests := []struct {
+		repository string
+		name       string
+		denied     bool
+	}{
+		{"ops/runbooks", "nginx/restart", false},
+		{"evil/repo", "nginx/restart", true},
+		{"ops/runbooks", "pwn", true},
+	}
+	for _, test := range tests {
+		err := policy.check(runbook(test.repository, test.name))
+		if denied := err != nil; denied != test.denied {
+			t.Errorf("%s %s: denied = %v, want %v (%v)", test.repository, test.name, denied, test.denied, err)
+		}
+	}
+
+	// 許可リストがない場合もAllowedRepositoriesは適用する
+	if err := mustCompilePolicy(t, Policy{AllowedRepositories: []string{"ops/runbooks"}}).check(runbook("evil/repo", "pwn")); err == nil {
+		t.Error("repository not in AllowedRepositories should be denied")
+	}
+	if err := mustCompilePolicy(t, Policy{}).check(runbook("evil/repo", "pwn")); err != nil {
+		t.Errorf("repository runbook should be allowed without a policy restriction: %v", err)
+	}
+}
+
+func TestPolicyExecArgs(t *testing.T) {
+	policy := mustCompilePolicy(t, Policy{AllowedExecArgs: [][]string{{"/usr/sbin/nginx", "-s", "reload|reopen"}}})
+
+	tests := []struct {
+		args    []string
+		allowed bool
+	}{
+		{[]string{"/usr/sbin/nginx", "-s", "reload"}, true},
+		{[]string{"/usr/sbin/nginx", "-s", "reopen"}, true},
+		{[]string{"/usr/sbin/nginx -s reload"}, false},
+		{[]string{"/usr/sbin/nginx", "-s reload"}, false},
+		{[]string{"/usr/sbin/nginx", "-s", "reload", "-c", "/tmp/evil.conf"}, false},
+		{[]string{"/usr/sbin/nginx", "-s", "stop"}, false},
+	}
+	for _, test := range tests {
+		err := policy.check(newPolicyTestEvent(t, actionTypeExec, execParameters{Args: test.args}))
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%q: allowed = %v, want %v (%v)", test.args, allowed, test.allowed, err)
+		}
+	}
+}
+
+func TestPolicyExecForbiddenPaths(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := os.Mkdir(secret, 0700); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(secret, link); err != nil {
+		t.Fatal(err)
+	}
+	policy := mustCompilePolicy(t, Policy{ForbiddenPaths: []string{secret}})
+
+	tests := []struct {
+		args   []string
+		denied bool
+	}{
+		{[]string{"/bin/cat", filepath.Join(dir, "other")}, false},
+		{[]string{"/bin/cat", filepath.Join(secret, "key")}, true},
+		{[]string{"/bin/cat", filepath.Join(link, "key")}, true},
+		{[]string{"/bin/cp", "--target=" + link, "/tmp/x"}, true},
+	}
+	for _, test := range tests {
+		err := policy.check(newPolicyTestEvent(t, actionTypeExec, execParameters{Args: test.args}))
+		if denied := err != nil; denied != test.denied {
+			t.Errorf("%q: denied = %v, want %v (%v)", test.args, denied, test.denied, err)
+		}
+	}
+}
+
+func TestPolicyService(t *testing.T) {
+	policy := mustCompilePolicy(t, Policy{AllowedExecArgs: [][]string{{systemctlPath, "restart", "--", `nginx\.service`}}})
+
+	if err := policy.check(newPolicyTestEvent(t, actionTypeService, serviceParameters{Unit: "nginx.service", Operation: "restart"})); err != nil {
+		t.Errorf("allowed service operation should pass: %v", err)
+	}
+	if err := policy.check(newPolicyTestEvent(t, actionTypeService, serviceParameters{Unit: "sshd.service", Operation: "restart"})); err == nil {
+		t.Error("service unit not in the allowlist should be denied")
+	}
+}
+
+func TestPolicyHTTP(t *testing.T) {
+	event := newPolicyTestEvent(t, actionTypeHTTP, httpParameters{Method: "POST", URL: "http://127.0.0.1:8080/admin/flush"})
+
+	if err := mustCompilePolicy(t, Policy{}).check(event); err != nil {
+		t.Errorf("http should be allowed without a policy restriction: %v", err)
+	}
+	allowlist := Policy{AllowedCommandPatterns: []string{"true"}}
+	if err := mustCompilePolicy(t, allowlist).check(event); err == nil {
+		t.Error("http should be denied when a command allowlist is configured")
+	}
+	allowlist.AllowedActionTypes = []string{actionTypeScript, actionTypeHTTP}
+	if err := mustCompilePolicy(t, allowlist).check(event); err != nil {
+		t.Errorf("http explicitly allowed by AllowedActionTypes should pass: %v", err)
+	}
+}
+
+func TestPolicyFile(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := os.Mkdir(secret, 0700); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(secret, link); err != nil {
+		t.Fatal(err)
+	}
+	policy := mustCompilePolicy(t, Policy{ForbiddenPaths: []string{secret}})
+
+	tests := []struct {
+		path   string
+		denied bool
+	}{
+		{filepath.Join(dir, "app.conf"), false},
+		{filepath.Join(secret, "app.conf"), true},
+		{filepath.Join(link, "app.conf"), true},
+		{filepath.Join(link, "missing", "app.conf"), true},
+	}
+	for _, test := range tests {
+		err := policy.check(newPolicyTestEvent(t, actionTypeFile, fileParameters{Path: test.path, Content: "x"}))
+		if denied := err != nil; denied != test.denied {
+			t.Errorf("%s: denied = %v, want %v (%v)", test.path, denied, test.denied, err)
+		}
+	}
+
+	allowlist := mustCompilePolicy(t, Policy{AllowedCommandPatterns: []string{"true"}})
+	if err := allowlist.check(newPolicyTestEvent(t, actionTypeFile, fileParameters{Path: filepath.Join(dir, "app.conf")})); err == nil {
+		t.Error("file should be denied when a command allowlist is configured")
+	}
+}
+
+func TestPolicyUnknownActionType(t *testing.T) {
+	policy := mustCompilePolicy(t, Policy{AllowedExecArgs: [][]string{{"/bin/true"}}})
+	if err := policy.check(&Event{ActionType: "custom"}); err == nil {
+		t.Error("action type the policy cannot evaluate should be denied")
+	}
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// プロセス実行の定数
+const (
+	defaultMaxOutputBytes = 1024 * 1024
+	// processWaitDelaySecs はタイムアウトでプロセスグループをkillした後に出力の読み込みを待つ秒数
+	processWaitDelaySecs = 5
+	truncatedOutputNote  = "\n[output truncated]"
+)
+
+// ExecutionSettings はActionのプロセスを起動する際の実行ユーザとリソース制限の構造体
+// AgentConfigでデフォルトを、Policy.Runbooksで Runbookごとの設定を指定し、0値の項目はデフォルトを使う
+// Runbook名はServerが指定するため、Runbookごとの設定はデフォルトより権限を弱める方向にだけ上書きできる
+type ExecutionSettings struct {
+	RunAsUser      string // 実行ユーザ名またはUID
+	RunAsGroup     string // 実行グループ名またはGID。省略した場合は実行ユーザのプライマリグループ
+	WorkingDir     string
+	Umask          string // 8進数のumask 例："0022"
+	CPULimitSecs   uint64 // CPU時間の上限(秒)
+	MemoryLimitMB  uint64 // 仮想メモリの上限(MB)
+	OpenFilesLimit uint64 // オープンできるファイル数の上限
+	MaxOutputBytes int    // 標準出力と標準エラー出力それぞれの保持する上限(バイト)
+}
+
+// lowerLimit はリソース制限を緩めないように、0(制限なし)を除いて小さい方の値を返却するファンクション
+func lowerLimit(current, override uint64) uint64 {
+	if override > 0 && (current == 0 || override < current) {
+		return override
+	}
+	return current
+}
+
+// merge はoverrideの0値でない項目でsの項目を上書きした設定を返却するファンクション
+// 実行ユーザと実行グループはsがAgentの実行ユーザで実行する場合だけ変更でき、別のユーザに変更する場合はエラーとする
+// umaskは両方のビットを合わせ、リソース制限は小さい方を使うため、デフォルトより緩めることはできない
+func (s ExecutionSettings) merge(override ExecutionSettings) (ExecutionSettings, error) {
+	if len(override.RunAsUser) > 0 || len(override.RunAsGroup) > 0 {
+		if len(s.RunAsUser) > 0 || len(s.RunAsGroup) > 0 {
+			if (len(override.RunAsUser) > 0 && override.RunAsUser != s.RunAsUser) ||
+				(len(override.RunAsGroup) > 0 && override.RunAsGroup != s.RunAsGroup) {
+				return s, errors.New("Runbook settings cannot change the default run-as user or group.")
+			}
+		} else {
+			s.RunAsUser = override.RunAsUser
+			s.RunAsGroup = override.RunAsGroup
+		}
+	}
+	if len(override.WorkingDir) > 0 {
+		s.WorkingDir = override.WorkingDir
+	}
+	if len(override.Umask) > 0 {
+		if len(s.Umask) == 0 {
+			s.Umask = override.Umask
+		} else {
+			current, err := strconv.ParseUint(s.Umask, 8, 32)
+			if err != nil {
+				return s, errors.New("Invalid umask: " + s.Umask)
+			}
+			mask, err := strconv.ParseUint(override.Umask, 8, 32)
+			if err != nil {
+				return s, errors.New("Invalid umask: " + override.Umask)
+			}
+			s.Umask = "0" + strconv.FormatUint(current|mask, 8)
+		}
+	}
+	s.CPULimitSecs = lowerLimit(s.CPULimitSecs, override.CPULimitSecs)
+	s.MemoryLimitMB = lowerLimit(s.MemoryLimitMB, override.MemoryLimitMB)
+	s.OpenFilesLimit = lowerLimit(s.OpenFilesLimit, override.OpenFilesLimit)
+	if override.MaxOutputBytes > 0 {
+		s.MaxOutputBytes = override.MaxOutputBytes
+	}
+	return s, nil
+}
+
+// validate は設定値を検証するファンクション
+func (s ExecutionSettings) validate() error {
+	if len(s.Umask) > 0 {
+		if m, err := strconv.ParseUint(s.Umask, 8, 32); err != nil || m > 0777 {
+			return errors.New("Invalid umask: " + s.Umask)
+		}
+	}
+	if s.MaxOutputBytes < 0 {
+		return errors.New("MaxOutputBytes must not be negative.")
+	}
+	return nil
+}
+
+// maxOutputBytes は出力を保持する上限を返却するファンクション
+func (s ExecutionSettings) maxOutputBytes() int {
+	if s.MaxOutputBytes > 0 {
+		return s.MaxOutputBytes
+	}
+	return defaultMaxOutputBytes
+}
+
+// limitCommands はumaskとulimitを設定するシェルコマンドを返却するファンクション
+func (s ExecutionSettings) limitCommands() []string {
+	var commands []string
+	if len(s.Umask) > 0 {
+		commands = append(commands, "umask "+s.Umask)
+	}
+	if s.CPULimitSecs > 0 {
+		commands = append(commands, "ulimit -t "+strconv.FormatUint(s.CPULimitSecs, 10))
+	}
+	if s.MemoryLimitMB > 0 {
+		commands = append(commands, "ulimit -v "+strconv.FormatUint(s.MemoryLimitMB*1024, 10))
+	}
+	if s.OpenFilesLimit > 0 {
+		commands = append(commands, "ulimit -n "+strconv.FormatUint(s.OpenFilesLimit, 10))
+	}
+	return commands
+}
+
+// wrapCommand はumaskとリソース制限を設定してからコマンドをexecするシェル経由の引数に変換するファンクション
+// 制限がない場合はそのままのコマンドを返却する
+func (s ExecutionSettings) wrapCommand(name string, args []string) (string, []string) {
+	commands := s.limitCommands()
+	if len(commands) == 0 {
+		return name, args
+	}
+	script := ""
+	for _, c := range commands {
+		script += c + " && "
+	}
+	script += `exec "$@"`
+	return shellPath, append([]string{shellCommandFlag, script, shellPath, name}, args...)
+}
+
+// executionDefaults はAgentConfigで指定されたデフォルトの実行設定。ConfigureExecutionで設定する
+var executionDefaults = struct {
+	sync.RWMutex
+	settings ExecutionSettings
+}{}
+
+// ConfigureExecution はActionのプロセスを起動する際のデフォルトの実行設定を設定するファンクション
+func ConfigureExecution(settings ExecutionSettings) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	executionDefaults.Lock()
+	executionDefaults.settings = settings
+	executionDefaults.Unlock()
+	return nil
+}
+
+// getExecutionSettings はEventのRunbookに適用する実行設定を求めるファンクション
+// デフォルトの実行設定にローカル実行ポリシーのRunbookごとの設定を上書きする
+func getExecutionSettings(event *Event) (ExecutionSettings, error) {
+	executionDefaults.RLock()
+	settings := executionDefaults.settings
+	executionDefaults.RUnlock()
+
+	if policy := getPolicy(); policy != nil {
+		if override, ok := policy.Runbooks[event.RunbookName]; ok {
+			var err error
+			if settings, err = settings.merge(override); err != nil {
+				return settings, err
+			}
+		}
+	}
+	return settings, settings.validate()
+}
+
+// checkRunsAsAgent はAgentの権限で実行するActionに実行ユーザと実行グループが指定されていないかを検証するファンクション
+// 指定した場合は実行ユーザより強い権限で実行しないように拒否する
+func checkRunsAsAgent(event *Event, reason string) error {
+	settings, err := getExecutionSettings(event)
+	if err != nil {
+		return err
+	}
+	if len(settings.RunAsUser) > 0 || len(settings.RunAsGroup) > 0 {
+		return errors.New("Action type " + event.ActionType + " " + reason + " and cannot be run as RunAsUser or RunAsGroup.")
+	}
+	return nil
+}
+
+// checkInProcessAction はAgentのプロセス内で実行するAction("http"と"file")を実行できるかを検証するファンクション
+// これらのActionは子プロセスを起動しないため、実行ユーザを指定した場合は拒否する
+func checkInProcessAction(event *Event) error {
+	return checkRunsAsAgent(event, "runs inside the agent process")
+}
+
+// cappedBuffer は上限を超えた出力を破棄するバッファ
+// 上限を超えてもプロセスを止めないように書き込みは常に成功させる
+type cappedBuffer struct {
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+// Write は上限まで出力を保持するファンクション
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - len(b.buf); remaining > 0 {
+		if len(p) > remaining {
+			b.buf = append(b.buf, p[:remaining]...)
+			b.truncated = true
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// String は保持した出力を返却するファンクション。上限を超えた場合は末尾に注記を付ける
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return string(b.buf) + truncatedOutputNote
+	}
+	return string(b.buf)
+}
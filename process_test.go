@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestExecutionSettingsMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     ExecutionSettings
+		override ExecutionSettings
+		want     ExecutionSettings
+		fails    bool
+	}{
+		{
+			name:     "run as a user from the agent user",
+			override: ExecutionSettings{RunAsUser: "nobody"},
+			want:     ExecutionSettings{RunAsUser: "nobody"},
+		},
+		{
+			name:     "same user as the default",
+			base:     ExecutionSettings{RunAsUser: "nobody"},
+			override: ExecutionSettings{RunAsUser: "nobody", CPULimitSecs: 10},
+			want:     ExecutionSettings{RunAsUser: "nobody", CPULimitSecs: 10},
+		},
+		{
+			name:     "raise to root",
+			base:     ExecutionSettings{RunAsUser: "nobody"},
+			override: ExecutionSettings{RunAsUser: "root"},
+			fails:    true,
+		},
+		{
+			name:     "change the group",
+			base:     ExecutionSettings{RunAsUser: "nobody"},
+			override: ExecutionSettings{RunAsGroup: "shadow"},
+			fails:    true,
+		},
+		{
+			name:     "limits are never loosened",
+			base:     ExecutionSettings{CPULimitSecs: 60, MemoryLimitMB: 512, Umask: "0022"},
+			override: ExecutionSettings{CPULimitSecs: 600, MemoryLimitMB: 128, OpenFilesLimit: 64, Umask: "0007"},
+			want:     ExecutionSettings{CPULimitSecs: 60, MemoryLimitMB: 128, OpenFilesLimit: 64, Umask: "027"},
+		},
+	}
+	for _, test := range tests {
+		got, err := test.base.merge(test.override)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: merge should fail", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRunbookSettingsCannotRaisePrivilege(t *testing.T) {
+	if err := ConfigureExecution(ExecutionSettings{RunAsUser: "nobody"}); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureExecution(ExecutionSettings{})
+	setPolicy(mustCompilePolicy(t, Policy{Runbooks: map[string]ExecutionSettings{"privileged": {RunAsUser: "root"}}}), "")
+	defer setPolicy(nil, "")
+
+	// Serverが特権のRunbook名を付けても、RawCommandをRunbookの実行ユーザで実行しない
+	event := &Event{EventID: "event", ActionType: actionTypeScript, RunbookName: "privileged", RawCommand: "id -u"}
+	result, err := ExecuteAction(event)
+	if err == nil || result.Status == ActionStatusSucceeded {
+		t.Errorf("status = %s, want a failure (%v)", result.Status, err)
+	}
+}
+
+func TestServiceActionRejectsRunAsUser(t *testing.T) {
+	if err := ConfigureExecution(ExecutionSettings{RunAsUser: "nobody"}); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureExecution(ExecutionSettings{})
+
+	event := newPolicyTestEvent(t, actionTypeService, serviceParameters{Unit: "nginx.service", Operation: "restart"})
+	result, err := ExecuteAction(event)
+	if err == nil || result.Status != ActionStatusError {
+		t.Errorf("status = %s, want %s (%v)", result.Status, ActionStatusError, err)
+	}
+}
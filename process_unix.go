@@ -0,0 +1,85 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"errors"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// openNoFollow はパスがシンボリックリンクの場合に開かないようにするos.OpenFileのフラグ
+const openNoFollow = syscall.O_NOFOLLOW
+
+// lookupUser はユーザ名またはUIDからユーザを求めるファンクション
+func lookupUser(name string) (*user.User, error) {
+	if u, err := user.Lookup(name); err == nil {
+		return u, nil
+	}
+	return user.LookupId(name)
+}
+
+// lookupGroupID はグループ名またはGIDからGIDを求めるファンクション
+func lookupGroupID(name string) (string, error) {
+	if g, err := user.LookupGroup(name); err == nil {
+		return g.Gid, nil
+	}
+	g, err := user.LookupGroupId(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// getCredential は実行ユーザと実行グループからプロセスの資格情報と実行ユーザを求めるファンクション
+func getCredential(settings ExecutionSettings) (*syscall.Credential, *user.User, error) {
+	u, err := lookupUser(settings.RunAsUser)
+	if err != nil {
+		return nil, nil, errors.New("Unknown run-as user: " + settings.RunAsUser)
+	}
+	gid := u.Gid
+	if len(settings.RunAsGroup) > 0 {
+		if gid, err = lookupGroupID(settings.RunAsGroup); err != nil {
+			return nil, nil, errors.New("Unknown run-as group: " + settings.RunAsGroup)
+		}
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	g, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(g)}, u, nil
+}
+
+// configureProcess は実行ユーザを設定し、子プロセスを新しいプロセスグループで起動するように設定するファンクション
+// 実行ユーザを指定した場合はHOME、USER、LOGNAMEを実行ユーザのものにする
+// タイムアウトした場合はRunbookが起動した孫プロセスも含めてプロセスグループ全体をkillする
+func configureProcess(cmd *exec.Cmd, settings ExecutionSettings) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if len(settings.RunAsUser) > 0 {
+		credential, u, err := getCredential(settings)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr.Credential = credential
+		cmd.Env = replaceEnv(cmd.Env, "HOME", u.HomeDir)
+		cmd.Env = replaceEnv(cmd.Env, "USER", u.Username)
+		cmd.Env = replaceEnv(cmd.Env, "LOGNAME", u.Username)
+	} else if len(settings.RunAsGroup) > 0 {
+		return errors.New("RunAsGroup requires RunAsUser.")
+	}
+
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second * processWaitDelaySecs
+	return nil
+}
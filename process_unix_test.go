@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+)
+
+func TestRunAsUserSetsHomeAndUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the run-as user requires root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("nobody user does not exist")
+	}
+	if err := ConfigureExecution(ExecutionSettings{RunAsUser: "nobody", WorkingDir: os.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureExecution(ExecutionSettings{})
+
+	event := &Event{EventID: "event", ActionType: actionTypeScript, RawCommand: `echo "$HOME $USER $LOGNAME"`}
+	result, err := ExecuteAction(event)
+	if err != nil || result.Status != ActionStatusSucceeded {
+		t.Fatalf("status = %s (%v) %s", result.Status, err, result.Stderr)
+	}
+	want := u.HomeDir + " nobody nobody"
+	if got := strings.TrimSpace(result.Stdout); got != want {
+		t.Errorf("environment = %q, want %q", got, want)
+	}
+}
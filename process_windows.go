@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+)
+
+// openNoFollow はWindowsにはO_NOFOLLOWがないため0。シンボリックリンクはLstatで拒否する
+const openNoFollow = 0
+
+// configureProcess はWindowsでは実行ユーザの変更に対応しないため、実行ユーザが指定された場合はエラーを返却するファンクション
+func configureProcess(cmd *exec.Cmd, settings ExecutionSettings) error {
+	if len(settings.RunAsUser) > 0 || len(settings.RunAsGroup) > 0 {
+		return errors.New("Run-as user is not supported on windows.")
+	}
+	cmd.WaitDelay = time.Second * processWaitDelaySecs
+	return nil
+}
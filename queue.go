@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"errors"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// キュー種別の定数
+const (
+	// QueueTypeSQS はAWS SQSをActionキューとして使う(デフォルト)
+	QueueTypeSQS = "sqs"
+	// QueueTypeLocal はローカルディレクトリをActionキューとして使う
+	QueueTypeLocal = "local"
+)
+
+// メッセージ属性名の定数
+const (
+	agentIDAttribute   = "agentID"
+	signatureAttribute = "signature"
+)
+
+// QueueMessage はActionキューから受信した単一のメッセージの構造体
+type QueueMessage struct {
+	MessageID     string
+	ReceiptHandle string
+	Body          string
+	Attributes    map[string]string
+}
+
+// ActionQueue はServerから送信されるActionメッセージを受信するキューのインタフェース
+// RunLoopはこのインタフェースを通してメッセージを受信、可視時間の変更、削除を行う
+type ActionQueue interface {
+	// Receive はキューをポーリングしてメッセージを取得する
+	Receive() ([]*QueueMessage, error)
+	// ChangeVisibility はメッセージの可視時間(秒)を変更する
+	ChangeVisibility(receiptHandle string, timeout int64) error
+	// Delete はメッセージを削除する
+	Delete(receiptHandle string) error
+}
+
+// newActionQueue はAgentConfigのActionQueueTypeに応じてActionキューを生成するファンクション
+func newActionQueue(agentConfig *AgentConfig, regManager *RegistrationManager) (ActionQueue, error) {
+	switch agentConfig.ActionQueueType {
+	case "", QueueTypeSQS:
+		logging.Info("Initializing SQS client.", nil)
+		return newSQSQueue(regManager), nil
+	case QueueTypeLocal:
+		logging.Info("Initializing local queue.", logging.Fields{"dir": agentConfig.LocalQueueDir})
+		return newLocalQueue(agentConfig.LocalQueueDir)
+	default:
+		return nil, errors.New("Unsupported action queue type: " + agentConfig.ActionQueueType)
+	}
+}
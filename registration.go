@@ -2,16 +2,23 @@ package agent
 
 import (
 	"errors"
+	"math"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/tsubauaaa/agent/logging"
-	"gopkg.in/jmcvetta/napping.v3"
 )
 
 const (
 	// AgentVersion はエージェントバージョン
 	AgentVersion = "0.1.0"
+	// AgentRegistrationのリトライ間隔(秒)。失敗するごとに倍にしてmaxRegistrationRetryDelaySecsを上限とする
+	registrationRetryDelaySecs    = 5
+	maxRegistrationRetryDelaySecs = 300
+	// minCredentialsRefreshDelaySecs はAWS一時認証情報の有効期間がcredentialsRefreshWindowより短い場合の再AgentRegistrationの最短間隔(秒)
+	// 短い有効期間の認証情報が続くたびに倍にしてmaxRegistrationRetryDelaySecsを上限とする
+	minCredentialsRefreshDelaySecs = 30
 )
 
 // RegistrationRequest はAgentからServerに送信するメッセージの構造体
@@ -39,6 +46,9 @@ type RegistrationInfo struct {
 	AWSAccessKey        string
 	AWSSecretAccessKey  string
 	AWSSecurityToken    string
+	VerificationKeys    []VerificationKey // SQSメッセージの署名検証用の公開鍵
+	// AWSCredentialsExpiration はAWS一時認証情報の有効期限(ミリ秒)。0の場合は期限なし
+	AWSCredentialsExpiration int64
 }
 
 // startTime はAgentの開始時刻
@@ -68,8 +78,9 @@ func RegisterAgent(data HostMetaData, configObj *ServerConfig) (*RegistrationInf
 	response := RegistrationInfo{}
 	logging.Info("Registering the agent.", logging.Fields{"request": request})
 
-	// napping.Post(url, payload, result, errMsg)
-	resp, err := napping.Post(joinURL(configObj.EndPoint, "register", configObj.APIKey), &request, &response, nil)
+	// Session.Post(url, payload, result, errMsg)
+	server := configObj.get()
+	resp, err := newServerSession(server).Post(joinURL(server.EndPoint, "register"), &request, &response, nil)
 	if err != nil {
 		logging.Error("Could not post to server.", logging.Fields{"error": err, "response": resp})
 		return &response, err
@@ -83,3 +94,178 @@ func RegisterAgent(data HostMetaData, configObj *ServerConfig) (*RegistrationInf
 	return &response, errors.New("Server returned unexpected status: " + strconv.Itoa(resp.Status()))
 
 }
+
+// RegistrationManager はAgent登録情報を保持し、再AgentRegistrationを行う構造体
+// 保持するRegistrationInfoは変更せずにポインタごと入れ替えるため、Getで取得したRegistrationInfoは安全に参照できる
+type RegistrationManager struct {
+	mu         sync.RWMutex
+	regInfo    *RegistrationInfo
+	lastUpdate time.Time
+	metaData   HostMetaData
+	configObj  *ServerConfig
+	pinnedKeys []VerificationKey
+	// shortLivedCredentials は有効期間がcredentialsRefreshWindowより短いAWS一時認証情報を連続して受け取った回数
+	shortLivedCredentials int
+}
+
+// NewRegistrationManager はRegistrationManagerを生成するファンクション
+// pinnedKeysはAgentConfigで固定したSQSメッセージの署名検証用の公開鍵
+func NewRegistrationManager(data HostMetaData, configObj *ServerConfig, pinnedKeys []VerificationKey) *RegistrationManager {
+	return &RegistrationManager{
+		regInfo:    &RegistrationInfo{},
+		metaData:   data,
+		configObj:  configObj,
+		pinnedKeys: pinnedKeys,
+	}
+}
+
+// Get は現在のAgent登録情報を返却するファンクション
+func (m *RegistrationManager) Get() *RegistrationInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.regInfo
+}
+
+// hostname はAgentエラーに設定するホスト名を返却するファンクション。AssignedHostnameが設定されている場合はそれを使う
+func (m *RegistrationManager) hostname() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.metaData.AssignedHostname) > 0 {
+		return m.metaData.AssignedHostname
+	}
+	return m.metaData.HostName
+}
+
+// setAssignedHostname は次回のAgentRegistrationでServerに送信するAssignedHostnameを変更するファンクション
+func (m *RegistrationManager) setAssignedHostname(name string) {
+	m.mu.Lock()
+	m.metaData.AssignedHostname = name
+	m.mu.Unlock()
+}
+
+// set はAgent登録情報を入れ替えてSQSメッセージの署名検証用の公開鍵を更新するファンクション
+func (m *RegistrationManager) set(regInfo *RegistrationInfo) {
+	m.mu.Lock()
+	m.regInfo = regInfo
+	m.lastUpdate = time.Now()
+	if expiration := regInfo.credentialsExpiration(); !expiration.IsZero() && expiration.Sub(m.lastUpdate) <= credentialsRefreshWindow {
+		m.shortLivedCredentials++
+	} else {
+		m.shortLivedCredentials = 0
+	}
+	m.mu.Unlock()
+	recordAgentID(regInfo.AgentID)
+
+	// 設定ファイルで公開鍵を固定している場合はその公開鍵だけを信頼し、AgentRegistrationで配布された公開鍵は使わない
+	keys := regInfo.VerificationKeys
+	if len(m.pinnedKeys) > 0 {
+		keys = m.pinnedKeys
+		if len(regInfo.VerificationKeys) > 0 {
+			logging.Debug("Ignoring the verification keys from the server because VerificationKeys are pinned.", logging.Fields{"count": len(regInfo.VerificationKeys)})
+		}
+	}
+	if err := SetVerificationKeys(keys); err != nil {
+		logging.Error("No verification keys. All messages will be rejected.", logging.Fields{"error": err})
+	}
+}
+
+// SetLocalAgentID はAgentRegistrationを行わずにAgentIDを設定するファンクション
+// exec-eventでローカルのメッセージを処理する場合に使い、署名の検証にはAgentConfigで固定した公開鍵だけを使う
+func (m *RegistrationManager) SetLocalAgentID(agentID string) {
+	m.set(&RegistrationInfo{AgentID: agentID})
+}
+
+// Register はAgentRegistrationが成功するまでリトライするファンクション
+// リトライ間隔は失敗するごとに倍にして最大maxRegistrationRetryDelaySecsとする
+func (m *RegistrationManager) Register() *RegistrationInfo {
+	for i := 0; ; i++ {
+		m.mu.RLock()
+		data := m.metaData
+		m.mu.RUnlock()
+		regInfo, err := RegisterAgent(data, m.configObj)
+		if err == nil {
+			m.set(regInfo)
+			return regInfo
+		}
+		sleepDelay := math.Min(registrationRetryDelaySecs*math.Pow(2, float64(i)), maxRegistrationRetryDelaySecs)
+		logging.Error("Cloud not register the agent. Retrying..", logging.Fields{"error": err, "delay": sleepDelay})
+		time.Sleep(time.Second * time.Duration(sleepDelay))
+	}
+}
+
+// credentialsRefreshDelay はAWS一時認証情報の残りの有効期間から再AgentRegistrationまでの待ち時間を求めるファンクション
+// 通常は期限切れのcredentialsRefreshWindow前とする。有効期間がそれより短い場合は再AgentRegistrationを繰り返さないように、
+// 残りの有効期間の半分とminCredentialsRefreshDelaySecsをshortLived回倍にした間隔の長い方を待つ
+func credentialsRefreshDelay(remaining time.Duration, shortLived int) time.Duration {
+	if delay := remaining - credentialsRefreshWindow; delay > 0 {
+		return delay
+	}
+	backoff := time.Second * time.Duration(math.Min(minCredentialsRefreshDelaySecs*math.Pow(2, float64(shortLived)), maxRegistrationRetryDelaySecs))
+	if half := remaining / 2; half > backoff {
+		return half
+	}
+	return backoff
+}
+
+// credentialsRefreshTimer はAWS一時認証情報の期限切れ前に発火するタイマーを返却するファンクション
+// 有効期限がない場合はnilを返却する
+func (m *RegistrationManager) credentialsRefreshTimer() *time.Timer {
+	m.mu.RLock()
+	expiration := m.regInfo.credentialsExpiration()
+	shortLived := m.shortLivedCredentials
+	m.mu.RUnlock()
+	if expiration.IsZero() {
+		return nil
+	}
+
+	delay := credentialsRefreshDelay(expiration.Sub(time.Now()), shortLived)
+	if shortLived > 0 {
+		logging.Warn("AWS credentials expire sooner than the refresh window. Delaying the re-registration.", logging.Fields{
+			"expiration": expiration,
+			"delay":      delay,
+			"count":      shortLived,
+		})
+	}
+	return time.NewTimer(delay)
+}
+
+// Run はregChannelで再AgentRegistrationを要求されるたびと、AWS一時認証情報の期限切れ前にAgentRegistrationを行い、
+// 完了したらregInfoUpdatesChでRunLoopに通知するファンクション
+func (m *RegistrationManager) Run(regChannel <-chan time.Time, regInfoUpdatesCh chan<- string) {
+	for {
+		var refresh <-chan time.Time
+		timer := m.credentialsRefreshTimer()
+		if timer != nil {
+			refresh = timer.C
+		}
+
+		var requested time.Time
+		select {
+		case requested = <-regChannel:
+		case requested = <-refresh:
+			logging.Info("AWS credentials are about to expire.", logging.Fields{"expiration": m.Get().credentialsExpiration()})
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		// 前回のAgentRegistration完了より前に要求されたものは完了済みとして扱う
+		m.mu.RLock()
+		lastUpdate := m.lastUpdate
+		m.mu.RUnlock()
+		if requested.Before(lastUpdate) {
+			logging.Debug("Skipping the re-registration request already satisfied.", logging.Fields{"requested": requested})
+			continue
+		}
+
+		logging.Info("Re-registering the agent.", logging.Fields{"requested": requested})
+		regInfo := m.Register()
+
+		select {
+		case regInfoUpdatesCh <- regInfo.AgentID:
+		default:
+			// RunLoopが未処理の通知がある場合はその通知で最新のAgent登録情報が読まれる
+			logging.Debug("Registration update notification is already pending.", nil)
+		}
+	}
+}
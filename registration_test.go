@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCredentialsRefreshDelay(t *testing.T) {
+	tests := []struct {
+		remaining  time.Duration
+		shortLived int
+		want       time.Duration
+	}{
+		{time.Hour, 0, time.Hour - credentialsRefreshWindow},
+		{credentialsRefreshWindow, 1, credentialsRefreshWindow / 2},
+		{time.Second * 40, 1, time.Second * minCredentialsRefreshDelaySecs * 2},
+		{credentialsRefreshWindow - time.Second, 0, (credentialsRefreshWindow - time.Second) / 2},
+		{0, 0, time.Second * minCredentialsRefreshDelaySecs},
+		{-time.Minute, 1, time.Second * minCredentialsRefreshDelaySecs * 2},
+		{0, 10, time.Second * maxRegistrationRetryDelaySecs},
+	}
+	for _, test := range tests {
+		if got := credentialsRefreshDelay(test.remaining, test.shortLived); got != test.want {
+			t.Errorf("credentialsRefreshDelay(%v, %d) = %v, want %v", test.remaining, test.shortLived, got, test.want)
+		}
+	}
+}
+
+// TestRegistrationManagerTrustsOnlyPinnedKeys は公開鍵を固定した場合にServerが配布した公開鍵で署名したメッセージを拒否することを確認するテスト
+func TestRegistrationManagerTrustsOnlyPinnedKeys(t *testing.T) {
+	pinnedPublic, pinnedPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	serverPublic, serverPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	pinned := VerificationKey{KeyID: "pinned", Algorithm: AlgorithmEd25519, PublicKey: encodePublicKey(t, pinnedPublic)}
+	regInfo := &RegistrationInfo{AgentID: "agent", VerificationKeys: []VerificationKey{
+		{KeyID: "server", Algorithm: AlgorithmEd25519, PublicKey: encodePublicKey(t, serverPublic)},
+	}}
+	t.Cleanup(func() { SetVerificationKeys(nil) })
+
+	message := "message"
+	pinnedSignature := "pinned:" + base64.StdEncoding.EncodeToString(ed25519.Sign(pinnedPrivate, []byte(message)))
+	serverSignature := "server:" + base64.StdEncoding.EncodeToString(ed25519.Sign(serverPrivate, []byte(message)))
+
+	NewRegistrationManager(HostMetaData{}, &ServerConfig{}, []VerificationKey{pinned}).set(regInfo)
+	if valid, err := VerifyMessage(message, pinnedSignature); !valid || err != nil {
+		t.Errorf("pinned key should be trusted: %v", err)
+	}
+	if valid, _ := VerifyMessage(message, serverSignature); valid {
+		t.Error("server key should not be trusted when keys are pinned")
+	}
+
+	NewRegistrationManager(HostMetaData{}, &ServerConfig{}, nil).set(regInfo)
+	if valid, err := VerifyMessage(message, serverSignature); !valid || err != nil {
+		t.Errorf("server key should be trusted without pinned keys: %v", err)
+	}
+}
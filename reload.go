@@ -0,0 +1,240 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// configReloadPollSecs は設定ファイルの変更を確認する間隔(秒)
+const configReloadPollSecs = 10
+
+// liveConfigPaths は実行中に反映できる設定値のパス。末尾が"."のものはその配下の全ての設定値
+// ServerConfigの変更は再AgentRegistrationで反映する。それ以外の設定値の変更はAgentの再起動が必要
+var liveConfigPaths = []string{
+	"Server.",
+	"Agent.AssignedHostname",
+	"Agent.LogFile",
+	"Agent.DebugMode",
+	"Agent.LogFormat",
+	"Agent.LogSinks",
+	"Agent.LogLevelResetSecs",
+	"Agent.PolicyFile",
+	"Agent.PollIntervalSecs",
+	"Agent.MaxEventAgeSecs",
+	"Agent.Execution.",
+}
+
+// isLiveConfigPath は設定値を実行中に反映できるかを返却するファンクション
+func isLiveConfigPath(path string) bool {
+	for _, live := range liveConfigPaths {
+		if path == live || (strings.HasSuffix(live, ".") && strings.HasPrefix(path, live)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigReloader は設定ファイルかローカル実行ポリシーファイルの変更とSIGHUPを契機に設定を再読み込みし、実行中に反映できる設定値を反映する構造体
+// 再読み込みした設定が不正な場合は反映せずに現在の設定を使い続ける
+type ConfigReloader struct {
+	mu             sync.Mutex
+	configFilePath string
+	cmdlineConfig  ServerConfig
+	serverConfig   *ServerConfig // 各go routineが参照するServerConfig。変更した場合はupdateで入れ替える
+	agentConfig    AgentConfig   // 反映済みのAgentConfig。再起動が必要な設定値は起動時の値のまま
+	regManager     *RegistrationManager
+	regChannel     chan<- time.Time
+	configStamp    fileStamp
+	policyStamp    fileStamp
+}
+
+// fileStamp は変更を検出するためのファイルの更新時刻とサイズの構造体
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// statFile はファイルの更新時刻とサイズを返却するファンクション
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// NewConfigReloader はConfigReloaderを生成するファンクション
+// serverConfigとagentConfigは起動時にGetConfigで構成した設定値。regChannelはServerConfigを変更した場合の再AgentRegistrationの要求に使う
+func NewConfigReloader(configFilePath string, cmdlineConfig ServerConfig, serverConfig *ServerConfig, agentConfig AgentConfig,
+	regManager *RegistrationManager, regChannel chan<- time.Time) *ConfigReloader {
+	r := &ConfigReloader{
+		configFilePath: configFilePath,
+		cmdlineConfig:  cmdlineConfig,
+		serverConfig:   serverConfig,
+		agentConfig:    agentConfig,
+		regManager:     regManager,
+		regChannel:     regChannel,
+	}
+	r.changed()
+	return r
+}
+
+// policyFilePath は反映済みのローカル実行ポリシーファイルのパスを返却するファンクション
+func (r *ConfigReloader) policyFilePath() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return ResolveConfigPath(r.configFilePath, r.agentConfig.PolicyFile)
+}
+
+// changed は前回の確認以降に設定ファイルかローカル実行ポリシーファイルが変更されたかを返却するファンクション
+func (r *ConfigReloader) changed() bool {
+	changed := false
+	for _, file := range []struct {
+		path  string
+		stamp *fileStamp
+	}{
+		{r.configFilePath, &r.configStamp},
+		{r.policyFilePath(), &r.policyStamp},
+	} {
+		stamp, err := statFile(file.path)
+		if err != nil {
+			logging.Debug("Could not stat the file.", logging.Fields{"path": file.path, "error": err})
+			continue
+		}
+		if !stamp.modTime.Equal(file.stamp.modTime) || stamp.size != file.stamp.size {
+			*file.stamp = stamp
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Run はconfigReloadPollSecsごとに設定ファイルとローカル実行ポリシーファイルの変更を確認して再読み込みするファンクション
+// reloadChannelで要求された場合(SIGHUPなど)は変更の有無にかかわらず再読み込みする
+func (r *ConfigReloader) Run(reloadChannel <-chan string) {
+	ticker := time.NewTicker(time.Second * configReloadPollSecs)
+	defer ticker.Stop()
+
+	for {
+		source := "file"
+		select {
+		case source = <-reloadChannel:
+			r.changed()
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+		}
+		r.Reload(source)
+	}
+}
+
+// Reload は設定を再読み込みして実行中に反映できる設定値を反映するファンクション。sourceは契機としてログに記録する
+// 設定値に問題がある場合は何も反映せずにエラーを返却する
+func (r *ConfigReloader) Reload(source string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	logging.Info("Reloading the config.", logging.Fields{"path": r.configFilePath, "source": source})
+	serverConfig, agentConfig, err := GetConfig(r.configFilePath, r.cmdlineConfig, make(chan error, 1))
+	if err != nil {
+		logging.Error("Rejected the reloaded config. Keeping the current config.", logging.Fields{"error": err})
+		return err
+	}
+	if problems := ValidateConfig(r.configFilePath, serverConfig, agentConfig); len(problems) > 0 {
+		messages := make([]string, len(problems))
+		for i, problem := range problems {
+			messages[i] = problem.Error()
+		}
+		logging.Error("Rejected the reloaded config. Keeping the current config.", logging.Fields{"problems": messages})
+		return errors.New("Invalid config values: " + strings.Join(messages, " "))
+	}
+	// ポリシーファイルの内容は設定値の検証では確認しないため、反映する前に読み込んで検証する
+	policyFilePath := ResolveConfigPath(r.configFilePath, agentConfig.PolicyFile)
+	policy, err := readPolicy(policyFilePath)
+	if err != nil {
+		logging.Error("Rejected the reloaded config. Keeping the current config.", logging.Fields{"path": policyFilePath, "error": err})
+		return err
+	}
+
+	old := Config{Server: r.serverConfig.get(), Agent: r.agentConfig}
+	reloaded := Config{Server: serverConfig, Agent: agentConfig}
+	changed, restartRequired := diffConfigs(&old, &reloaded)
+
+	// ログの設定を最初に反映し、以降のログを新しい出力先に出力する
+	oldLogConfig := GetLogConfig(r.configFilePath, old.Agent)
+	newLogConfig := GetLogConfig(r.configFilePath, reloaded.Agent)
+	if !reflect.DeepEqual(oldLogConfig, newLogConfig) || old.Agent.DebugMode != reloaded.Agent.DebugMode {
+		if err := logging.SetupLogger(newLogConfig, reloaded.Agent.DebugMode, ErrorsChannel); err != nil {
+			logging.Error("Could not apply the reloaded log config. Keeping the current log config.", logging.Fields{"error": err})
+			reloaded.Agent.LogFile = old.Agent.LogFile
+			reloaded.Agent.LogFormat = old.Agent.LogFormat
+			reloaded.Agent.LogSinks = old.Agent.LogSinks
+			reloaded.Agent.DebugMode = old.Agent.DebugMode
+		}
+	}
+	logging.SetLevelResetDuration(time.Second * time.Duration(reloaded.Agent.LogLevelResetSecs))
+	setPolicy(policy, policyFilePath)
+	if err := ConfigureExecution(reloaded.Agent.Execution); err != nil {
+		logging.Error("Could not apply the reloaded execution settings.", logging.Fields{"error": err})
+		reloaded.Agent.Execution = old.Agent.Execution
+	}
+	// Serverが指示したポーリング間隔を上書きしないように、設定ファイルの値が変更された場合だけ反映する
+	if reloaded.Agent.PollIntervalSecs != old.Agent.PollIntervalSecs {
+		ConfigurePollInterval(reloaded.Agent.PollIntervalSecs)
+	}
+
+	ConfigureMaxEventAge(reloaded.Agent.MaxEventAgeSecs)
+
+	// ServerConfigとAssignedHostnameはServerに送信するため、変更した場合は再AgentRegistrationする
+	reregister := false
+	if reloaded.Server != old.Server {
+		r.serverConfig.update(reloaded.Server)
+		reregister = true
+	}
+	if reloaded.Agent.AssignedHostname != old.Agent.AssignedHostname {
+		r.regManager.setAssignedHostname(reloaded.Agent.AssignedHostname)
+		reregister = true
+	}
+	if reregister {
+		select {
+		case r.regChannel <- time.Now():
+		default:
+			logging.Warn("Re-registration is already pending.", nil)
+		}
+	}
+
+	if len(restartRequired) > 0 {
+		logging.Warn("Some config changes require restarting the agent to take effect.", logging.Fields{"keys": restartRequired})
+	}
+	r.agentConfig = reloaded.Agent
+	logging.Info("Reloaded the config.", logging.Fields{"changed": changed, "reregister": reregister})
+	LogConfigSources(reloaded.Server, reloaded.Agent)
+	return nil
+}
+
+// diffConfigs は変更された設定値のパスを返却するファンクション
+// 実行中に反映できない設定値はrestartRequiredとして返却し、reloadedの値を変更前の値に戻す
+func diffConfigs(old *Config, reloaded *Config) (changed []string, restartRequired []string) {
+	oldFields := walkConfigFields(reflect.ValueOf(old).Elem(), nil, nil)
+	newFields := walkConfigFields(reflect.ValueOf(reloaded).Elem(), nil, nil)
+	for i, field := range newFields {
+		if reflect.DeepEqual(field.value.Interface(), oldFields[i].value.Interface()) {
+			continue
+		}
+		path := strings.Join(field.path, ".")
+		if isLiveConfigPath(path) {
+			changed = append(changed, path)
+			continue
+		}
+		restartRequired = append(restartRequired, path)
+		field.value.Set(oldFields[i].value)
+	}
+	return changed, restartRequired
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeReloadTestConfig は設定ファイルとローカル実行ポリシーファイルを書き込むファンクション
+func writeReloadTestConfig(t *testing.T, dir string, pollIntervalSecs int, policy Policy) string {
+	config := map[string]interface{}{
+		"Server": map[string]interface{}{"EndPoint": "server.example.com", "APIKey": "key"},
+		"Agent": map[string]interface{}{
+			"LogFile":          filepath.Join(dir, "agent.log"),
+			"PolicyFile":       "policy.json",
+			"PollIntervalSecs": pollIntervalSecs,
+		},
+	}
+	for name, value := range map[string]interface{}{"agent.json": config, "policy.json": policy} {
+		content, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "agent.json")
+}
+
+// newTestConfigReloader は設定ファイルを読み込んで起動時と同じように反映したConfigReloaderを生成するファンクション
+func newTestConfigReloader(t *testing.T, configFilePath string) *ConfigReloader {
+	serverConfig, agentConfig, err := GetConfig(configFilePath, ServerConfig{}, make(chan error, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadPolicy(ResolveConfigPath(configFilePath, agentConfig.PolicyFile)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setPolicy(nil, "") })
+	ConfigurePollInterval(agentConfig.PollIntervalSecs)
+	regManager := NewRegistrationManager(HostMetaData{}, &serverConfig, nil)
+	return NewConfigReloader(configFilePath, ServerConfig{}, &serverConfig, agentConfig, regManager, make(chan time.Time, 1))
+}
+
+func TestReloadKeepsServerPollInterval(t *testing.T) {
+	dir := t.TempDir()
+	configFilePath := writeReloadTestConfig(t, dir, 20, Policy{})
+	reloader := newTestConfigReloader(t, configFilePath)
+
+	// Serverがハートビートで指示したポーリング間隔
+	agentState.Lock()
+	agentState.pollInterval = time.Second * 5
+	agentState.Unlock()
+
+	if err := reloader.Reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	if interval := getPollInterval(); interval != time.Second*5 {
+		t.Errorf("poll interval = %v, the server-set interval should be kept", interval)
+	}
+
+	writeReloadTestConfig(t, dir, 30, Policy{})
+	if err := reloader.Reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	if interval := getPollInterval(); interval != time.Second*30 {
+		t.Errorf("poll interval = %v, want the changed config value", interval)
+	}
+}
+
+func TestReloadDetectsPolicyFileChange(t *testing.T) {
+	dir := t.TempDir()
+	configFilePath := writeReloadTestConfig(t, dir, 0, Policy{})
+	reloader := newTestConfigReloader(t, configFilePath)
+	if reloader.changed() {
+		t.Error("nothing should be changed right after the start")
+	}
+
+	policy := Policy{AllowedActionTypes: []string{actionTypeExec}}
+	content, err := json.Marshal(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyFilePath := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(policyFilePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(policyFilePath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !reloader.changed() {
+		t.Fatal("policy file change should be detected")
+	}
+	if err := reloader.Reload("file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := getPolicy().check(&Event{ActionType: actionTypeScript, RawCommand: "true"}); err == nil {
+		t.Error("reloaded policy should deny script actions")
+	}
+}
@@ -0,0 +1,282 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// Runbook取得の定数
+const (
+	// RunbookSourceGithub はGitHub API(またはGitHub互換のHTTPサーバ)からRunbookを取得する(デフォルト)
+	RunbookSourceGithub = "github"
+	// RunbookSourceGit はローカルのGitリポジトリからRunbookを取得する
+	RunbookSourceGit = "git"
+
+	defaultGithubAPIURL   = "https://api.github.com"
+	defaultRunbookRef     = "master"
+	runbookCacheDirName   = "runbooks"
+	runbookRequestTimeout = 30
+)
+
+// runbookNameRegex はRunbook名として許可する文字列の正規表現
+var runbookNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+
+// repositoryRegex はリポジトリ名(owner/repo)の正規表現
+var repositoryRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+// runbookRefRegex はブランチ名やタグ名として許可する文字列の正規表現
+// gitのオプションと解釈されないように"-"で始まるものは許可しない
+var runbookRefRegex = regexp.MustCompile(`^[A-Za-z0-9_.][A-Za-z0-9_./-]*$`)
+
+// commitSHARegex はコミットSHAの正規表現
+var commitSHARegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// errRunbookNotFound はリポジトリにRunbookのファイルがない場合のエラー
+var errRunbookNotFound = errors.New("Runbook is not found.")
+
+// RunbookSource はリポジトリからRunbookを取得するインタフェース
+type RunbookSource interface {
+	// ResolveCommit はブランチ名やタグ名をコミットSHAに解決する
+	ResolveCommit(repository, ref string) (string, error)
+	// Fetch はコミットSHA時点のファイルの内容を取得する。ファイルがない場合はerrRunbookNotFoundを返却する
+	Fetch(repository, commit, path string) ([]byte, error)
+}
+
+// githubRunbookSource はGitHub APIからRunbookを取得する構造体
+// テストではapiURLにGitHub互換のローカルHTTPサーバを指定できる
+type githubRunbookSource struct {
+	apiURL string
+	client *http.Client
+}
+
+// get はGitHub APIにHTTP GETしてレスポンス本文を取得するファンクション
+func (s *githubRunbookSource) get(url, accept string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+
+	logging.Debug("Querying the runbook repository.", logging.Fields{"url": url})
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errRunbookNotFound
+	}
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		return nil, errors.New("Server returned unexpected status: " + strconv.Itoa(resp.StatusCode))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ResolveCommit はGitHub APIでブランチ名やタグ名をコミットSHAに解決するファンクション
+func (s *githubRunbookSource) ResolveCommit(repository, ref string) (string, error) {
+	body, err := s.get(strings.Join([]string{s.apiURL, "repos", repository, "commits", ref}, slash), "application/vnd.github.v3.sha")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Fetch はGitHub APIでコミットSHA時点のファイルの内容を取得するファンクション
+func (s *githubRunbookSource) Fetch(repository, commit, path string) ([]byte, error) {
+	return s.get(strings.Join([]string{s.apiURL, "repos", repository, "contents", path}, slash)+"?ref="+commit, "application/vnd.github.v3.raw")
+}
+
+// gitRunbookSource はbaseDir/owner/repoにあるローカルのGitリポジトリからRunbookを取得する構造体
+type gitRunbookSource struct {
+	baseDir string
+}
+
+// git はリポジトリのディレクトリでgitコマンドを実行するファンクション
+func (s *gitRunbookSource) git(repository string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", filepath.Join(s.baseDir, repository)}, args...)...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New("git " + args[0] + " failed: " + strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// ResolveCommit はgit rev-parseでブランチ名やタグ名をコミットSHAに解決するファンクション
+func (s *gitRunbookSource) ResolveCommit(repository, ref string) (string, error) {
+	out, err := s.git(repository, "rev-parse", "--verify", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Fetch はgit showでコミットSHA時点のファイルの内容を取得するファンクション
+func (s *gitRunbookSource) Fetch(repository, commit, path string) ([]byte, error) {
+	out, err := s.git(repository, "show", commit+":"+path)
+	if err != nil {
+		return nil, errRunbookNotFound
+	}
+	return out, nil
+}
+
+// runbookFetcher はRunbookを取得してコミットSHAごとにキャッシュする構造体
+type runbookFetcher struct {
+	mu       sync.Mutex
+	source   RunbookSource
+	cacheDir string
+}
+
+// runbooks はExecuteActionが使うRunbook取得処理。ConfigureRunbooksで設定する
+var runbooks struct {
+	sync.RWMutex
+	fetcher *runbookFetcher
+}
+
+// ConfigureRunbooks はAgentConfigに応じてRunbookの取得元を設定するファンクション
+// 取得したRunbookはstateDir/runbooksにキャッシュする
+func ConfigureRunbooks(agentConfig *AgentConfig, stateDir string) error {
+	var source RunbookSource
+	switch agentConfig.RunbookSource {
+	case "", RunbookSourceGithub:
+		apiURL := agentConfig.RunbookSourceURL
+		if len(apiURL) == 0 {
+			apiURL = defaultGithubAPIURL
+		}
+		source = &githubRunbookSource{
+			apiURL: strings.TrimRight(apiURL, slash),
+			client: &http.Client{Timeout: time.Second * runbookRequestTimeout},
+		}
+	case RunbookSourceGit:
+		if len(agentConfig.RunbookSourceURL) == 0 {
+			return errors.New("Runbook source directory is missing.")
+		}
+		source = &gitRunbookSource{baseDir: agentConfig.RunbookSourceURL}
+	default:
+		return errors.New("Unsupported runbook source: " + agentConfig.RunbookSource)
+	}
+
+	runbooks.Lock()
+	runbooks.fetcher = &runbookFetcher{source: source, cacheDir: filepath.Join(stateDir, runbookCacheDirName)}
+	runbooks.Unlock()
+	return nil
+}
+
+// runbookCandidatePaths はRunbook名からリポジトリ内で探すファイルパスを優先順に返却するファンクション
+func runbookCandidatePaths(name string) []string {
+	return []string{
+		"runbooks/" + name + ".sh",
+		"runbooks/" + name,
+		name + ".sh",
+		name,
+	}
+}
+
+// verifyChecksum はRunbookの内容のSHA-256がEventのChecksumと一致するかを検証するファンクション
+// Eventは署名されているため、Checksumが一致すればRunbookは改ざんされていない
+func verifyChecksum(content []byte, checksum string) error {
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(checksum) {
+		return errors.New("Runbook checksum does not match.")
+	}
+	return nil
+}
+
+// resolve はEventのRunbookを取得して検証し、キャッシュしたファイルパスを返却するファンクション
+func (f *runbookFetcher) resolve(event *Event) (string, error) {
+	if !repositoryRegex.MatchString(event.GithubFilePath) {
+		return "", errors.New("Invalid runbook repository: " + event.GithubFilePath)
+	}
+	if !runbookNameRegex.MatchString(event.RunbookName) || strings.Contains(event.RunbookName, "..") {
+		return "", errors.New("Invalid runbook name: " + event.RunbookName)
+	}
+	if len(event.Checksum) == 0 {
+		return "", errors.New("Event does not have runbook checksum.")
+	}
+
+	ref := event.GithubRef
+	if len(ref) == 0 {
+		ref = defaultRunbookRef
+	}
+	if !runbookRefRegex.MatchString(ref) || strings.Contains(ref, "..") {
+		return "", errors.New("Invalid runbook ref: " + ref)
+	}
+	commit, err := f.source.ResolveCommit(event.GithubFilePath, ref)
+	if err != nil {
+		return "", err
+	}
+	if !commitSHARegex.MatchString(commit) {
+		return "", errors.New("Invalid commit SHA: " + commit)
+	}
+
+	// 同じRunbookを並列に取得しないようにキャッシュの読み書きは排他する
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cachePath := filepath.Join(f.cacheDir, commit, filepath.FromSlash(event.RunbookName))
+	if content, err := ioutil.ReadFile(cachePath); err == nil {
+		if err := verifyChecksum(content, event.Checksum); err != nil {
+			return "", err
+		}
+		logging.Debug("Using the cached runbook.", logging.Fields{"runbookName": event.RunbookName, "commit": commit})
+		return cachePath, nil
+	}
+
+	for _, path := range runbookCandidatePaths(event.RunbookName) {
+		content, err := f.source.Fetch(event.GithubFilePath, commit, path)
+		if err == errRunbookNotFound {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if err := verifyChecksum(content, event.Checksum); err != nil {
+			return "", err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+			return "", err
+		}
+		tmpPath := cachePath + ".tmp"
+		if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmpPath, cachePath); err != nil {
+			return "", err
+		}
+		logging.Info("Downloaded the runbook.", logging.Fields{
+			"repository":  event.GithubFilePath,
+			"commit":      commit,
+			"path":        path,
+			"runbookName": event.RunbookName,
+		})
+		return cachePath, nil
+	}
+	return "", errors.New("Runbook is not found in the repository: " + event.RunbookName)
+}
+
+// resolveRunbook は設定済みのRunbook取得処理でEventのRunbookを取得するファンクション
+func resolveRunbook(event *Event) (string, error) {
+	runbooks.RLock()
+	fetcher := runbooks.fetcher
+	runbooks.RUnlock()
+
+	if fetcher == nil {
+		return "", errors.New("Runbook source is not configured.")
+	}
+	return fetcher.resolve(event)
+}
@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeRunbookSource はブランチ名とコミットSHA時点のファイルをメモリに保持するRunbookSource
+type fakeRunbookSource struct {
+	commits map[string]string // ブランチ名 → コミットSHA
+	files   map[string]string // "コミットSHA:パス" → 内容
+	fetches int
+}
+
+func (s *fakeRunbookSource) ResolveCommit(repository, ref string) (string, error) {
+	return s.commits[ref], nil
+}
+
+func (s *fakeRunbookSource) Fetch(repository, commit, path string) ([]byte, error) {
+	s.fetches++
+	content, ok := s.files[commit+":"+path]
+	if !ok {
+		return nil, errRunbookNotFound
+	}
+	return []byte(content), nil
+}
+
+func checksumOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+const (
+	testCommitA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	testCommitB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func newRunbookTestEvent(ref, checksum string) *Event {
+	return &Event{EventID: "event", GithubFilePath: "owner/repo", GithubRef: ref, RunbookName: "restart", Checksum: checksum}
+}
+
+func TestRunbookFetcherCachesBySHA(t *testing.T) {
+	source := &fakeRunbookSource{
+		commits: map[string]string{"master": testCommitA, "release": testCommitB},
+		files: map[string]string{
+			testCommitA + ":runbooks/restart.sh": "echo a\n",
+			testCommitB + ":runbooks/restart.sh": "echo b\n",
+		},
+	}
+	fetcher := &runbookFetcher{source: source, cacheDir: t.TempDir()}
+
+	path, err := fetcher.resolve(newRunbookTestEvent("", checksumOf("echo a\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(filepath.Dir(path)) != testCommitA {
+		t.Errorf("cache path %s should be under the commit SHA", path)
+	}
+	if _, err := fetcher.resolve(newRunbookTestEvent("master", checksumOf("echo a\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if source.fetches != 1 {
+		t.Errorf("fetches = %d, want 1 for the cached commit", source.fetches)
+	}
+
+	// ブランチが別のコミットを指す場合は取得し直す
+	path, err = fetcher.resolve(newRunbookTestEvent("release", checksumOf("echo b\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "echo b\n" {
+		t.Errorf("content = %q", content)
+	}
+	if source.fetches != 2 {
+		t.Errorf("fetches = %d, want 2", source.fetches)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm()&0077 != 0 {
+		t.Errorf("cached runbook should be private: %v %v", info.Mode(), err)
+	}
+}
+
+func TestRunbookFetcherChecksumMismatch(t *testing.T) {
+	source := &fakeRunbookSource{
+		commits: map[string]string{"master": testCommitA},
+		files:   map[string]string{testCommitA + ":runbooks/restart.sh": "echo a\n"},
+	}
+	fetcher := &runbookFetcher{source: source, cacheDir: t.TempDir()}
+
+	if _, err := fetcher.resolve(newRunbookTestEvent("", checksumOf("echo tampered\n"))); err == nil {
+		t.Fatal("checksum mismatch should be an error")
+	}
+	if _, err := os.Stat(filepath.Join(fetcher.cacheDir, testCommitA)); !os.IsNotExist(err) {
+		t.Error("runbook with a checksum mismatch should not be cached")
+	}
+
+	// キャッシュが書き換えられた場合も実行しない
+	path, err := fetcher.resolve(newRunbookTestEvent("", checksumOf("echo a\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("echo tampered\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetcher.resolve(newRunbookTestEvent("", checksumOf("echo a\n"))); err == nil {
+		t.Error("tampered cache should be an error")
+	}
+}
+
+func TestRunbookFetcherRejectsInvalidRefs(t *testing.T) {
+	source := &fakeRunbookSource{commits: map[string]string{}}
+	fetcher := &runbookFetcher{source: source, cacheDir: t.TempDir()}
+	for _, ref := range []string{"-c", "--output=/tmp/x", "../../evil", "master;id", "master branch"} {
+		if _, err := fetcher.resolve(newRunbookTestEvent(ref, checksumOf(""))); err == nil || !strings.Contains(err.Error(), "ref") {
+			t.Errorf("%q: err = %v, want invalid ref", ref, err)
+		}
+	}
+}
+
+func TestGitRunbookSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	baseDir := t.TempDir()
+	repoDir := filepath.Join(baseDir, "owner", "repo")
+	if err := os.MkdirAll(filepath.Join(repoDir, "runbooks"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repoDir, "runbooks", "restart.sh"), []byte("echo git\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "runbooks"},
+		{"branch", "-f", "release"},
+	} {
+		cmd := exec.Command("git", append([]string{"-C", repoDir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+	}
+
+	source := &gitRunbookSource{baseDir: baseDir}
+	commit, err := source.ResolveCommit("owner/repo", "release")
+	if err != nil || !commitSHARegex.MatchString(commit) {
+		t.Fatalf("commit = %q, err = %v", commit, err)
+	}
+	if _, err := source.ResolveCommit("owner/repo", "--output=x"); err == nil {
+		t.Error("option-like ref should not be resolved")
+	}
+	content, err := source.Fetch("owner/repo", commit, "runbooks/restart.sh")
+	if err != nil || string(content) != "echo git\n" {
+		t.Errorf("content = %q, err = %v", content, err)
+	}
+	if _, err := source.Fetch("owner/repo", commit, "runbooks/missing.sh"); err != errRunbookNotFound {
+		t.Errorf("missing file: err = %v, want errRunbookNotFound", err)
+	}
+}
+
+func TestGithubRunbookSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repos/owner/repo/commits/master" && r.Header.Get("Accept") == "application/vnd.github.v3.sha":
+			w.Write([]byte(testCommitA))
+		case r.URL.Path == "/repos/owner/repo/contents/runbooks/restart.sh" && r.URL.Query().Get("ref") == testCommitA:
+			w.Write([]byte("echo github\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source := &githubRunbookSource{apiURL: server.URL, client: server.Client()}
+	fetcher := &runbookFetcher{source: source, cacheDir: t.TempDir()}
+	path, err := fetcher.resolve(newRunbookTestEvent("master", checksumOf("echo github\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "echo github\n" {
+		t.Errorf("content = %q", content)
+	}
+}
+
+func TestScriptActionRunsRunbookOverStdin(t *testing.T) {
+	script := "echo runbook \"$0\"\n"
+	source := &fakeRunbookSource{
+		commits: map[string]string{"master": testCommitA},
+		files:   map[string]string{testCommitA + ":runbooks/restart.sh": script},
+	}
+	runbooks.Lock()
+	runbooks.fetcher = &runbookFetcher{source: source, cacheDir: t.TempDir()}
+	runbooks.Unlock()
+	defer func() {
+		runbooks.Lock()
+		runbooks.fetcher = nil
+		runbooks.Unlock()
+	}()
+
+	event := newRunbookTestEvent("", checksumOf(script))
+	event.ActionType = actionTypeScript
+	result, err := ExecuteAction(event)
+	if err != nil || result.Status != ActionStatusSucceeded {
+		t.Fatalf("status = %s, err = %v, stderr = %s", result.Status, err, result.Stderr)
+	}
+	if result.Stdout != "runbook "+shellPath+"\n" {
+		t.Errorf("stdout = %q", result.Stdout)
+	}
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// redactedSecret はログなどにSecretの値の代わりに出力する文字列
+const redactedSecret = "<redacted>"
+
+// Secret はAPIキーなどのログに出力してはならない値の型
+// fmtとlogrusのフォーマット、JSONへの変換では値を出力しない。値はValueで取得する
+type Secret string
+
+// Value はSecretの値を返却するファンクション。Serverへの送信など値が必要な場合にだけ使う
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String は値を出力せずに、空でない場合は"<redacted>"を返却するファンクション
+func (s Secret) String() string {
+	if len(s) == 0 {
+		return ""
+	}
+	return redactedSecret
+}
+
+// GoString は%#vで出力した場合も値を出力しないようにするファンクション
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalJSON はJSONに変換する場合も値を出力しないようにするファンクション
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// resolveAPIKey はAPIKeyが空の場合にAPIKeyFileのファイル、APIKeyEnvの環境変数の順にAPIキーを読み込むファンクション
+// APIKeyFileが相対パスの場合は設定ファイルのディレクトリからのパス。ファイルの前後の空白と改行は取り除く
+func resolveAPIKey(configFilePath string, serverConfig *ServerConfig, sources configSources) error {
+	if len(serverConfig.APIKey) > 0 {
+		return nil
+	}
+	if len(serverConfig.APIKeyFile) > 0 {
+		path := ResolveConfigPath(configFilePath, serverConfig.APIKeyFile)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.New("Could not read the API key file: " + err.Error())
+		}
+		key := strings.TrimSpace(string(content))
+		if len(key) == 0 {
+			return errors.New("The API key file is empty: " + path)
+		}
+		serverConfig.APIKey = Secret(key)
+		sources["Server.APIKey"] = configSourceKeyFile
+		return nil
+	}
+	if len(serverConfig.APIKeyEnv) > 0 {
+		key := strings.TrimSpace(os.Getenv(serverConfig.APIKeyEnv))
+		if len(key) == 0 {
+			return errors.New("The API key environment variable is not set: " + serverConfig.APIKeyEnv)
+		}
+		serverConfig.APIKey = Secret(key)
+		sources["Server.APIKey"] = configSourceKeyEnv
+	}
+	return nil
+}
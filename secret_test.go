@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretRedaction(t *testing.T) {
+	config := ServerConfig{APIKey: Secret("super-secret"), EndPoint: "api.example.com"}
+
+	outputs := map[string]string{
+		"String":   config.APIKey.String(),
+		"%v":       fmt.Sprintf("%v", config),
+		"%+v":      fmt.Sprintf("%+v", config),
+		"%#v":      fmt.Sprintf("%#v", config),
+		"%s field": fmt.Sprintf("%s", config.APIKey),
+	}
+	raw, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	outputs["JSON"] = decoded["APIKey"]
+
+	for name, output := range outputs {
+		if strings.Contains(output, "super-secret") {
+			t.Errorf("%s leaks the secret: %s", name, output)
+		}
+		if !strings.Contains(output, redactedSecret) {
+			t.Errorf("%s does not show the redacted marker: %s", name, output)
+		}
+	}
+	if config.APIKey.Value() != "super-secret" {
+		t.Errorf("Value = %q, want the secret", config.APIKey.Value())
+	}
+	if Secret("").String() != "" {
+		t.Error("empty secret should be shown as empty")
+	}
+}
+
+func TestResolveAPIKeyPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	configFilePath := filepath.Join(dir, "agent.json")
+	if err := ioutil.WriteFile(filepath.Join(dir, "api_key"), []byte("  from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "empty_key"), []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TEST_AGENT_API_KEY", "from-env")
+	defer os.Unsetenv("TEST_AGENT_API_KEY")
+
+	tests := []struct {
+		name   string
+		config ServerConfig
+		want   string
+		source string
+		fails  bool
+	}{
+		{"APIKey wins", ServerConfig{APIKey: "direct", APIKeyFile: "api_key", APIKeyEnv: "TEST_AGENT_API_KEY"}, "direct", configSourceFile, false},
+		{"file before env", ServerConfig{APIKeyFile: "api_key", APIKeyEnv: "TEST_AGENT_API_KEY"}, "from-file", configSourceKeyFile, false},
+		{"absolute file", ServerConfig{APIKeyFile: filepath.Join(dir, "api_key")}, "from-file", configSourceKeyFile, false},
+		{"env", ServerConfig{APIKeyEnv: "TEST_AGENT_API_KEY"}, "from-env", configSourceKeyEnv, false},
+		{"missing file", ServerConfig{APIKeyFile: "missing", APIKeyEnv: "TEST_AGENT_API_KEY"}, "", "", true},
+		{"empty file", ServerConfig{APIKeyFile: "empty_key"}, "", "", true},
+		{"unset env", ServerConfig{APIKeyEnv: "TEST_AGENT_API_KEY_UNSET"}, "", "", true},
+		{"nothing", ServerConfig{}, "", configSourceFile, false},
+	}
+	for _, test := range tests {
+		config := test.config
+		sources := configSources{"Server.APIKey": configSourceFile}
+		err := resolveAPIKey(configFilePath, &config, sources)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: resolveAPIKey should fail", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if config.APIKey.Value() != test.want || sources["Server.APIKey"] != test.source {
+			t.Errorf("%s: APIKey = %q from %s, want %q from %s", test.name, config.APIKey.Value(), sources["Server.APIKey"], test.want, test.source)
+		}
+	}
+}
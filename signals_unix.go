@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// WatchLogLevelSignals はシグナルでログレベルを変更するファンクション
+// SIGUSR1で1段階詳細なログレベル(info、debug、traceの順)に変更し、SIGUSR2で設定ファイルによるログレベルに戻す
+func WatchLogLevelSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			if err := logging.RaiseLevel("SIGUSR1"); err != nil {
+				logging.Warn("Could not change the log level.", logging.Fields{"error": err})
+			}
+		case syscall.SIGUSR2:
+			logging.ResetLevel("SIGUSR2")
+		}
+	}
+}
+
+// WatchReloadSignals はSIGHUPを受け取るたびにreloadChannelで設定の再読み込みを要求するファンクション
+func WatchReloadSignals(reloadChannel chan<- string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		select {
+		case reloadChannel <- "SIGHUP":
+		default:
+			logging.Debug("Config reload is already pending.", nil)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package agent
+
+// WatchLogLevelSignals はWindowsにはSIGUSR1とSIGUSR2がないため何もしないファンクション
+// ログレベルはローカル制御エンドポイントかServerからの指示で変更する
+func WatchLogLevelSignals() {}
+
+// WatchReloadSignals はWindowsにはSIGHUPがないため何もしないファンクション
+// 設定ファイルの変更はConfigReloaderが定期的に確認して再読み込みする
+func WatchReloadSignals(reloadChannel chan<- string) {}
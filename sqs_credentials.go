@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	// registrationProviderName はAgent登録情報のAWS認証情報を示すプロバイダ名
+	registrationProviderName = "RegistrationProvider"
+	// credentialsRefreshWindow はAWS一時認証情報の期限切れ前に再AgentRegistrationを行う猶予時間
+	credentialsRefreshWindow = time.Minute * 5
+)
+
+// registrationCredentialsProvider はAgent登録情報のAWS認証情報を返却するプロバイダの構造体
+// RegistrationManagerが再AgentRegistrationで認証情報を入れ替えると期限切れとして扱われ、次のリクエストで新しい認証情報が使われる
+type registrationCredentialsProvider struct {
+	regManager *RegistrationManager
+	retrieved  *RegistrationInfo
+}
+
+// Retrieve はAgent登録情報からAWS認証情報を取得するファンクション
+// Agent登録情報にAWS認証情報がない場合はエラーを返却して、チェーンの次のプロバイダに任せる
+func (p *registrationCredentialsProvider) Retrieve() (credentials.Value, error) {
+	regInfo := p.regManager.Get()
+	if len(regInfo.AWSAccessKey) == 0 || len(regInfo.AWSSecretAccessKey) == 0 {
+		return credentials.Value{ProviderName: registrationProviderName},
+			errors.New("Registration info does not have AWS credentials.")
+	}
+	p.retrieved = regInfo
+	return credentials.Value{
+		AccessKeyID:     regInfo.AWSAccessKey,
+		SecretAccessKey: regInfo.AWSSecretAccessKey,
+		SessionToken:    regInfo.AWSSecurityToken,
+		ProviderName:    registrationProviderName,
+	}, nil
+}
+
+// IsExpired はAgent登録情報が入れ替わったか、AWS一時認証情報の期限が近い場合にtrueを返却するファンクション
+func (p *registrationCredentialsProvider) IsExpired() bool {
+	if p.retrieved == nil || p.retrieved != p.regManager.Get() {
+		return true
+	}
+	expiration := p.retrieved.credentialsExpiration()
+	return !expiration.IsZero() && time.Now().After(expiration)
+}
+
+// credentialsExpiration はAWS一時認証情報の有効期限を返却するファンクション
+// 有効期限がない場合はゼロ値を返却する
+func (regInfo *RegistrationInfo) credentialsExpiration() time.Time {
+	if regInfo.AWSCredentialsExpiration <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, regInfo.AWSCredentialsExpiration*int64(time.Millisecond))
+}
+
+// getSQSCredentials はSQS接続に使うAWS認証情報のチェーンを生成するファンクション
+// 優先順位はAgent登録情報、環境変数、共有認証情報ファイル、EC2インスタンスロールの順
+func getSQSCredentials(regManager *RegistrationManager) *credentials.Credentials {
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&registrationCredentialsProvider{regManager: regManager},
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{},
+		&ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(session.New())},
+	})
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// expirationIn は現在時刻からdの後のAWS一時認証情報の有効期限(ミリ秒)を返却するファンクション
+func expirationIn(d time.Duration) int64 {
+	return time.Now().Add(d).UnixNano() / int64(time.Millisecond)
+}
+
+func TestRegistrationCredentialsProvider(t *testing.T) {
+	t.Cleanup(func() { SetVerificationKeys(nil) })
+	regManager := NewRegistrationManager(HostMetaData{}, &ServerConfig{}, nil)
+	regManager.set(&RegistrationInfo{AgentID: "agent", AWSAccessKey: "AKID", AWSSecretAccessKey: "secret", AWSSecurityToken: "token",
+		AWSCredentialsExpiration: expirationIn(time.Hour)})
+	provider := &registrationCredentialsProvider{regManager: regManager}
+
+	if !provider.IsExpired() {
+		t.Error("provider should be expired before the first retrieve")
+	}
+	value, err := provider.Retrieve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "AKID" || value.SecretAccessKey != "secret" || value.SessionToken != "token" || value.ProviderName != registrationProviderName {
+		t.Errorf("value = %+v", value)
+	}
+	if provider.IsExpired() {
+		t.Error("provider should not be expired before the credentials expire")
+	}
+
+	// 再AgentRegistrationで認証情報を入れ替えた場合は次のリクエストで新しい認証情報を使う
+	regManager.set(&RegistrationInfo{AgentID: "agent", AWSAccessKey: "AKID2", AWSSecretAccessKey: "secret2"})
+	if !provider.IsExpired() {
+		t.Error("provider should be expired after re-registration")
+	}
+	if value, _ := provider.Retrieve(); value.AccessKeyID != "AKID2" {
+		t.Errorf("AccessKeyID = %q, want the new credentials", value.AccessKeyID)
+	}
+
+	regManager.set(&RegistrationInfo{AgentID: "agent", AWSAccessKey: "AKID3", AWSSecretAccessKey: "secret3",
+		AWSCredentialsExpiration: expirationIn(-time.Minute)})
+	provider.Retrieve()
+	if !provider.IsExpired() {
+		t.Error("provider should be expired after the credentials expire")
+	}
+}
+
+func TestSQSCredentialsFallBackToEnvironment(t *testing.T) {
+	t.Cleanup(func() { SetVerificationKeys(nil) })
+	os.Setenv("AWS_ACCESS_KEY_ID", "ENVKEY")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	regManager := NewRegistrationManager(HostMetaData{}, &ServerConfig{}, nil)
+	regManager.set(&RegistrationInfo{AgentID: "agent"})
+	value, err := getSQSCredentials(regManager).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "ENVKEY" || value.SecretAccessKey != "envsecret" {
+		t.Errorf("value = %+v, want the environment credentials", value)
+	}
+
+	regManager.set(&RegistrationInfo{AgentID: "agent", AWSAccessKey: "AKID", AWSSecretAccessKey: "secret"})
+	value, err = getSQSCredentials(regManager).Get()
+	if err != nil || value.AccessKeyID != "AKID" {
+		t.Errorf("value = %+v (%v), want the registration credentials first", value, err)
+	}
+}
+
+func TestCredentialsRefreshTimer(t *testing.T) {
+	t.Cleanup(func() { SetVerificationKeys(nil) })
+	regManager := NewRegistrationManager(HostMetaData{}, &ServerConfig{}, nil)
+
+	regManager.set(&RegistrationInfo{AgentID: "agent"})
+	if timer := regManager.credentialsRefreshTimer(); timer != nil {
+		timer.Stop()
+		t.Error("credentials without expiration should not be refreshed")
+	}
+
+	regManager.set(&RegistrationInfo{AgentID: "agent", AWSCredentialsExpiration: expirationIn(time.Hour)})
+	timer := regManager.credentialsRefreshTimer()
+	if timer == nil {
+		t.Fatal("temporary credentials should be refreshed before they expire")
+	}
+	timer.Stop()
+	if regManager.shortLivedCredentials != 0 {
+		t.Errorf("shortLivedCredentials = %d, want 0", regManager.shortLivedCredentials)
+	}
+
+	// 有効期間がcredentialsRefreshWindowより短い認証情報が続く場合は数える
+	for i := 1; i <= 2; i++ {
+		regManager.set(&RegistrationInfo{AgentID: "agent", AWSCredentialsExpiration: expirationIn(time.Minute)})
+		if regManager.shortLivedCredentials != i {
+			t.Errorf("shortLivedCredentials = %d, want %d", regManager.shortLivedCredentials, i)
+		}
+	}
+}
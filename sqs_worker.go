@@ -3,11 +3,12 @@ package agent
 import (
 	"encoding/json"
 	"net/http"
+	"net/http/httputil"
 	"regexp"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/tsubauaaa/agent/logging"
@@ -30,8 +31,8 @@ var requiredAttributes []*string
 
 func init() {
 	// agentIDおよびsignatureはどのSQSメッセージにも付与される属性情報
-	agentIDAttr := "agentID"
-	signatureAttr := "signature"
+	agentIDAttr := agentIDAttribute
+	signatureAttr := signatureAttribute
 	requiredAttributes = append(requiredAttributes, &agentIDAttr)
 	requiredAttributes = append(requiredAttributes, &signatureAttr)
 }
@@ -94,10 +95,11 @@ func getMessages(svc *sqs.SQS, queue string) (*sqs.ReceiveMessageOutput, error)
 	return resp, nil
 }
 
-// getSQSClient はSQS接続クライアントをAWSアクセスキーおよびAWSシークレットアクセスキーから生成するファンクション
-func getSQSClient(regInfo *RegistrationInfo) *sqs.SQS {
-	creds := credentials.NewStaticCredentials(regInfo.AWSAccessKey, regInfo.AWSSecretAccessKey, regInfo.AWSSecurityToken)
-	region := parseQueueDetails(regInfo.ActionQueueEndpoint)
+// getSQSClient はSQS接続クライアントを生成するファンクション
+// AWS認証情報はAgent登録情報、環境変数、共有認証情報ファイル、EC2インスタンスロールの順に探す
+func getSQSClient(regManager *RegistrationManager) *sqs.SQS {
+	creds := getSQSCredentials(regManager)
+	region := parseQueueDetails(regManager.Get().ActionQueueEndpoint)
 	awsConfig := aws.NewConfig().WithCredentials(creds).
 		WithRegion(region).
 		WithHTTPClient(http.DefaultClient).
@@ -105,112 +107,249 @@ func getSQSClient(regInfo *RegistrationInfo) *sqs.SQS {
 		WithLogger(aws.NewDefaultLogger()).
 		WithLogLevel(aws.LogOff).
 		WithSleepDelay(time.Sleep)
-	return sqs.New(session.New(awsConfig))
+	svc := sqs.New(session.New(awsConfig))
+	addTraceHandlers(&svc.Handlers)
+	return svc
 }
 
-// RunLoop は現在は無限に連続してSQSメッセージを取得しに行ってしまう(getMessagesによって)
+// addTraceHandlers はtraceレベルが有効な場合にSQSとの通信内容をログに出力するハンドラを追加するファンクション
+func addTraceHandlers(handlers *request.Handlers) {
+	handlers.Send.PushFrontNamed(request.NamedHandler{
+		Name: "agent.TraceRequest",
+		Fn: func(r *request.Request) {
+			if !logging.IsTraceEnabled() {
+				return
+			}
+			dump, err := httputil.DumpRequestOut(r.HTTPRequest, true)
+			// ダンプで読み込んだリクエストボディを送信できるように戻す
+			r.ResetBody()
+			if err != nil {
+				logging.Trace("Could not dump the SQS request.", logging.Fields{"error": err})
+				return
+			}
+			logging.Trace("SQS request.", logging.Fields{"operation": r.Operation.Name, "request": string(dump)})
+		},
+	})
+	handlers.Send.PushBackNamed(request.NamedHandler{
+		Name: "agent.TraceResponse",
+		Fn: func(r *request.Request) {
+			if !logging.IsTraceEnabled() || r.HTTPResponse == nil {
+				return
+			}
+			dump, err := httputil.DumpResponse(r.HTTPResponse, true)
+			if err != nil {
+				logging.Trace("Could not dump the SQS response.", logging.Fields{"error": err})
+				return
+			}
+			logging.Trace("SQS response.", logging.Fields{"operation": r.Operation.Name, "response": string(dump)})
+		},
+	})
+}
+
+// sqsQueue はAWS SQSをActionキューとして使う構造体
+type sqsQueue struct {
+	svc   *sqs.SQS
+	queue string
+}
+
+// newSQSQueue はAgent登録情報のSQSエンドポイントに接続するActionキューを生成するファンクション
+func newSQSQueue(regManager *RegistrationManager) *sqsQueue {
+	return &sqsQueue{
+		svc:   getSQSClient(regManager),
+		queue: regManager.Get().ActionQueueEndpoint,
+	}
+}
+
+// Receive はSQSをポーリングしてメッセージを取得するファンクション
+func (q *sqsQueue) Receive() ([]*QueueMessage, error) {
+	resp, err := getMessages(q.svc, q.queue)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*QueueMessage
+	for _, msg := range resp.Messages {
+		attributes := map[string]string{}
+		for name, value := range msg.MessageAttributes {
+			if value.StringValue != nil {
+				attributes[name] = *value.StringValue
+			}
+		}
+		messages = append(messages, &QueueMessage{
+			MessageID:     aws.StringValue(msg.MessageId),
+			ReceiptHandle: aws.StringValue(msg.ReceiptHandle),
+			Body:          aws.StringValue(msg.Body),
+			Attributes:    attributes,
+		})
+	}
+	return messages, nil
+}
+
+// ChangeVisibility はSQSメッセージの可視時間を変更するファンクション
+func (q *sqsQueue) ChangeVisibility(receiptHandle string, timeout int64) error {
+	return changeMessageVisibility(q.svc, q.queue, receiptHandle, timeout)
+}
+
+// Delete はSQSメッセージを削除するファンクション
+func (q *sqsQueue) Delete(receiptHandle string) error {
+	return DeleteMessage(q.svc, q.queue, receiptHandle)
+}
+
+// sleepUnlessStopped はdurationの間かstopChannelが閉じられるまで待つファンクション
+func sleepUnlessStopped(duration time.Duration, stopChannel <-chan struct{}) {
+	select {
+	case <-time.After(duration):
+	case <-stopChannel:
+	}
+}
+
+// RunLoop は現在は無限に連続してActionキューのメッセージを取得しに行ってしまう(ActionQueue.Receiveによって)
 // そのためSleep処理が必要である
-func RunLoop(regInfo *RegistrationInfo, regInfoUpdatesCh <-chan string, eventsChannel chan<- *Event, regChannel chan<- time.Time) {
-	logging.Info("Initializing SQS client.", nil)
-	svc := getSQSClient(regInfo)
-	queue := regInfo.ActionQueueEndpoint
+// Agent登録情報はregManagerから取得し、regInfoUpdatesChで更新を通知されたら取得し直す
+// ActionキューはagentConfigのActionQueueTypeに応じてSQSかローカルキューを使う
+// stopChannelが閉じられるとポーリングを止めて返却する。eventsChannelは閉じないため、呼び出し元が閉じる
+func RunLoop(regManager *RegistrationManager, agentConfig *AgentConfig, regInfoUpdatesCh <-chan string, eventsChannel chan<- *Event, regChannel chan<- time.Time, stopChannel <-chan struct{}) error {
+	regInfo := regManager.Get()
+	queue, err := newActionQueue(agentConfig, regManager)
+	if err != nil {
+		logging.Error("Could not initialize the action queue.", logging.Fields{"error": err})
+		return err
+	}
 
-	// shouldLogErrorはgetMessagesファンクションによるSQSメッセージ取得に失敗となった場合に再AgentRegistrationするか
+	// shouldLogErrorはReceiveによるメッセージ取得に失敗となった場合に再AgentRegistrationするか
 	// を判断する処理に遷移するかを決定するために用いる変数
 	shouldLogError := true
-	// numFailuresはgetMessagesファンクションによるSQSメッセージ取得にnumSQSFailuresBeforeReregistration回数失敗となった場合に
+	// numFailuresはReceiveによるメッセージ取得にnumSQSFailuresBeforeReregistration回数失敗となった場合に
 	// 再度AgentRegistrationするかを判断する処理で用いる変数
 	numFailures := 0
 	for {
-		//shouldSleepはAgentのSQSメッセージがない場合のSleep制御のための変数。AgentのSQSメッセージが存在する場合はfalseになる
+		//shouldSleepはAgentのメッセージがない場合のSleep制御のための変数。Agentのメッセージが存在する場合はfalseになる
 		shouldSleep := true
 		select {
 
-		// Agent登録情報が変更される、もしくはSQSクライアントが初期化される場合
+		// Agentの停止時はポーリングを止める
+		case <-stopChannel:
+			logging.Info("Stopped polling the action queue.", nil)
+			return nil
+
+		// Agent登録情報が変更される、もしくはActionキューが初期化される場合
 		case <-regInfoUpdatesCh:
-			logging.Info("Initializing SQS client.", nil)
-			svc = getSQSClient(regInfo)
-			queue = regInfo.ActionQueueEndpoint
+			regInfo = regManager.Get()
+			if q, err := newActionQueue(agentConfig, regManager); err == nil {
+				queue = q
+			} else {
+				logging.Error("Could not initialize the action queue.", logging.Fields{"error": err})
+			}
 
 		default:
-			//getMessagesファンクションによるSQSメッセージ取得開始時刻のための変数
+			// ServerからAction実行の一時停止を指示されている場合はポーリングしない
+			if isActionExecutionPaused() {
+				logging.Debug("Action execution is paused. Skipping the poll.", nil)
+				sleepUnlessStopped(getPollInterval(), stopChannel)
+				continue
+			}
+
+			//Receiveによるメッセージ取得開始時刻のための変数
 			t1 := time.Now()
-			if resp, err := getMessages(svc, queue); err == nil {
+			if messages, err := queue.Receive(); err == nil {
 				shouldLogError = true
 				numFailures = 0
 				//Agentステータス更新処理
-				logging.Debug("Received messages.", logging.Fields{"count": len(resp.Messages)})
+				recordSuccessfulPoll()
+				logging.Debug("Received messages.", logging.Fields{"count": len(messages)})
 
-				for _, msg := range resp.Messages {
-					bodyStr := *msg.Body // SQSメッセージVerifyで使う
-					messageID := *msg.MessageId
+				for _, msg := range messages {
+					bodyStr := msg.Body // メッセージVerifyで使う
+					messageID := msg.MessageID
 
-					//SQSメッセージ属性であるagentIDがあることをチェック
-					agentID, ok := msg.MessageAttributes["agentID"]
+					//メッセージ属性であるagentIDがあることをチェック
+					agentID, ok := msg.Attributes[agentIDAttribute]
 					if !ok {
 						logging.Error("Received message does not have agentID attributes.", logging.Fields{"msgID": messageID})
 						continue
 					}
-					//SQSメッセージ属性agentIDとAgent登録情報内のAgentIDとを照合
-					if regInfo.AgentID == *agentID.StringValue {
+					//メッセージ属性agentIDとAgent登録情報内のAgentIDとを照合
+					if regInfo.AgentID == agentID {
 						logging.Debug("Received a message for me. Checking message integrity.", nil)
 
-						signature, ok := msg.MessageAttributes["signature"]
+						signature, ok := msg.Attributes[signatureAttribute]
 						if !ok {
 							logging.Error("Received message does not have signature attributes.", logging.Fields{"msgID": messageID})
 							continue
 						}
 
-						if valid, e := VerifyMessage(bodyStr, *signature.StringValue); valid && e == nil {
+						if valid, e := VerifyMessage(bodyStr, signature); valid && e == nil {
 							var event Event
 							err := json.Unmarshal([]byte(bodyStr), &event)
 							if err != nil {
-								logging.Error("Cloud not deserialize the SQS message.", logging.Fields{"error": err})
+								logging.Error("Cloud not deserialize the message.", logging.Fields{"error": err})
 							} else {
 								event.SQSMessageID = messageID
-								event.ReceiptHandle = *msg.ReceiptHandle
+								event.ReceiptHandle = msg.ReceiptHandle
+								event.queue = queue
 							}
-							// Agent登録情報とSQSメッセージ内のAgetnIDを照合して、合致したらActionを実行する処理
-							// Agent登録情報とSQSメッセージ属性値のAgentIDが合致していてもメッセージ改ざんしているかをチェックする処理
+							// Agent登録情報とメッセージ内のAgetnIDを照合して、合致したらActionを実行する処理
+							// Agent登録情報とメッセージ属性値のAgentIDが合致していてもメッセージ改ざんしているかをチェックする処理
 							if regInfo.AgentID == event.AgentID {
-								// SQSメッセージの可視時間にSQSメッセージ内のタイムアウト値に加えて2秒のバッファを設ける処理
+								// 署名済みのメッセージを再送された場合に実行しないように、古いEventは削除する
+								if err := checkEventTimestamp(&event, time.Now()); err != nil {
+									logging.Error("Rejecting a stale message so deleting the message.",
+										logging.Fields{"msgID": messageID, "eventID": event.EventID, "reason": err})
+									queue.Delete(msg.ReceiptHandle)
+									continue
+								}
+								// メッセージの可視時間にメッセージ内のタイムアウト値に加えて2秒のバッファを設ける処理
 								// これはアクションの処理中に競合することを回避する処理
-								changeMessageVisibility(svc, queue, event.ReceiptHandle, int64(event.Timeout+2))
+								// ただし最初のキープアライブまでに可視時間が切れないようにvisibilityExtensionSecsを下限とする
+								timeout := int64(event.Timeout + 2)
+								if timeout < visibilityExtensionSecs {
+									timeout = visibilityExtensionSecs
+								}
+								queue.ChangeVisibility(event.ReceiptHandle, timeout)
+								// Actionの実行や実行結果の送信が長引いても再度受信されないように可視時間を延長し続ける
+								event.keepalive = startVisibilityKeepalive(queue, event.ReceiptHandle, event.EventID)
 
 								logging.Debug("Pushing the message for processing.", logging.Fields{"eventID": event.EventID})
-								eventsChannel <- &event
+								select {
+								case eventsChannel <- &event:
+								case <-stopChannel:
+									// 実行しないEventはすぐに再度受信できるように可視時間を0にする
+									releaseEvent(&event, false)
+									queue.ChangeVisibility(event.ReceiptHandle, int64(0))
+									logging.Info("Stopped polling the action queue.", nil)
+									return nil
+								}
 								shouldSleep = false
 							} else {
-								// 本来はありえない場合。通常はSQSメッセージ属性値とSQSメッセージ内のAgentIDは合致するので異常な場合の処理
+								// 本来はありえない場合。通常はメッセージ属性値とメッセージ内のAgentIDは合致するので異常な場合の処理
 								logging.Error("Something is wrong!! Agent id present in the message attributes matches but "+
 									"agent id in event does not match. Deleting the message.",
 									logging.Fields{"msgID": messageID})
-								DeleteMessage(svc, queue, *msg.ReceiptHandle)
+								queue.Delete(msg.ReceiptHandle)
 							}
 						} else {
 							logging.Error("Cloud not verify the message with signature so deleting the message.",
-								logging.Fields{"error": err})
-							DeleteMessage(svc, queue, *msg.ReceiptHandle)
+								logging.Fields{"msgID": messageID, "reason": e})
+							queue.Delete(msg.ReceiptHandle)
 						}
 
 					} else {
-						// SQSメッセージ属性値AgentIDがAgent登録情報と一致しなかった場合の処理(他のAgentのメッセージと判断)
+						// メッセージ属性値AgentIDがAgent登録情報と一致しなかった場合の処理(他のAgentのメッセージと判断)
 						logging.Debug("Releasing a message which is not for me.", logging.Fields{"msgID": messageID})
-						// 他のAgentのメッセージの可能性があるため可視時間を無制限にする
-						changeMessageVisibility(svc, queue, *msg.ReceiptHandle, int64(0))
+						// 他のAgentのメッセージの可能性があるため可視時間を0にしてすぐに受信できるようにする
+						queue.ChangeVisibility(msg.ReceiptHandle, int64(0))
 					}
 				}
 			} else if shouldLogError {
-				// getMessagesによるSQSメッセージ取得に失敗してエラーとなった場合の処理
-				logging.Error("Could not receive message from SQS.", logging.Fields{
-					"error":    err,
-					"response": resp,
+				// Receiveによるメッセージ取得に失敗してエラーとなった場合の処理
+				logging.Error("Could not receive message from the action queue.", logging.Fields{
+					"error": err,
 				})
-				// getMessagesによるSQSメッセージ取得に失敗してエラーとなった場合にshouldLogErrorをfalseにする
+				// Receiveによるメッセージ取得に失敗してエラーとなった場合にshouldLogErrorをfalseにする
 				shouldLogError = false
 				numFailures++
 			} else {
-				// getMessagesによるSQSメッセージ取得に2回以上失敗した場合の処理
+				// Receiveによるメッセージ取得に2回以上失敗した場合の処理
 				numFailures++
 
 				// numFailuresがnumSQSFailuresBeforeReregistration回数に達したらnumFailuresとshouldLogErrorを初期化して
@@ -221,11 +360,11 @@ func RunLoop(regInfo *RegistrationInfo, regInfoUpdatesCh <-chan string, eventsCh
 					regChannel <- time.Now()
 				}
 			}
-			// SQSポーリングを少なくともsqsPollingFrequencySecsに定義した秒数Sleepさせる処理
+			// ポーリングを少なくともポーリング間隔(デフォルトはsqsPollingFrequencySecsに定義した秒数)Sleepさせる処理
 			if shouldSleep {
-				if duration := t1.Add(time.Second * sqsPollingFrequencySecs).Sub(time.Now()); duration > 0 {
+				if duration := t1.Add(getPollInterval()).Sub(time.Now()); duration > 0 {
 					logging.Debug("Sleeping between two polls.", logging.Fields{"duration": duration})
-					time.Sleep(duration)
+					sleepUnlessStopped(duration, stopChannel)
 				}
 			}
 		}
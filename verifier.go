@@ -1,6 +1,234 @@
 package agent
 
-// VerifyMessage はとりあえずtrueを返すファンクション
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// 署名アルゴリズムの定数
+const (
+	// AlgorithmEd25519 はEd25519署名
+	AlgorithmEd25519 = "ed25519"
+	// AlgorithmRSAPSS はSHA-256ダイジェストによるRSA-PSS署名
+	AlgorithmRSAPSS = "rsa-pss-sha256"
+	// signatureKeyIDSeparator はsignature属性のキーIDと署名値の区切り文字
+	// signature属性例：key-2016-07:BASE64署名値
+	signatureKeyIDSeparator = ":"
+	// defaultMaxEventAgeSecs はEventのtimestampから受け付ける最大の経過秒数のデフォルト
+	defaultMaxEventAgeSecs = 60 * 60
+	// maxEventClockSkew はServerとAgentの時刻のずれとして許容する、未来のtimestampの範囲
+	maxEventClockSkew = time.Minute * 5
+)
+
+// VerificationKey はSQSメッセージの署名を検証するServerの公開鍵の構造体
+// PublicKeyはPEM形式(PKIX)の公開鍵
+type VerificationKey struct {
+	KeyID     string
+	Algorithm string
+	PublicKey string
+}
+
+// verificationKey はパース済みの公開鍵の構造体
+type verificationKey struct {
+	keyID     string
+	algorithm string
+	publicKey crypto.PublicKey
+}
+
+// keyStore は有効な公開鍵をキーIDごとに保持する
+// キーローテーション中は複数のキーIDが同時に有効になる
+var keyStore = struct {
+	sync.RWMutex
+	keys map[string]*verificationKey
+}{keys: map[string]*verificationKey{}}
+
+// eventAgeLimit はEventのtimestampから受け付ける最大の経過時間
+// 署名済みのメッセージを再送されても、Action実行記録が期限切れになった後に二重に実行しないようにする
+var eventAgeLimit = struct {
+	sync.RWMutex
+	maxAge time.Duration
+}{maxAge: time.Second * defaultMaxEventAgeSecs}
+
+// ConfigureMaxEventAge はEventのtimestampから受け付ける最大の経過秒数を設定するファンクション。0の場合はデフォルト
+func ConfigureMaxEventAge(secs int) {
+	if secs <= 0 {
+		secs = defaultMaxEventAgeSecs
+	}
+	eventAgeLimit.Lock()
+	eventAgeLimit.maxAge = time.Second * time.Duration(secs)
+	eventAgeLimit.Unlock()
+}
+
+// checkEventTimestamp はEventのtimestampが受け付ける範囲にあるかを検証するファンクション
+// timestampがないEvent、最大の経過時間より古いEvent、maxEventClockSkewより未来のEventは拒否理由をエラーとして返却する
+func checkEventTimestamp(event *Event, now time.Time) error {
+	if event.Timestamp <= 0 {
+		return errors.New("Event does not have timestamp.")
+	}
+	eventAgeLimit.RLock()
+	maxAge := eventAgeLimit.maxAge
+	eventAgeLimit.RUnlock()
+
+	age := now.Sub(time.Unix(0, event.Timestamp*int64(time.Millisecond)))
+	if age > maxAge {
+		return errors.New("Event is too old: " + strconv.FormatInt(int64(age/time.Second), 10) + " seconds.")
+	}
+	if age < -maxEventClockSkew {
+		return errors.New("Event timestamp is in the future: " + strconv.FormatInt(int64(-age/time.Second), 10) + " seconds.")
+	}
+	return nil
+}
+
+// parseVerificationKey はVerificationKeyの公開鍵をパースしてアルゴリズムと一致するか検証するファンクション
+func parseVerificationKey(key VerificationKey) (*verificationKey, error) {
+	if len(key.KeyID) == 0 {
+		return nil, errors.New("Verification key does not have key id.")
+	}
+	block, _ := pem.Decode([]byte(key.PublicKey))
+	if block == nil {
+		return nil, errors.New("Could not decode PEM public key.")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.Algorithm {
+	case AlgorithmEd25519:
+		if _, ok := publicKey.(ed25519.PublicKey); !ok {
+			return nil, errors.New("Public key is not an Ed25519 key.")
+		}
+	case AlgorithmRSAPSS:
+		if _, ok := publicKey.(*rsa.PublicKey); !ok {
+			return nil, errors.New("Public key is not an RSA key.")
+		}
+	default:
+		return nil, errors.New("Unsupported signature algorithm: " + key.Algorithm)
+	}
+	return &verificationKey{keyID: key.KeyID, algorithm: key.Algorithm, publicKey: publicKey}, nil
+}
+
+// SetVerificationKeys はSQSメッセージの検証に使う公開鍵を入れ替えるファンクション
+// AgentConfigで固定した公開鍵とRegistrationInfoで配布された公開鍵をまとめて渡す
+// パースできない公開鍵はスキップし、有効な公開鍵が1つもない場合はエラーを返却する
+func SetVerificationKeys(keys []VerificationKey) error {
+	parsed := map[string]*verificationKey{}
+	for _, key := range keys {
+		k, err := parseVerificationKey(key)
+		if err != nil {
+			logging.Error("Could not parse the verification key. Skipping.", logging.Fields{"keyID": key.KeyID, "error": err})
+			continue
+		}
+		parsed[k.keyID] = k
+	}
+
+	keyStore.Lock()
+	keyStore.keys = parsed
+	keyStore.Unlock()
+
+	if len(parsed) == 0 {
+		return errors.New("No valid verification keys.")
+	}
+	logging.Info("Updated the verification keys.", logging.Fields{"count": len(parsed)})
+	return nil
+}
+
+// verify は1つの公開鍵でメッセージの署名を検証するファンクション
+func (k *verificationKey) verify(message, signature []byte) bool {
+	switch k.algorithm {
+	case AlgorithmEd25519:
+		return ed25519.Verify(k.publicKey.(ed25519.PublicKey), message, signature)
+	case AlgorithmRSAPSS:
+		digest := sha256.Sum256(message)
+		err := rsa.VerifyPSS(k.publicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		return err == nil
+	}
+	return false
+}
+
+// VerifyMessage はSQSメッセージ本文をsignature属性の署名で検証するファンクション
+// signature属性は「キーID:BASE64署名値」の形式で、キーIDがない場合は有効な全ての公開鍵で検証する
+// 検証に失敗した場合は拒否理由をエラーとして返却する
 func VerifyMessage(message, signature string) (bool, error) {
-	return true, nil
+	keyID := ""
+	encoded := signature
+	if i := strings.LastIndex(signature, signatureKeyIDSeparator); i >= 0 {
+		keyID = signature[:i]
+		encoded = signature[i+len(signatureKeyIDSeparator):]
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sig) == 0 {
+		return false, errors.New("Signature is not valid base64.")
+	}
+
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+
+	if len(keyStore.keys) == 0 {
+		return false, errors.New("No verification keys are configured.")
+	}
+
+	if len(keyID) > 0 {
+		key, ok := keyStore.keys[keyID]
+		if !ok {
+			return false, errors.New("Unknown verification key id: " + keyID)
+		}
+		if !key.verify([]byte(message), sig) {
+			return false, errors.New("Signature does not match for key id: " + keyID)
+		}
+		return true, nil
+	}
+
+	for _, key := range keyStore.keys {
+		if key.verify([]byte(message), sig) {
+			return true, nil
+		}
+	}
+	return false, errors.New("Signature does not match any verification key.")
+}
+
+// SignMessage はPEM形式(PKCS#8)の秘密鍵でメッセージに署名して、signature属性の形式(「キーID:BASE64署名値」)で返却するファンクション
+// Ed25519の秘密鍵はAlgorithmEd25519、RSAの秘密鍵はAlgorithmRSAPSSで署名する
+// exec-eventでローカルのEventに署名する場合に使い、検証にはAgentConfigのVerificationKeysに対応する公開鍵が必要
+func SignMessage(message []byte, keyID string, privateKeyPEM []byte) (string, error) {
+	if len(keyID) == 0 || strings.Contains(keyID, signatureKeyIDSeparator) {
+		return "", errors.New("Invalid key id: " + keyID)
+	}
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return "", errors.New("Could not decode PEM private key.")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	var sig []byte
+	switch key := privateKey.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, message)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(message)
+		if sig, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("Private key must be an Ed25519 or RSA key.")
+	}
+	return keyID + signatureKeyIDSeparator + base64.StdEncoding.EncodeToString(sig), nil
 }
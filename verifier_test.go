@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 8032 7.1 TEST 1のEd25519のテストベクタ(空のメッセージ)
+const (
+	rfc8032PublicKey = "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+	rfc8032Signature = "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"
+)
+
+// encodePublicKey は公開鍵をPEM形式(PKIX)に変換するファンクション
+func encodePublicKey(t *testing.T, publicKey crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// setTestVerificationKeys はテストの間だけ有効な公開鍵を入れ替えるファンクション
+func setTestVerificationKeys(t *testing.T, keys ...VerificationKey) {
+	if err := SetVerificationKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetVerificationKeys(nil) })
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestVerifyMessageEd25519Vector(t *testing.T) {
+	publicKey := ed25519.PublicKey(mustDecodeHex(t, rfc8032PublicKey))
+	setTestVerificationKeys(t, VerificationKey{KeyID: "rfc8032", Algorithm: AlgorithmEd25519, PublicKey: encodePublicKey(t, publicKey)})
+
+	signature := base64.StdEncoding.EncodeToString(mustDecodeHex(t, rfc8032Signature))
+	if ok, err := VerifyMessage("", "rfc8032:"+signature); !ok || err != nil {
+		t.Errorf("RFC 8032 vector should verify: %v", err)
+	}
+	if ok, _ := VerifyMessage("x", "rfc8032:"+signature); ok {
+		t.Error("signature should not verify a different message")
+	}
+}
+
+func TestVerifyMessage(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestVerificationKeys(t,
+		VerificationKey{KeyID: "ed-key", Algorithm: AlgorithmEd25519, PublicKey: encodePublicKey(t, edPublic)},
+		VerificationKey{KeyID: "key:2016:07", Algorithm: AlgorithmRSAPSS, PublicKey: encodePublicKey(t, &rsaPrivate.PublicKey)},
+	)
+
+	message := `{"EventID":"event","RawCommand":"service nginx restart"}`
+	edSignature := base64.StdEncoding.EncodeToString(ed25519.Sign(edPrivate, []byte(message)))
+	digest := sha256.Sum256([]byte(message))
+	rsaRaw, err := rsa.SignPSS(rand.Reader, rsaPrivate, crypto.SHA256, digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSignature := base64.StdEncoding.EncodeToString(rsaRaw)
+	badSignature := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))
+
+	tests := []struct {
+		name      string
+		message   string
+		signature string
+		ok        bool
+	}{
+		{"ed25519 with key id", message, "ed-key:" + edSignature, true},
+		{"ed25519 without key id", message, edSignature, true},
+		{"rsa-pss with key id containing the separator", message, "key:2016:07:" + rsaSignature, true},
+		{"rsa-pss without key id", message, rsaSignature, true},
+		{"tampered message", message + " ", "ed-key:" + edSignature, false},
+		{"signature for another key id", message, "key:2016:07:" + edSignature, false},
+		{"unknown key id", message, "unknown:" + edSignature, false},
+		{"bad signature", message, "ed-key:" + badSignature, false},
+		{"bad signature without key id", message, badSignature, false},
+		{"not base64", message, "ed-key:***", false},
+		{"empty signature", message, "ed-key:", false},
+		{"empty attribute", message, "", false},
+	}
+	for _, test := range tests {
+		ok, err := VerifyMessage(test.message, test.signature)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v, want %v (%v)", test.name, ok, test.ok, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%s: rejected signature should have a reason", test.name)
+		}
+	}
+}
+
+func TestVerifyMessageWithoutKeys(t *testing.T) {
+	SetVerificationKeys(nil)
+	signature := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))
+	if ok, err := VerifyMessage("message", signature); ok || err == nil {
+		t.Error("messages should be rejected when no keys are configured")
+	}
+}
+
+func TestSetVerificationKeysSkipsInvalidKeys(t *testing.T) {
+	edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := []VerificationKey{
+		{KeyID: "", Algorithm: AlgorithmEd25519, PublicKey: encodePublicKey(t, edPublic)},
+		{KeyID: "not-pem", Algorithm: AlgorithmEd25519, PublicKey: "not a key"},
+		{KeyID: "mismatch", Algorithm: AlgorithmRSAPSS, PublicKey: encodePublicKey(t, edPublic)},
+		{KeyID: "mismatch-rsa", Algorithm: AlgorithmEd25519, PublicKey: encodePublicKey(t, &rsaPrivate.PublicKey)},
+		{KeyID: "unsupported", Algorithm: "hmac-sha256", PublicKey: encodePublicKey(t, edPublic)},
+	}
+	if err := SetVerificationKeys(invalid); err == nil {
+		t.Error("only invalid keys should be an error")
+	}
+	setTestVerificationKeys(t, append(invalid, VerificationKey{KeyID: "valid", Algorithm: AlgorithmEd25519, PublicKey: encodePublicKey(t, edPublic)})...)
+	keyStore.RLock()
+	count := len(keyStore.keys)
+	keyStore.RUnlock()
+	if count != 1 {
+		t.Errorf("valid keys = %d, want 1", count)
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestVerificationKeys(t,
+		VerificationKey{KeyID: "ed", Algorithm: AlgorithmEd25519, PublicKey: encodePublicKey(t, edPublic)},
+		VerificationKey{KeyID: "rsa", Algorithm: AlgorithmRSAPSS, PublicKey: encodePublicKey(t, &rsaPrivate.PublicKey)},
+	)
+
+	message := []byte(`{"eventid":"event"}`)
+	for keyID, privateKey := range map[string]interface{}{"ed": edPrivate, "rsa": rsaPrivate} {
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := SignMessage(message, keyID, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		if err != nil {
+			t.Fatalf("%s: %v", keyID, err)
+		}
+		if !strings.HasPrefix(signature, keyID+":") {
+			t.Errorf("%s: signature = %q, want the key id prefix", keyID, signature)
+		}
+		if ok, err := VerifyMessage(string(message), signature); !ok {
+			t.Errorf("%s: signed message does not verify: %v", keyID, err)
+		}
+	}
+
+	if _, err := SignMessage(message, "a:b", nil); err == nil {
+		t.Error("key id containing the separator should be rejected")
+	}
+	if _, err := SignMessage(message, "ed", []byte("not pem")); err == nil {
+		t.Error("invalid private key should be rejected")
+	}
+}
+
+func TestCheckEventTimestamp(t *testing.T) {
+	defer ConfigureMaxEventAge(0)
+	ConfigureMaxEventAge(600)
+
+	now := time.Now()
+	millis := func(d time.Duration) int64 { return now.Add(d).UnixNano() / int64(time.Millisecond) }
+	tests := []struct {
+		name      string
+		timestamp int64
+		wantErr   bool
+	}{
+		{"fresh", millis(-time.Minute), false},
+		{"within window", millis(-time.Second * 599), false},
+		{"too old", millis(-time.Second * 601), true},
+		{"small clock skew", millis(time.Minute), false},
+		{"far future", millis(maxEventClockSkew + time.Minute), true},
+		{"missing", 0, true},
+	}
+	for _, test := range tests {
+		err := checkEventTimestamp(&Event{Timestamp: test.timestamp}, now)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", test.name, err, test.wantErr)
+		}
+	}
+
+	ConfigureMaxEventAge(0)
+	if err := checkEventTimestamp(&Event{Timestamp: millis(-time.Second * 601)}, now); err != nil {
+		t.Errorf("default window should accept a 10 minute old event: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"github.com/tsubauaaa/agent/logging"
+)
+
+// ワーカープールの定数
+const (
+	defaultMaxConcurrentActions = 4
+	// maxPendingActions は実行待ちとして保持するEventの上限
+	// 上限に達するとeventsChannelの受信を止めるため、RunLoopはeventsChannelへのプッシュで待たされる
+	maxPendingActions = 100
+)
+
+// workerPool はActionを並列に実行するワーカープールの構造体
+// RuleIDかRunbookNameが実行中のEventと同じEventは実行待ちにして、受信順に1つずつ実行する
+type workerPool struct {
+	maxWorkers int
+	running    int
+	pending    []*Event
+	busyKeys   map[string]bool
+	// accepted は実行待ちか実行中のEventをAction実行記録のキーごとに保持する
+	accepted       map[string]*Event
+	done           chan *Event
+	ledger         *ActionLedger
+	resultsChannel chan<- *ActionResult
+}
+
+// newWorkerPool はワーカープールを生成するファンクション
+func newWorkerPool(maxWorkers int, ledger *ActionLedger, resultsChannel chan<- *ActionResult) *workerPool {
+	return &workerPool{
+		maxWorkers:     maxWorkers,
+		busyKeys:       map[string]bool{},
+		accepted:       map[string]*Event{},
+		done:           make(chan *Event, maxWorkers),
+		ledger:         ledger,
+		resultsChannel: resultsChannel,
+	}
+}
+
+// acceptEvent はAction実行記録を調べて、Eventを実行するかを判断するファンクション
+// 重複したEventは実行せず、完了済みの場合は記録した実行結果を再度送信してメッセージを削除させる
+func (p *workerPool) acceptEvent(event *Event) bool {
+	if p.ledger == nil {
+		return true
+	}
+	entry, isNew := p.ledger.begin(event)
+	if isNew {
+		return true
+	}
+
+	fields := logging.Fields{"eventID": event.EventID, "inflightActionID": event.InflightActionID}
+	switch {
+	case entry.State == ledgerStateCompleted && entry.Result != nil:
+		// 出力は記録していないため、ステータスと終了コードだけを再度送信する
+		logging.Info("Skipping the duplicate event. Reporting the stored result.", fields)
+		pushResult(entry.Result.actionResult(event), p.resultsChannel)
+	case p.ledger.isActive(event):
+		// 実行中のEventがメッセージを削除するため、重複したメッセージは削除しない
+		// 古いReceiptHandleでは可視時間の延長と削除ができないため、実行中のEventに新しいReceiptHandleを引き継いでから重複したEventの延長を止める
+		logging.Info("Skipping the duplicate event which is already running.", fields)
+		if accepted, ok := p.accepted[ledgerKey(event)]; ok && accepted.queue == event.queue {
+			accepted.keepalive.renew(event.ReceiptHandle)
+		}
+		releaseEvent(event, false)
+	default:
+		// 前回のAgentプロセスで実行中に停止したEventは、再実行せずに中断したことを送信する
+		logging.Warn("Skipping the duplicate event interrupted in the previous run.", fields)
+		result := newActionResult(event)
+		result.EndTime = result.StartTime
+		result.Status = ActionStatusInterrupted
+		result.ExitCode = -1
+		result.ErrorMessage = "Action was interrupted before completion."
+		p.ledger.complete(event, result)
+		pushResult(result, p.resultsChannel)
+	}
+	return false
+}
+
+// serializationKeys は同時に実行してはいけないEventを判別するキーを返却するファンクション
+func serializationKeys(event *Event) []string {
+	var keys []string
+	if len(event.RuleID) > 0 {
+		keys = append(keys, "rule:"+event.RuleID)
+	}
+	if len(event.RunbookName) > 0 {
+		keys = append(keys, "runbook:"+event.RunbookName)
+	}
+	return keys
+}
+
+// isBusy はいずれかのキーが使用中かを返却するファンクション
+func isBusy(keys []string, busyKeys map[string]bool) bool {
+	for _, key := range keys {
+		if busyKeys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch は実行待ちのEventを受信順に調べて、空いているワーカーで実行できるEventを実行するファンクション
+func (p *workerPool) dispatch() {
+	// 実行待ちのまま残したEventのキーは、後続のEventが追い越さないように使用中として扱う
+	blockedKeys := map[string]bool{}
+	var remaining []*Event
+	for _, event := range p.pending {
+		keys := serializationKeys(event)
+		if p.running >= p.maxWorkers || isBusy(keys, p.busyKeys) || isBusy(keys, blockedKeys) {
+			for _, key := range keys {
+				blockedKeys[key] = true
+			}
+			remaining = append(remaining, event)
+			continue
+		}
+
+		for _, key := range keys {
+			p.busyKeys[key] = true
+		}
+		p.running++
+		go func(event *Event) {
+			handleEvent(event, p.ledger, p.resultsChannel)
+			p.done <- event
+		}(event)
+	}
+	p.pending = remaining
+	setQueuedActions(len(p.pending))
+}
+
+// run はeventsChannelが閉じられて全てのActionが完了するまでEventを受信して実行するファンクション
+func (p *workerPool) run(eventsChannel <-chan *Event) {
+	for eventsChannel != nil || p.running > 0 || len(p.pending) > 0 {
+		in := eventsChannel
+		if len(p.pending) >= maxPendingActions {
+			in = nil
+		}
+
+		select {
+		case event, ok := <-in:
+			if !ok {
+				eventsChannel = nil
+				break
+			}
+			if !p.acceptEvent(event) {
+				break
+			}
+			p.accepted[ledgerKey(event)] = event
+			logging.Debug("Queued the event.", logging.Fields{"eventID": event.EventID, "pending": len(p.pending) + 1})
+			p.pending = append(p.pending, event)
+
+		case event := <-p.done:
+			p.running--
+			delete(p.accepted, ledgerKey(event))
+			for _, key := range serializationKeys(event) {
+				delete(p.busyKeys, key)
+			}
+		}
+		p.dispatch()
+	}
+}
@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// actionRecorder はhttpのActionを受け付けて、パスごとに同時に実行したリクエストの最大数を記録するテスト用のサーバ
+// releaseが閉じられるまで応答を待たせる
+type actionRecorder struct {
+	mu         sync.Mutex
+	running    map[string]int
+	maxRunning map[string]int
+	total      int
+	maxTotal   int
+	requests   int
+	order      []string
+	release    chan struct{}
+	started    chan string
+}
+
+// newActionRecorder はactionRecorderを起動するファンクション
+func newActionRecorder(t *testing.T) (*actionRecorder, *httptest.Server) {
+	recorder := &actionRecorder{
+		running:    map[string]int{},
+		maxRunning: map[string]int{},
+		release:    make(chan struct{}),
+		started:    make(chan string, 100),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder.mu.Lock()
+		recorder.requests++
+		recorder.running[r.URL.Path]++
+		recorder.total++
+		recorder.order = append(recorder.order, r.URL.Path+"?"+r.URL.RawQuery)
+		if recorder.running[r.URL.Path] > recorder.maxRunning[r.URL.Path] {
+			recorder.maxRunning[r.URL.Path] = recorder.running[r.URL.Path]
+		}
+		if recorder.total > recorder.maxTotal {
+			recorder.maxTotal = recorder.total
+		}
+		recorder.mu.Unlock()
+		recorder.started <- r.URL.Path
+
+		select {
+		case <-recorder.release:
+		case <-time.After(time.Millisecond * 50):
+		}
+
+		recorder.mu.Lock()
+		recorder.running[r.URL.Path]--
+		recorder.total--
+		recorder.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return recorder, server
+}
+
+// newWorkerPoolTestEvent はserverにhttpリクエストを送るEventを生成するファンクション
+func newWorkerPoolTestEvent(t *testing.T, server *httptest.Server, eventID, runbookName string) *Event {
+	event := newPolicyTestEvent(t, actionTypeHTTP, httpParameters{URL: server.URL + "/" + runbookName + "?" + eventID})
+	event.EventID = eventID
+	event.RunbookName = runbookName
+	return event
+}
+
+// waitFor はcondがtrueになるまで待つファンクション
+func waitFor(t *testing.T, message string, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for " + message)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWorkerPoolSerializesRunbook(t *testing.T) {
+	recorder, server := newActionRecorder(t)
+	events := make(chan *Event, 10)
+	results := make(chan *ActionResult, 10)
+	for _, eventID := range []string{"1", "2", "3"} {
+		events <- newWorkerPoolTestEvent(t, server, eventID, "runbook")
+	}
+	events <- newWorkerPoolTestEvent(t, server, "4", "other")
+	close(events)
+
+	newWorkerPool(4, nil, results).run(events)
+	close(results)
+
+	for result := range results {
+		if result.Status != ActionStatusSucceeded {
+			t.Errorf("event %s: status = %s", result.EventID, result.Status)
+		}
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if recorder.maxRunning["/runbook"] != 1 {
+		t.Errorf("same runbook ran %d at once, want 1", recorder.maxRunning["/runbook"])
+	}
+	if recorder.maxTotal < 2 {
+		t.Errorf("different runbooks should run concurrently, max = %d", recorder.maxTotal)
+	}
+	var runbookOrder []string
+	for _, request := range recorder.order {
+		if request != "/other?4" {
+			runbookOrder = append(runbookOrder, request)
+		}
+	}
+	if len(runbookOrder) != 3 || runbookOrder[0] != "/runbook?1" || runbookOrder[1] != "/runbook?2" || runbookOrder[2] != "/runbook?3" {
+		t.Errorf("runbook order = %v, want the received order", runbookOrder)
+	}
+}
+
+func TestWorkerPoolReportsCompletedDuplicate(t *testing.T) {
+	recorder, server := newActionRecorder(t)
+	ledger, err := OpenActionLedger(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan *ActionResult, 10)
+
+	first := newWorkerPoolTestEvent(t, server, "event", "runbook")
+	first.InflightActionID = "inflight"
+	events := make(chan *Event, 1)
+	events <- first
+	close(events)
+	newWorkerPool(4, ledger, results).run(events)
+	if result := <-results; result.Status != ActionStatusSucceeded || result.OutputUnavailable {
+		t.Fatalf("first result = %+v", result)
+	}
+
+	duplicate := newWorkerPoolTestEvent(t, server, "event", "runbook")
+	duplicate.InflightActionID = "inflight"
+	events = make(chan *Event, 1)
+	events <- duplicate
+	close(events)
+	newWorkerPool(4, ledger, results).run(events)
+
+	result := <-results
+	if result.Status != ActionStatusSucceeded || !result.OutputUnavailable || result.event != duplicate {
+		t.Errorf("duplicate should report the stored result: %+v", result)
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if recorder.requests != 1 {
+		t.Errorf("action ran %d times, want 1", recorder.requests)
+	}
+}
+
+// TestWorkerPoolHandsOverReceiptHandleOfRunningDuplicate は実行中のEventと同じメッセージを再度受信した場合に、
+// 重複したEventを実行も削除もせず、実行中のEventが新しいReceiptHandleでメッセージを削除することを確認するテスト
+func TestWorkerPoolHandsOverReceiptHandleOfRunningDuplicate(t *testing.T) {
+	recorder, server := newActionRecorder(t)
+	ledger, err := OpenActionLedger(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := &fakeActionQueue{}
+	newQueuedEvent := func(receiptHandle string) *Event {
+		event := newWorkerPoolTestEvent(t, server, "event", "runbook")
+		event.InflightActionID = "inflight"
+		event.ReceiptHandle = receiptHandle
+		event.queue = queue
+		event.keepalive = startVisibilityKeepalive(queue, receiptHandle, event.EventID)
+		return event
+	}
+
+	events := make(chan *Event)
+	results := make(chan *ActionResult, 10)
+	done := make(chan struct{})
+	go func() {
+		newWorkerPool(4, ledger, results).run(events)
+		close(done)
+	}()
+
+	original := newQueuedEvent("first")
+	events <- original
+	<-recorder.started
+
+	duplicate := newQueuedEvent("second")
+	events <- duplicate
+	waitFor(t, "the receipt handle hand over", func() bool {
+		select {
+		case <-duplicate.keepalive.stop:
+			return original.keepalive.currentReceiptHandle() == "second"
+		default:
+			return false
+		}
+	})
+	if deleted := queue.deletedHandles(); len(deleted) != 0 {
+		t.Errorf("duplicate should not delete the message: %v", deleted)
+	}
+
+	close(recorder.release)
+	close(events)
+	<-done
+	close(results)
+
+	var reported []*ActionResult
+	for result := range results {
+		reported = append(reported, result)
+	}
+	if len(reported) != 1 || reported[0].event != original {
+		t.Fatalf("want only the original result, got %d results", len(reported))
+	}
+	releaseEvent(reported[0].event, true)
+	if deleted := queue.deletedHandles(); len(deleted) != 1 || deleted[0] != "second" {
+		t.Errorf("deleted = %v, want the newest receipt handle", deleted)
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if recorder.requests != 1 {
+		t.Errorf("action ran %d times, want 1", recorder.requests)
+	}
+}